@@ -0,0 +1,100 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pigeond-io/pigeond/common/utils"
+	"strings"
+)
+
+var (
+	AclClaim = "acl" // Name of the jwt claim holding the topic acl
+)
+
+/*
+	Topic ACL granted by the token. The acl claim holds glob lists of the topics that can be subscribed & published
+
+	{"sid": "s1", "uid": "u1", "acl": {"subscribe": ["news.*", "user.u1"], "publish": ["chat.u1.*"]}}
+
+	A missing list grants nothing. Tokens without the acl claim are not scoped
+*/
+type TopicAcl struct {
+	Subscribe []string
+	Publish   []string
+}
+
+// Parses the acl claim. Returns nil if the claims are not scoped
+func ParseTopicAcl(claims jwt.MapClaims) *TopicAcl {
+	if claims == nil {
+		return nil
+	}
+	value, ok := claims[AclClaim].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return &TopicAcl{
+		Subscribe: stringList(value["subscribe"]),
+		Publish:   stringList(value["publish"]),
+	}
+}
+
+func stringList(value interface{}) []string {
+	var list []string
+	switch v := value.(type) {
+	case string:
+		list = append(list, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// nil acl allows every topic
+func (acl *TopicAcl) CanSubscribe(topic string) bool {
+	return acl == nil || matchesAny(acl.Subscribe, topic)
+}
+
+func (acl *TopicAcl) CanPublish(topic string) bool {
+	return acl == nil || matchesAny(acl.Publish, topic)
+}
+
+// A pattern can be subscribed only if every topic it can match is allowed.
+// That is the case when it is one of the allowed globs, a topic allowed literally,
+// or it starts with the literal prefix of an allowed glob ending with *
+func (acl *TopicAcl) CanPSubscribe(pattern string) bool {
+	if acl == nil {
+		return true
+	}
+	for _, glob := range acl.Subscribe {
+		if glob == pattern {
+			return true
+		}
+		if strings.HasSuffix(glob, "*") {
+			prefix := glob[:len(glob)-1]
+			if !hasGlobChars(prefix) && strings.HasPrefix(pattern, prefix) {
+				return true
+			}
+		}
+	}
+	return !hasGlobChars(pattern) && matchesAny(acl.Subscribe, pattern)
+}
+
+func matchesAny(globs []string, topic string) bool {
+	for _, glob := range globs {
+		if utils.GlobMatch(glob, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasGlobChars(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package auth_test
+
+import (
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pigeond-io/pigeond/common/auth"
+	"testing"
+)
+
+func parseAcl(t *testing.T, claimsJson string) *auth.TopicAcl {
+	var claims jwt.MapClaims
+	if err := json.Unmarshal([]byte(claimsJson), &claims); err != nil {
+		t.Fatal(err)
+	}
+	return auth.ParseTopicAcl(claims)
+}
+
+func TestUnscopedAcl(t *testing.T) {
+	acl := parseAcl(t, `{"sid": "s1"}`)
+	if acl != nil {
+		t.Fatal("Expected nil acl without acl claim")
+	}
+	if !acl.CanSubscribe("any") || !acl.CanPSubscribe("*") || !acl.CanPublish("any") {
+		t.Error("Expected nil acl to allow every topic")
+	}
+}
+
+func TestScopedAcl(t *testing.T) {
+	acl := parseAcl(t, `{"acl": {"subscribe": ["news.*", "user.u1"], "publish": "chat.u1.*"}}`)
+	cases := []struct {
+		name     string
+		can      func(string) bool
+		topic    string
+		expected bool
+	}{
+		{"subscribe", acl.CanSubscribe, "news.sports", true},
+		{"subscribe", acl.CanSubscribe, "user.u1", true},
+		{"subscribe", acl.CanSubscribe, "user.u2", false},
+		{"psubscribe", acl.CanPSubscribe, "news.*", true},
+		{"psubscribe", acl.CanPSubscribe, "news.sports.*", true},
+		{"psubscribe", acl.CanPSubscribe, "user.u1", true},
+		{"psubscribe", acl.CanPSubscribe, "user.u?", false},
+		{"psubscribe", acl.CanPSubscribe, "*", false},
+		{"publish", acl.CanPublish, "chat.u1.room", true},
+		{"publish", acl.CanPublish, "news.sports", false},
+	}
+	for _, c := range cases {
+		if c.can(c.topic) != c.expected {
+			t.Errorf("Expected %s %q to be %v", c.name, c.topic, c.expected)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/log"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound       = errors.New("Verification key not found")
+	FileKeyCheckInterval = 30 * time.Second // Interval at which key files are checked for changes
+)
+
+// KeySet resolves the key used to verify a token signature
+type KeySet interface {
+	// Returns the key identified by kid that can verify signatures of the alg algorithm.
+	// Keys without id are used when kid is empty or unknown.
+	Key(kid string, alg string) (interface{}, error)
+}
+
+/*
+  Immutable KeySet of HMAC secrets ([]byte), *rsa.PublicKey and *ecdsa.PublicKey keys
+*/
+type StaticKeySet struct {
+	keys map[string][]interface{} // Keys grouped by kid
+}
+
+func MakeStaticKeySet() *StaticKeySet {
+	return &StaticKeySet{keys: make(map[string][]interface{})}
+}
+
+// Adds key with the id kid. Empty kid adds a default key
+func (s *StaticKeySet) Add(kid string, key interface{}) *StaticKeySet {
+	s.keys[kid] = append(s.keys[kid], key)
+	return s
+}
+
+func (s *StaticKeySet) Len() int {
+	count := 0
+	for _, keys := range s.keys {
+		count += len(keys)
+	}
+	return count
+}
+
+func (s *StaticKeySet) Key(kid string, alg string) (interface{}, error) {
+	if kid != "" {
+		if keys, ok := s.keys[kid]; ok {
+			return findKey(keys, alg)
+		}
+	}
+	return findKey(s.keys[""], alg)
+}
+
+// Finds the first key usable with the algorithm.
+// Key types are checked against the algorithm family so that a public key can never be used as a HMAC secret
+func findKey(keys []interface{}, alg string) (interface{}, error) {
+	for _, key := range keys {
+		switch key.(type) {
+		case []byte:
+			if strings.HasPrefix(alg, "HS") {
+				return key, nil
+			}
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS") {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if strings.HasPrefix(alg, "ES") {
+				return key, nil
+			}
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+/*
+  KeySet loaded from a PEM or a JWKS (*.json) file.
+  The file is reloaded when it changes, which allows key rotation by kid without restarts.
+  If a reload fails the previously loaded keys are kept.
+*/
+type FileKeySet struct {
+	path      string
+	keys      *StaticKeySet
+	modTime   time.Time // Modification time of the loaded file
+	checkedAt time.Time // Last time the file was checked for changes
+	lock      sync.RWMutex
+}
+
+func MakeFileKeySet(path string) (*FileKeySet, error) {
+	s := &FileKeySet{path: path}
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileKeySet) Key(kid string, alg string) (interface{}, error) {
+	l := &s.lock
+	l.RLock()
+	keys := s.keys
+	shouldCheck := time.Since(s.checkedAt) > FileKeyCheckInterval
+	l.RUnlock()
+	if shouldCheck {
+		err := s.reload()
+		if err != nil {
+			log.WithFields("auth.keys", "Reload", s.path).Error(err)
+		}
+		l.RLock()
+		keys = s.keys
+		l.RUnlock()
+	}
+	return keys.Key(kid, alg)
+}
+
+// Reloads the file if it has been modified since it was last loaded
+func (s *FileKeySet) reload() error {
+	l := &s.lock
+	l.Lock()
+	defer l.Unlock()
+	s.checkedAt = time.Now()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.keys != nil && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys *StaticKeySet
+	if strings.EqualFold(filepath.Ext(s.path), ".json") {
+		keys, err = ParseJWKS(content)
+	} else {
+		keys, err = ParsePEM(content)
+	}
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// Parses all the public keys and certificates from PEM encoded content. The keys are added as default keys
+func ParsePEM(content []byte) (*StaticKeySet, error) {
+	keys := MakeStaticKeySet()
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys.Add("", key)
+		default:
+			return nil, fmt.Errorf("Unsupported public key %T", key)
+		}
+	}
+	if keys.Len() == 0 {
+		return nil, errors.New("No public key found in PEM")
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// Parses a JSON Web Key Set (RFC 7517). RSA, EC (P-256, P-384, P-521) and oct keys are supported
+func ParseJWKS(content []byte) (*StaticKeySet, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(content, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := MakeStaticKeySet()
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Key %q: %v", jwk.Kid, err)
+		}
+		keys.Add(jwk.Kid, key)
+	}
+	if keys.Len() == 0 {
+		return nil, errors.New("No signing key found in JWKS")
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", jwk.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	slice, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(slice) == 0 {
+		return nil, errors.New("Empty key parameter")
+	}
+	return new(big.Int).SetBytes(slice), nil
+}
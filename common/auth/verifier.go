@@ -0,0 +1,158 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("Invalid Token")
+	ErrExpired      = errors.New("Token is expired")
+	ErrNotValidYet  = errors.New("Token is not valid yet")
+	ErrIssuer       = errors.New("Token issuer is not accepted")
+	ErrAudience     = errors.New("Token audience is not accepted")
+)
+
+// Verifier parses a token and verifies its signature & claims
+type Verifier interface {
+	Parse(token string) (*jwt.Token, error)
+}
+
+type VerifierOptions struct {
+	Algorithms []string      // Accepted signing algorithms. When empty any algorithm matching the key type is accepted
+	Issuer     string        // Expected iss claim. Empty skips the check
+	Audience   string        // Expected to be one of the aud claim values. Empty skips the check
+	Leeway     time.Duration // Clock skew tolerated while validating exp, nbf & iat claims
+	RequireExp bool          // Rejects tokens without exp claim
+}
+
+/*
+  JWT Verifier that supports HMAC (HS*), RSA (RS*, PS*) and ECDSA (ES*) signatures.
+  Keys are resolved by the kid header from the KeySet.
+*/
+type JwtVerifier struct {
+	keys    KeySet
+	options VerifierOptions
+	parser  *jwt.Parser
+}
+
+func MakeJwtVerifier(keys KeySet, options VerifierOptions) *JwtVerifier {
+	return &JwtVerifier{
+		keys:    keys,
+		options: options,
+		parser: &jwt.Parser{
+			ValidMethods:         options.Algorithms,
+			UseJSONNumber:        true,
+			SkipClaimsValidation: true, // Claims are validated with leeway
+		},
+	}
+}
+
+func (v *JwtVerifier) Parse(token string) (*jwt.Token, error) {
+	jToken, err := v.parser.ParseWithClaims(token, jwt.MapClaims{}, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !jToken.Valid {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := jToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	err = v.validateClaims(claims, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return jToken, nil
+}
+
+func (v *JwtVerifier) keyFunc(jToken *jwt.Token) (interface{}, error) {
+	kid, _ := jToken.Header["kid"].(string)
+	alg, _ := jToken.Header["alg"].(string)
+	key, err := v.keys.Key(kid, alg)
+	if err != nil {
+		return nil, fmt.Errorf("%v (kid: %q, alg: %q)", err, kid, alg)
+	}
+	return key, nil
+}
+
+func (v *JwtVerifier) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	options := &v.options
+	leeway := int64(options.Leeway / time.Second)
+	unix := now.Unix()
+	exp, hasExp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !hasExp && options.RequireExp {
+		return ErrExpired
+	}
+	if hasExp && unix > exp+leeway {
+		return ErrExpired
+	}
+	nbf, hasNbf, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if hasNbf && unix+leeway < nbf {
+		return ErrNotValidYet
+	}
+	iat, hasIat, err := numericClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if hasIat && unix+leeway < iat {
+		return ErrNotValidYet
+	}
+	if options.Issuer != "" {
+		iss, _ := claims["iss"].(string)
+		if iss != options.Issuer {
+			return ErrIssuer
+		}
+	}
+	if options.Audience != "" && !hasAudience(claims, options.Audience) {
+		return ErrAudience
+	}
+	return nil
+}
+
+// Reads a NumericDate claim. Returns false if the claim is absent
+func numericClaim(claims jwt.MapClaims, name string) (int64, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return 0, false, nil
+	}
+	switch number := value.(type) {
+	case json.Number:
+		f, err := number.Float64()
+		if err == nil {
+			return int64(f), true, nil
+		}
+	case float64:
+		return int64(number), true, nil
+	}
+	return 0, true, fmt.Errorf("Invalid %s claim", name)
+}
+
+// aud claim can be a string or an array of strings
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if s, ok := value.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
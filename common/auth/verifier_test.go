@@ -0,0 +1,118 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pigeond-io/pigeond/common/auth"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestRsaAndEcdsa(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := auth.MakeStaticKeySet().Add("rsa", &rsaKey.PublicKey).Add("ec", &ecKey.PublicKey)
+	verifier := auth.MakeJwtVerifier(keys, auth.VerifierOptions{})
+	claims := jwt.MapClaims{"sid": "s1"}
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims)); err != nil {
+		t.Error("RS256", err)
+	}
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodES256, "ec", ecKey, claims)); err != nil {
+		t.Error("ES256", err)
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodRS256, "rsa", otherKey, claims)); err == nil {
+		t.Error("Expected signature verification failure")
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keys, err := auth.ParsePEM(pemBytes)
+	if err != nil || keys.Len() != 1 {
+		t.Fatal("ParsePEM", err)
+	}
+	verifier := auth.MakeJwtVerifier(keys, auth.VerifierOptions{})
+	// HS256 token signed with the public key bytes must not verify
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodHS256, "", pemBytes, jwt.MapClaims{})); err == nil {
+		t.Error("Expected HS256 token to be rejected")
+	}
+	restricted := auth.MakeJwtVerifier(keys, auth.VerifierOptions{Algorithms: []string{"RS512"}})
+	if _, err := restricted.Parse(sign(t, jwt.SigningMethodRS256, "", rsaKey, jwt.MapClaims{})); err == nil {
+		t.Error("Expected RS256 token to be rejected")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	jwks := []byte(`{"keys":[
+		{"kty":"oct","kid":"k1","k":"c2VjcmV0LTE"},
+		{"kty":"oct","kid":"k2","k":"c2VjcmV0LTI"},
+		{"kty":"oct","kid":"k3","use":"enc","k":"c2VjcmV0LTM"}
+	]}`)
+	keys, err := auth.ParseJWKS(jwks)
+	if err != nil || keys.Len() != 2 {
+		t.Fatal("ParseJWKS", err, keys)
+	}
+	verifier := auth.MakeJwtVerifier(keys, auth.VerifierOptions{})
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodHS256, "k2", []byte("secret-2"), jwt.MapClaims{})); err != nil {
+		t.Error("kid k2", err)
+	}
+	if _, err := verifier.Parse(sign(t, jwt.SigningMethodHS256, "k1", []byte("secret-2"), jwt.MapClaims{})); err == nil {
+		t.Error("Expected kid k1 to reject secret-2")
+	}
+}
+
+func TestClaims(t *testing.T) {
+	secret := []byte("secret")
+	keys := auth.MakeStaticKeySet().Add("", secret)
+	verifier := auth.MakeJwtVerifier(keys, auth.VerifierOptions{
+		Issuer:     "pigeond",
+		Audience:   "edge",
+		Leeway:     30 * time.Second,
+		RequireExp: true,
+	})
+	now := time.Now().Unix()
+	cases := []struct {
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge", "exp": now + 60}, true},
+		{jwt.MapClaims{"iss": "pigeond", "aud": []string{"origin", "edge"}, "exp": now + 60}, true},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge", "exp": now - 10}, true},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge", "exp": now - 60}, false},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge"}, false},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge", "exp": now + 60, "nbf": now + 10}, true},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "edge", "exp": now + 600, "nbf": now + 60}, false},
+		{jwt.MapClaims{"iss": "other", "aud": "edge", "exp": now + 60}, false},
+		{jwt.MapClaims{"iss": "pigeond", "aud": "origin", "exp": now + 60}, false},
+	}
+	for i, c := range cases {
+		_, err := verifier.Parse(sign(t, jwt.SigningMethodHS256, "", secret, c.claims))
+		if (err == nil) != c.valid {
+			t.Errorf("Case %d: expected valid=%v, got %v", i, c.valid, err)
+		}
+	}
+}
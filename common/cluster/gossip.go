@@ -0,0 +1,641 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ProbeInterval    = 1 * time.Second        // Interval at which the next member is probed
+	ProbeTimeout     = 300 * time.Millisecond // Max wait for the ack of a direct probe before probing indirectly
+	IndirectProbes   = 3                      // Members asked to probe a member that did not ack a direct probe
+	SuspicionTimeout = 5 * time.Second        // Suspect members that do not refute the suspicion within SuspicionTimeout are dead
+	ReclaimTimeout   = 30 * time.Second       // Dead and left members are forgotten after ReclaimTimeout
+	SyncInterval     = 30 * time.Second       // Interval at which the full state is exchanged with a random member
+	JoinTimeout      = 2 * time.Second        // Max wait for a seed to reply
+	RetransmitMult   = 3                      // Updates are piggybacked RetransmitMult * log10(members + 1) times
+	MaxPacketSize    = 1400                   // Max size of a gossip datagram, updates that do not fit wait for the next one
+)
+
+var (
+	errorNoSeed = errors.New("No seed replied")
+)
+
+type gossipMember struct {
+	Member
+	changedAt time.Time // Time the state last changed
+}
+
+// Update piggybacked on the gossip datagrams until it has been sent often enough to reach every member
+type broadcast struct {
+	name      string // Member the update is about. A newer update about the member replaces it
+	packet    []byte
+	transmits int
+}
+
+/*
+	Membership of the nodes that join a gossip cluster through a seed, following SWIM.
+
+	Every ProbeInterval the next member in a shuffled round robin is probed with PING seq from target.
+	A member that does not ACK seq from within ProbeTimeout is probed indirectly through IndirectProbes other members
+	with PINGREQ seq from target target-address, who forward its ack. A member not acked by the end of the interval
+	is suspect, and dead unless it refutes the suspicion within SuspicionTimeout by gossiping itself alive with a
+	higher incarnation.
+
+	Membership updates are piggybacked on the probes and acks as RESP arrays, and disseminated epidemically:
+		ALIVE name incarnation role address gossip-address [key value ...]
+		SUSPECT name incarnation
+		DEAD name incarnation
+		LEFT name incarnation
+	A node joins by sending SYNC seq from to a seed, which replies with SYNCACK seq from followed by the state of
+	every member it knows. Nodes also SYNC with a random member every SyncInterval to heal partitions.
+*/
+type GossipMembership struct {
+	notifier
+	self       string // Name of the local node
+	seeds      []string
+	conn       *net.UDPConn
+	members    map[string]*gossipMember
+	order      []string // Probe order, shuffled every round
+	next       int      // Index of the next member to probe in order
+	broadcasts []*broadcast
+	acks       map[int64]func() // Ack callbacks keyed with sequence number
+	seq        int64
+	lock       sync.Mutex // Synchronizes the state above
+	done       chan struct{}
+	once       sync.Once
+}
+
+// Starts gossiping as self, whose Heartbeat is the UDP address the node gossips on, and joins the cluster
+// through the first seed that replies. The first node of a cluster has no seeds
+func MakeGossipMembership(self Member, seeds ...string) (*GossipMembership, error) {
+	_, port, err := net.SplitHostPort(self.Heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	self.State = Alive
+	self.LastSeen = time.Now()
+	g := &GossipMembership{
+		self:    self.Name,
+		seeds:   seeds,
+		conn:    conn,
+		members: map[string]*gossipMember{self.Name: {Member: self, changedAt: time.Now()}},
+		acks:    make(map[int64]func()),
+		done:    make(chan struct{}),
+	}
+	go g.receive()
+	if len(seeds) > 0 {
+		if err = g.join(); err != nil {
+			g.Shutdown()
+			return nil, err
+		}
+	}
+	go g.probe()
+	go g.sync()
+	return g, nil
+}
+
+func (g *GossipMembership) Self() Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.members[g.self].Member
+}
+
+func (g *GossipMembership) Members() []Member {
+	g.lock.Lock()
+	members := make([]Member, 0, len(g.members))
+	for _, member := range g.members {
+		members = append(members, member.Member)
+	}
+	g.lock.Unlock()
+	sortMembers(members)
+	return members
+}
+
+func (g *GossipMembership) Alive(role string) []Member {
+	return aliveMembers(g.Members(), role)
+}
+
+// Leaves the cluster, so that the other members see the node as left rather than dead, and stops gossiping
+func (g *GossipMembership) Close() {
+	g.lock.Lock()
+	self := g.members[g.self]
+	self.State = Left
+	packet := encodeUpdate(&self.Member)
+	var peers []string
+	for _, member := range g.members {
+		if member.Name != g.self && member.State == Alive {
+			peers = append(peers, member.Heartbeat)
+		}
+	}
+	g.lock.Unlock()
+	for _, peer := range peers {
+		g.sendTo(peer, packet)
+	}
+	g.Shutdown()
+}
+
+// Stops gossiping without leaving. The other members find the node dead
+func (g *GossipMembership) Shutdown() {
+	g.once.Do(func() {
+		close(g.done)
+		g.conn.Close()
+	})
+}
+
+// Sends SYNC to the seeds until one replies
+func (g *GossipMembership) join() error {
+	for _, seed := range g.seeds {
+		if g.syncWith(seed) {
+			return nil
+		}
+		log.WithFields("cluster.gossip", "join").Error("Seed ", seed, " did not reply")
+	}
+	return errorNoSeed
+}
+
+// Exchanges the full state with the member at address. Returns false if it does not reply within JoinTimeout
+func (g *GossipMembership) syncWith(address string) bool {
+	replied := make(chan struct{}, 1)
+	seq := g.expectAck(func() {
+		select {
+		case replied <- struct{}{}:
+		default:
+		}
+	})
+	defer g.forgetAck(seq)
+	g.lock.Lock()
+	packets := g.statePackets(message("SYNC", seq, g.self))
+	g.lock.Unlock()
+	for _, packet := range packets {
+		g.sendTo(address, packet)
+	}
+	select {
+	case <-replied:
+		return true
+	case <-time.After(JoinTimeout):
+		return false
+	case <-g.done:
+		return false
+	}
+}
+
+// Gossip run loop that syncs with a random member every SyncInterval, or with the seeds when no member is known
+func (g *GossipMembership) sync() {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+		peers := g.randomPeers(1, "")
+		if len(peers) > 0 {
+			g.syncWith(peers[0].Heartbeat)
+		} else if len(g.seeds) > 0 {
+			g.join()
+		}
+	}
+}
+
+// Gossip run loop that probes the next member every ProbeInterval and expires the suspicions and the dead members
+func (g *GossipMembership) probe() {
+	ticker := time.NewTicker(ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			g.notify(g.expire(now))
+		}
+		if target, ok := g.nextTarget(); ok {
+			g.probeMember(target)
+		}
+	}
+}
+
+// Probes the target directly, then indirectly. Target becomes suspect if no ack arrives within the probe interval
+func (g *GossipMembership) probeMember(target Member) {
+	acked := make(chan struct{}, 1)
+	seq := g.expectAck(func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	})
+	defer g.forgetAck(seq)
+	g.send(target.Heartbeat, message("PING", seq, g.self, target.Name))
+	select {
+	case <-acked:
+		return
+	case <-g.done:
+		return
+	case <-time.After(ProbeTimeout):
+	}
+	for _, helper := range g.randomPeers(IndirectProbes, target.Name) {
+		g.send(helper.Heartbeat, message("PINGREQ", seq, g.self, target.Name, target.Heartbeat))
+	}
+	wait := ProbeInterval - ProbeTimeout
+	if wait < ProbeTimeout {
+		wait = ProbeTimeout
+	}
+	select {
+	case <-acked:
+		return
+	case <-g.done:
+		return
+	case <-time.After(wait):
+	}
+	log.WithFields("cluster.gossip", "probe", target.Name).Debug("No ack")
+	g.notify(g.suspect(target.Name, target.Incarnation))
+}
+
+// Next member to probe. Members are probed in a round robin that is shuffled every round
+func (g *GossipMembership) nextTarget() (Member, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		for ; g.next < len(g.order); g.next++ {
+			member, ok := g.members[g.order[g.next]]
+			if ok && (member.State == Alive || member.State == Suspect) {
+				g.next++
+				return member.Member, true
+			}
+		}
+		g.order = g.order[:0]
+		for name := range g.members {
+			if name != g.self {
+				g.order = append(g.order, name)
+			}
+		}
+		sort.Strings(g.order)
+		shuffle(len(g.order), func(i, j int) {
+			g.order[i], g.order[j] = g.order[j], g.order[i]
+		})
+		g.next = 0
+	}
+	return Member{}, false
+}
+
+// Up to count random alive members other than the local node and except
+func (g *GossipMembership) randomPeers(count int, except string) []Member {
+	var peers []Member
+	g.lock.Lock()
+	for name, member := range g.members {
+		if name != g.self && name != except && member.State == Alive {
+			peers = append(peers, member.Member)
+		}
+	}
+	g.lock.Unlock()
+	shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// Registers a callback invoked when the ack with the returned sequence number arrives
+func (g *GossipMembership) expectAck(callback func()) int64 {
+	g.lock.Lock()
+	g.seq++
+	seq := g.seq
+	g.acks[seq] = callback
+	g.lock.Unlock()
+	return seq
+}
+
+func (g *GossipMembership) forgetAck(seq int64) {
+	g.lock.Lock()
+	delete(g.acks, seq)
+	g.lock.Unlock()
+}
+
+func (g *GossipMembership) onAck(seq int64) {
+	g.lock.Lock()
+	callback, ok := g.acks[seq]
+	g.lock.Unlock()
+	if ok {
+		callback()
+	}
+}
+
+// Gossip run loop that handles the datagrams
+func (g *GossipMembership) receive() {
+	buffer := make([]byte, 64<<10)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-g.done:
+				return
+			default:
+			}
+			log.WithFields("cluster.gossip", "receive").Error(err)
+			continue
+		}
+		values, err := resp.ReadValues(buffer[:n])
+		if err != nil {
+			log.WithFields("cluster.gossip", "receive").Debug(from, ", Err: ", err)
+			continue
+		}
+		for _, value := range values {
+			if value.Ok() {
+				g.handle(value.Action(), value.Args(), from)
+			}
+		}
+	}
+}
+
+func (g *GossipMembership) handle(action string, args [][]byte, from *net.UDPAddr) {
+	switch action {
+	case "PING": // PING seq from target
+		if len(args) == 3 && string(args[2]) == g.self {
+			g.send(from.String(), message("ACK", parseInt(args[0]), g.self))
+		}
+	case "ACK", "SYNCACK": // ACK seq from
+		if len(args) == 2 {
+			g.onAck(parseInt(args[0]))
+		}
+	case "PINGREQ": // PINGREQ seq from target address
+		if len(args) == 4 {
+			requester, seq := from.String(), parseInt(args[0])
+			probe := g.expectAck(func() {
+				g.send(requester, message("ACK", seq, g.self))
+			})
+			time.AfterFunc(ProbeInterval, func() {
+				g.forgetAck(probe)
+			})
+			g.send(string(args[3]), message("PING", probe, g.self, string(args[2])))
+		}
+	case "SYNC": // SYNC seq from
+		if len(args) == 2 {
+			g.lock.Lock()
+			packets := g.statePackets(message("SYNCACK", parseInt(args[0]), g.self))
+			g.lock.Unlock()
+			for _, packet := range packets {
+				g.sendTo(from.String(), packet)
+			}
+		}
+	case "ALIVE":
+		if len(args) >= 5 && len(args)%2 == 1 {
+			member := Member{
+				Name:        string(args[0]),
+				Incarnation: uint64(parseInt(args[1])),
+				Role:        string(args[2]),
+				Address:     string(args[3]),
+				Heartbeat:   string(args[4]),
+			}
+			if len(args) > 5 {
+				member.Meta = make(map[string]string)
+				for i := 5; i < len(args); i += 2 {
+					member.Meta[string(args[i])] = string(args[i+1])
+				}
+			}
+			g.notify(g.alive(member))
+		}
+	case "SUSPECT":
+		if len(args) == 2 {
+			g.notify(g.suspect(string(args[0]), uint64(parseInt(args[1]))))
+		}
+	case "DEAD", "LEFT":
+		if len(args) == 2 {
+			state := Dead
+			if action == "LEFT" {
+				state = Left
+			}
+			g.notify(g.dead(string(args[0]), uint64(parseInt(args[1])), state))
+		}
+	}
+}
+
+// Applies an ALIVE update. Returns the member if it joined or changed
+func (g *GossipMembership) alive(update Member) []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	if update.Name == g.self {
+		self := g.members[g.self]
+		if update.Incarnation > self.Incarnation { // Gossip about an earlier run of the node
+			g.refute(update.Incarnation)
+		}
+		return nil
+	}
+	member, ok := g.members[update.Name]
+	if ok && update.Incarnation <= member.Incarnation {
+		if member.State == Alive {
+			member.LastSeen = now
+		}
+		return nil
+	}
+	update.State = Alive
+	update.LastSeen = now
+	g.members[update.Name] = &gossipMember{Member: update, changedAt: now}
+	g.enqueue(&update)
+	return []Member{update}
+}
+
+// Applies a SUSPECT update. The local node refutes suspicions about itself. Returns the member if it changed state
+func (g *GossipMembership) suspect(name string, incarnation uint64) []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if name == g.self {
+		g.refute(incarnation)
+		return nil
+	}
+	member, ok := g.members[name]
+	if !ok || incarnation < member.Incarnation || member.State != Alive {
+		return nil
+	}
+	member.State = Suspect
+	member.Incarnation = incarnation
+	member.changedAt = time.Now()
+	g.enqueue(&member.Member)
+	return []Member{member.Member}
+}
+
+// Applies a DEAD or LEFT update. Returns the member if it changed state
+func (g *GossipMembership) dead(name string, incarnation uint64, state State) []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if name == g.self {
+		if g.members[g.self].State != Left {
+			g.refute(incarnation)
+		}
+		return nil
+	}
+	member, ok := g.members[name]
+	if !ok || incarnation < member.Incarnation || member.State == Dead || member.State == Left {
+		return nil
+	}
+	member.State = state
+	member.Incarnation = incarnation
+	member.changedAt = time.Now()
+	g.enqueue(&member.Member)
+	return []Member{member.Member}
+}
+
+// Gossips the local node alive with an incarnation above the one of the suspicion. Must be called holding lock
+func (g *GossipMembership) refute(incarnation uint64) {
+	self := g.members[g.self]
+	if incarnation >= self.Incarnation {
+		self.Incarnation = incarnation + 1
+	}
+	log.WithFields("cluster.gossip", "refute").Info("Incarnation ", self.Incarnation)
+	g.enqueue(&self.Member)
+}
+
+// Declares dead the suspects that did not refute within SuspicionTimeout and forgets the members
+// dead or left for more than ReclaimTimeout. Returns the members that changed state
+func (g *GossipMembership) expire(now time.Time) []Member {
+	var changes []Member
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for name, member := range g.members {
+		switch {
+		case member.State == Suspect && now.Sub(member.changedAt) >= SuspicionTimeout:
+			member.State = Dead
+			member.changedAt = now
+			g.enqueue(&member.Member)
+			changes = append(changes, member.Member)
+		case (member.State == Dead || member.State == Left) && now.Sub(member.changedAt) >= ReclaimTimeout:
+			delete(g.members, name)
+		}
+	}
+	return changes
+}
+
+// Queues the update for dissemination, replacing the older update about the member. Must be called holding lock
+func (g *GossipMembership) enqueue(member *Member) {
+	packet := encodeUpdate(member)
+	for i, b := range g.broadcasts {
+		if b.name == member.Name {
+			g.broadcasts = append(g.broadcasts[:i], g.broadcasts[i+1:]...)
+			break
+		}
+	}
+	g.broadcasts = append(g.broadcasts, &broadcast{name: member.Name, packet: packet})
+}
+
+// Sends the message with as many queued updates as fit in the datagram, the least sent first
+func (g *GossipMembership) send(address string, msg []byte) {
+	g.lock.Lock()
+	limit := RetransmitMult * int(math.Ceil(math.Log10(float64(len(g.members)+1))))
+	sort.SliceStable(g.broadcasts, func(i, j int) bool {
+		return g.broadcasts[i].transmits < g.broadcasts[j].transmits
+	})
+	packet := append([]byte(nil), msg...)
+	kept := g.broadcasts[:0]
+	for _, b := range g.broadcasts {
+		if len(packet)+len(b.packet) <= MaxPacketSize {
+			packet = append(packet, b.packet...)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	g.broadcasts = kept
+	g.lock.Unlock()
+	g.sendTo(address, packet)
+}
+
+func (g *GossipMembership) sendTo(address string, packet []byte) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err == nil {
+		_, err = g.conn.WriteToUDP(packet, addr)
+	}
+	if err != nil {
+		log.WithFields("cluster.gossip", "send", address).Debug(err)
+	}
+}
+
+// Splits the state of every member into datagrams, the first one starting with msg. Must be called holding lock
+func (g *GossipMembership) statePackets(msg []byte) [][]byte {
+	var packets [][]byte
+	packet := msg
+	for _, member := range g.members {
+		update := encodeUpdate(&member.Member)
+		if len(packet)+len(update) > MaxPacketSize && len(packet) > 0 {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		packet = append(packet, update...)
+	}
+	return append(packets, packet)
+}
+
+// Encodes the state of the member as an update
+func encodeUpdate(member *Member) []byte {
+	incarnation := strconv.FormatUint(member.Incarnation, 10)
+	var buffer bytes.Buffer
+	w := resp.MakeWriter(&buffer)
+	switch member.State {
+	case Alive:
+		w.WriteArrayHeader(6 + 2*len(member.Meta))
+		w.WriteBulkString("ALIVE")
+		w.WriteBulkString(member.Name)
+		w.WriteBulkString(incarnation)
+		w.WriteBulkString(member.Role)
+		w.WriteBulkString(member.Address)
+		w.WriteBulkString(member.Heartbeat)
+		keys := make([]string, 0, len(member.Meta))
+		for key := range member.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			w.WriteBulkString(key)
+			w.WriteBulkString(member.Meta[key])
+		}
+	case Suspect:
+		w.WriteStrings("SUSPECT", member.Name, incarnation)
+	case Dead:
+		w.WriteStrings("DEAD", member.Name, incarnation)
+	case Left:
+		w.WriteStrings("LEFT", member.Name, incarnation)
+	}
+	return buffer.Bytes()
+}
+
+// Fisher-Yates shuffle of n elements
+func shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, rand.Intn(i+1))
+	}
+}
+
+func message(action string, seq int64, args ...string) []byte {
+	var buffer bytes.Buffer
+	resp.MakeWriter(&buffer).WriteStrings(append([]string{action, strconv.FormatInt(seq, 10)}, args...)...)
+	return buffer.Bytes()
+}
+
+func parseInt(slice []byte) int64 {
+	i, _ := strconv.ParseInt(string(slice), 10, 64)
+	return i
+}
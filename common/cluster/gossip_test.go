@@ -0,0 +1,109 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	cluster.ProbeInterval = 50 * time.Millisecond
+	cluster.ProbeTimeout = 20 * time.Millisecond
+	cluster.SuspicionTimeout = 200 * time.Millisecond
+	cluster.SyncInterval = 200 * time.Millisecond
+	cluster.JoinTimeout = 500 * time.Millisecond
+}
+
+func startGossip(t *testing.T, name string, seeds ...string) *cluster.GossipMembership {
+	self := cluster.Member{
+		Name:      name,
+		Role:      cluster.RoleEdge,
+		Address:   "localhost:8765",
+		Heartbeat: freeHeartbeat(t),
+		Meta:      map[string]string{"transport": "tcp"},
+	}
+	g, err := cluster.MakeGossipMembership(self, seeds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGossipMembership(t *testing.T) {
+	nodes := []*cluster.GossipMembership{startGossip(t, "node-0")}
+	seed := nodes[0].Self().Heartbeat
+	for i := 1; i < 5; i++ {
+		nodes = append(nodes, startGossip(t, fmt.Sprintf("node-%d", i), seed))
+	}
+	defer func() {
+		for _, g := range nodes {
+			g.Shutdown()
+		}
+	}()
+	all := "node-0=alive node-1=alive node-2=alive node-3=alive node-4=alive"
+	for _, g := range nodes {
+		g := g
+		eventually(t, func() bool { return states(g) == all })
+	}
+	if member := nodes[4].Members()[1]; member.Meta["transport"] != "tcp" || member.Address != "localhost:8765" {
+		t.Errorf("Unexpected member %v %v", member, member.Meta)
+	}
+
+	nodes[3].Shutdown()
+	nodes[4].Close()
+	for _, g := range nodes[:3] {
+		g := g
+		eventually(t, func() bool {
+			return states(g) == "node-0=alive node-1=alive node-2=alive node-3=dead node-4=left"
+		})
+	}
+}
+
+func TestGossipRefutesSuspicion(t *testing.T) {
+	g := startGossip(t, "node-0")
+	defer g.Shutdown()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr, _ := net.ResolveUDPAddr("udp", g.Self().Heartbeat)
+
+	var packet bytes.Buffer
+	resp.MakeWriter(&packet).
+		WriteStrings("SUSPECT", "node-0", "4").
+		WriteStrings("PING", "1", "intruder", "node-0")
+	conn.WriteToUDP(packet.Bytes(), addr)
+
+	// The ack carries the refutation
+	buffer := make([]byte, 64<<10)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := resp.ReadValues(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, value := range values {
+		actions = append(actions, value.String())
+	}
+	if len(values) < 2 || values[0].Action() != "ACK" || values[1].Action() != "ALIVE" ||
+		string(values[1].Args()[0]) != "node-0" || string(values[1].Args()[1]) != "5" {
+		t.Errorf("Expected an ack and a refutation got %s", strings.Join(actions, ", "))
+	}
+	if self := g.Self(); self.Incarnation != 5 || self.State != cluster.Alive {
+		t.Errorf("Unexpected self %v incarnation %d", self, self.Incarnation)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	VirtualNodes = 128 // Points of each node on the hash ring
+)
+
+/*
+	Thread-safe consistent hash ring assigning keys to nodes.
+	Every node is hashed onto the ring at replicas points, and a key is owned by the node of the first point
+	at or after the hash of the key. Adding or removing a node only moves the keys of its points, about
+	1/n of the keys, and the virtual points spread them evenly across the other nodes.
+*/
+type HashRing struct {
+	replicas int
+	points   []uint64          // Sorted hashes of the virtual nodes
+	owners   map[uint64]string // Node of each point
+	nodes    map[string]bool
+	lock     sync.RWMutex //ReadWrite synchronization mutex
+}
+
+// Makes an empty ring placing each node at replicas points. Non positive replicas defaults to VirtualNodes
+func MakeHashRing(replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = VirtualNodes
+	}
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint64]string),
+		nodes:    make(map[string]bool),
+	}
+}
+
+// Replaces the nodes of the ring. Returns false if the nodes did not change
+func (r *HashRing) Set(nodes ...string) bool {
+	set := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		set[node] = true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changed := len(set) != len(r.nodes)
+	for node := range set {
+		if !r.nodes[node] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	r.nodes = set
+	r.build()
+	return true
+}
+
+func (r *HashRing) Add(nodes ...string) {
+	r.lock.Lock()
+	for _, node := range nodes {
+		r.nodes[node] = true
+	}
+	r.build()
+	r.lock.Unlock()
+}
+
+func (r *HashRing) Remove(nodes ...string) {
+	r.lock.Lock()
+	for _, node := range nodes {
+		delete(r.nodes, node)
+	}
+	r.build()
+	r.lock.Unlock()
+}
+
+// Node owning the key. Empty when the ring has no nodes
+func (r *HashRing) Owner(key string) string {
+	hash := hashKey(key)
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes of the ring, sorted
+func (r *HashRing) Nodes() []string {
+	r.lock.RLock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	r.lock.RUnlock()
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Places the virtual nodes on the ring. Must be called holding the write lock
+func (r *HashRing) build() {
+	r.points = r.points[:0]
+	r.owners = make(map[uint64]string, len(r.nodes)*r.replicas)
+	for node := range r.nodes {
+		for i := 0; i < r.replicas; i++ {
+			hash := hashKey(node + "#" + strconv.Itoa(i))
+			if owner, ok := r.owners[hash]; ok && owner < node {
+				continue // Colliding points go to the lowest node whatever the order of insertion
+			}
+			if _, ok := r.owners[hash]; !ok {
+				r.points = append(r.points, hash)
+			}
+			r.owners[hash] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+}
+
+// Position of the key on the ring, the first 8 bytes of its MD5 digest
+func hashKey(key string) uint64 {
+	sum := docid.MD5([]byte(key))
+	digest := sum[len(sum)-32:] // MD5 prefixes the hex digest with the signature
+	hash, _ := strconv.ParseUint(digest[:16], 16, 64)
+	return hash
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"strconv"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := cluster.MakeHashRing(0)
+	if owner := ring.Owner("news"); owner != "" {
+		t.Errorf("Expected no owner got %s", owner)
+	}
+	ring.Set("hub-1", "hub-2", "hub-3")
+	other := cluster.MakeHashRing(0)
+	other.Add("hub-3")
+	other.Add("hub-1", "hub-2")
+
+	count := 30000
+	owners := make(map[string]string)
+	load := make(map[string]int)
+	for i := 0; i < count; i++ {
+		topic := "topic-" + strconv.Itoa(i)
+		owners[topic] = ring.Owner(topic)
+		load[owners[topic]]++
+		if owner := other.Owner(topic); owner != owners[topic] {
+			t.Fatalf("Owner of %s depends on the order of insertion, %s and %s", topic, owners[topic], owner)
+		}
+	}
+	for _, node := range ring.Nodes() {
+		if load[node] < count/3*8/10 || load[node] > count/3*12/10 {
+			t.Errorf("Unbalanced ring %v", load)
+		}
+	}
+
+	// Only the keys of the new node move
+	if !ring.Set("hub-1", "hub-2", "hub-3", "hub-4") || ring.Set("hub-4", "hub-3", "hub-2", "hub-1") {
+		t.Error("Expected Set to report the changes only")
+	}
+	moved := 0
+	for topic, previous := range owners {
+		owner := ring.Owner(topic)
+		if owner != previous {
+			moved++
+			if owner != "hub-4" {
+				t.Fatalf("%s moved from %s to %s", topic, previous, owner)
+			}
+		}
+	}
+	if moved < count/4*8/10 || moved > count/4*12/10 {
+		t.Errorf("Expected about %d moved keys got %d", count/4, moved)
+	}
+
+	// The keys of the removed node are spread over the others
+	ring.Remove("hub-4", "hub-1")
+	for topic, previous := range owners {
+		if owner := ring.Owner(topic); previous != "hub-1" && owner != previous {
+			t.Fatalf("%s moved from %s to %s", topic, previous, owner)
+		}
+	}
+}
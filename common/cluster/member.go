@@ -0,0 +1,163 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/log"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RoleEdge      = "edge"
+	RoleHub       = "hub"
+	RoleOrigin    = "origin"
+	RoleDataStore = "data_store"
+)
+
+// Health of a member as seen by the local node
+type State int
+
+const (
+	Alive   State = iota // Heard from within SuspectTimeout
+	Suspect              // Not heard from within SuspectTimeout, or not heard from yet
+	Dead                 // Not heard from within DeadTimeout
+	Left                 // Removed from the members file
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Node of the cluster
+type Member struct {
+	Name        string            // Unique name of the node
+	Role        string            // RoleEdge, RoleHub, RoleOrigin or RoleDataStore
+	Address     string            // Address the node serves on, e.g. the websocket address of an edge or the listen address of a hub
+	Heartbeat   string            // UDP address the node exchanges heartbeats or gossip on
+	Meta        map[string]string // Addresses of the other listeners of the node and such. Replaced, never modified
+	State       State
+	Incarnation uint64    // Version of the state of the member, bumped by the member to refute suspicions. Gossip only
+	LastSeen    time.Time // Last time a heartbeat of the member was received
+}
+
+func (m Member) String() string {
+	return fmt.Sprintf("%s %s %s %s (%s)", m.Name, m.Role, m.Address, m.Heartbeat, m.State)
+}
+
+// Checks whether both members describe the same node at the same addresses
+func (m Member) sameAs(other Member) bool {
+	return m.Name == other.Name && m.Role == other.Role && m.Address == other.Address && m.Heartbeat == other.Heartbeat
+}
+
+// Callback invoked when a member joins, leaves or changes state
+type ChangeHandler func(member Member)
+
+// Membership tracks the nodes of the cluster and their health
+type Membership interface {
+	Self() Member                   // Local node
+	Members() []Member              // All the members including the local node, sorted by name
+	Alive(role string) []Member     // Alive members with the role, sorted by name
+	OnChange(handler ChangeHandler) // Registers a callback invoked whenever a member joins, leaves or changes state
+	Close()                         // Stops tracking the members
+}
+
+// Change handlers of a membership
+type notifier struct {
+	handlers []ChangeHandler
+	hlock    sync.RWMutex // Handlers synchronization mutex
+}
+
+func (n *notifier) OnChange(handler ChangeHandler) {
+	n.hlock.Lock()
+	n.handlers = append(n.handlers, handler)
+	n.hlock.Unlock()
+}
+
+func (n *notifier) notify(changes []Member) {
+	if len(changes) == 0 {
+		return
+	}
+	n.hlock.RLock()
+	handlers := n.handlers
+	n.hlock.RUnlock()
+	for _, member := range changes {
+		log.WithFields("cluster.membership", "notify").Info(member.String())
+		for _, handler := range handlers {
+			handler(member)
+		}
+	}
+}
+
+func sortMembers(members []Member) {
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+}
+
+// Alive members with the role
+func aliveMembers(members []Member, role string) []Member {
+	var alive []Member
+	for _, member := range members {
+		if member.Role == role && member.State == Alive {
+			alive = append(alive, member)
+		}
+	}
+	return alive
+}
+
+/*
+	Reads the members, one per line: name role address heartbeat-address
+
+		# Comments and blank lines are ignored
+		hub-1  hub  hub-1:8766  hub-1:7946
+		edge-1 edge edge-1:8765 edge-1:7946
+*/
+func ParseMembers(reader io.Reader) ([]Member, error) {
+	var members []Member
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Line %d: expected name role address heartbeat-address", line)
+		}
+		member := Member{Name: fields[0], Role: fields[1], Address: fields[2], Heartbeat: fields[3], State: Suspect}
+		switch member.Role {
+		case RoleEdge, RoleHub, RoleOrigin, RoleDataStore:
+		default:
+			return nil, fmt.Errorf("Line %d: unknown role %s", line, member.Role)
+		}
+		if _, _, err := net.SplitHostPort(member.Heartbeat); err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		if names[member.Name] {
+			return nil, fmt.Errorf("Line %d: duplicate member %s", line, member.Name)
+		}
+		names[member.Name] = true
+		members = append(members, member)
+	}
+	return members, scanner.Err()
+}
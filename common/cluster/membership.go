@@ -0,0 +1,313 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	HeartbeatInterval = 1 * time.Second  // Interval at which heartbeats are sent to every member
+	SuspectTimeout    = 3 * time.Second  // Members not heard from within SuspectTimeout are suspect
+	DeadTimeout       = 10 * time.Second // Members not heard from within DeadTimeout are dead
+	WatchInterval     = 2 * time.Second  // Interval at which the members file is checked for changes
+)
+
+/*
+	Membership of a list of nodes that exchange heartbeats.
+	Members are listed statically or in a members file that is reloaded when it changes.
+	Every HeartbeatInterval the local node sends HEARTBEAT name as a RESP datagram to the heartbeat address
+	of every other member, and marks the members it hears from as alive. Members it does not hear from
+	become suspect after SuspectTimeout and dead after DeadTimeout.
+*/
+type listMembership struct {
+	notifier
+	self    string // Name of the local node
+	path    string // Members file. Empty for a static membership
+	modTime time.Time
+	conn    *net.UDPConn
+	members map[string]*Member
+	lock    sync.RWMutex // Members synchronization mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Membership of a fixed list of members. Self is the name of the local node and must be in the list
+func MakeStaticMembership(self string, members []Member) (Membership, error) {
+	m, err := makeMembership(self, members)
+	if err != nil {
+		return nil, err
+	}
+	m.start()
+	return m, nil
+}
+
+// Membership of the members listed in the file at path. See ParseMembers for the format
+func MakeFileMembership(self string, path string) (Membership, error) {
+	members, modTime, err := readMembersFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := makeMembership(self, members)
+	if err != nil {
+		return nil, err
+	}
+	m.path = path
+	m.modTime = modTime
+	m.start()
+	go m.watch()
+	return m, nil
+}
+
+func makeMembership(self string, members []Member) (*listMembership, error) {
+	m := &listMembership{
+		self:    self,
+		members: make(map[string]*Member),
+		done:    make(chan struct{}),
+	}
+	now := time.Now()
+	for _, member := range members {
+		member := member
+		member.LastSeen = now
+		m.members[member.Name] = &member
+	}
+	local, ok := m.members[self]
+	if !ok {
+		return nil, fmt.Errorf("Node %s is not a member", self)
+	}
+	local.State = Alive
+	_, port, err := net.SplitHostPort(local.Heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	m.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *listMembership) start() {
+	go m.receive()
+	go m.heartbeat()
+}
+
+// Local node
+func (m *listMembership) Self() Member {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return *m.members[m.self]
+}
+
+// All the members including the local node, sorted by name
+func (m *listMembership) Members() []Member {
+	m.lock.RLock()
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	m.lock.RUnlock()
+	sortMembers(members)
+	return members
+}
+
+// Alive members with the role, sorted by name
+func (m *listMembership) Alive(role string) []Member {
+	return aliveMembers(m.Members(), role)
+}
+
+// Stops the heartbeats and the file watcher
+func (m *listMembership) Close() {
+	m.once.Do(func() {
+		close(m.done)
+		m.conn.Close()
+	})
+}
+
+// Membership run loop that sends the heartbeats and updates the health of the members
+func (m *listMembership) heartbeat() {
+	var buffer bytes.Buffer
+	resp.MakeWriter(&buffer).WriteStrings("HEARTBEAT", m.self)
+	packet := buffer.Bytes()
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		for _, member := range m.Members() {
+			if member.Name == m.self {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", member.Heartbeat)
+			if err == nil {
+				_, err = m.conn.WriteToUDP(packet, addr)
+			}
+			if err != nil {
+				log.WithFields("cluster.membership", "heartbeat", member.Name).Debug(err)
+			}
+		}
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.notify(m.check(now))
+		}
+	}
+}
+
+// Updates the health of the members that were not heard from. Returns the members that changed state
+func (m *listMembership) check(now time.Time) []Member {
+	var changes []Member
+	m.lock.Lock()
+	for name, member := range m.members {
+		if name == m.self {
+			continue
+		}
+		state := Alive
+		since := now.Sub(member.LastSeen)
+		if since >= DeadTimeout {
+			state = Dead
+		} else if since >= SuspectTimeout {
+			state = Suspect
+		} else if member.State != Alive {
+			continue // Only a heartbeat makes a member alive
+		}
+		if state != member.State {
+			member.State = state
+			changes = append(changes, *member)
+		}
+	}
+	m.lock.Unlock()
+	return changes
+}
+
+// Membership run loop that receives the heartbeats
+func (m *listMembership) receive() {
+	buffer := make([]byte, 64<<10)
+	for {
+		n, _, err := m.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			log.WithFields("cluster.membership", "receive").Error(err)
+			continue
+		}
+		values, err := resp.ReadValues(buffer[:n])
+		if err != nil {
+			log.WithFields("cluster.membership", "receive").Debug(err)
+			continue
+		}
+		for _, value := range values {
+			if value.Ok() && value.Action() == "HEARTBEAT" && len(value.Elems) == 2 {
+				m.notify(m.heard(string(value.Elems[1].Str), time.Now()))
+			}
+		}
+	}
+}
+
+// Marks the member as alive. Returns the member if it changed state
+func (m *listMembership) heard(name string, now time.Time) []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	member, ok := m.members[name]
+	if !ok || name == m.self {
+		return nil
+	}
+	member.LastSeen = now
+	if member.State == Alive {
+		return nil
+	}
+	member.State = Alive
+	return []Member{*member}
+}
+
+// Membership run loop that reloads the members file when it changes
+func (m *listMembership) watch() {
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(m.path)
+		if err != nil {
+			log.WithFields("cluster.membership", "watch").Error(err)
+			continue
+		}
+		if info.ModTime().Equal(m.modTime) {
+			continue
+		}
+		members, modTime, err := readMembersFile(m.path)
+		if err != nil {
+			log.WithFields("cluster.membership", "watch").Error("Keeping the current members, Err: ", err)
+			continue
+		}
+		m.modTime = modTime
+		m.notify(m.update(members, time.Now()))
+	}
+}
+
+// Adds the new members, removes the members that are not listed anymore and updates the addresses of the others.
+// The local node is never removed. Returns the members that joined, left or changed
+func (m *listMembership) update(members []Member, now time.Time) []Member {
+	var changes []Member
+	listed := make(map[string]bool)
+	m.lock.Lock()
+	for _, member := range members {
+		member := member
+		listed[member.Name] = true
+		current, ok := m.members[member.Name]
+		if !ok {
+			member.LastSeen = now
+			m.members[member.Name] = &member
+			changes = append(changes, member)
+		} else if !current.sameAs(member) && member.Name != m.self {
+			current.Role = member.Role
+			current.Address = member.Address
+			current.Heartbeat = member.Heartbeat
+			changes = append(changes, *current)
+		}
+	}
+	for name, member := range m.members {
+		if !listed[name] && name != m.self {
+			delete(m.members, name)
+			member.State = Left
+			changes = append(changes, *member)
+		}
+	}
+	m.lock.Unlock()
+	return changes
+}
+
+func readMembersFile(path string) ([]Member, time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	members, err := ParseMembers(file)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return members, info.ModTime(), nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package cluster_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	cluster.HeartbeatInterval = 20 * time.Millisecond
+	cluster.SuspectTimeout = 100 * time.Millisecond
+	cluster.DeadTimeout = 200 * time.Millisecond
+	cluster.WatchInterval = 20 * time.Millisecond
+}
+
+func freeHeartbeat(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func states(m cluster.Membership) string {
+	var s []string
+	for _, member := range m.Members() {
+		s = append(s, member.Name+"="+member.State.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func TestParseMembers(t *testing.T) {
+	members, err := cluster.ParseMembers(strings.NewReader(`
+		# Hubs
+		hub-1  hub  hub-1:8766  hub-1:7946
+
+		edge-1 edge edge-1:8765 edge-1:7946
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].Name != "hub-1" || members[1].Role != cluster.RoleEdge ||
+		members[1].Address != "edge-1:8765" || members[1].Heartbeat != "edge-1:7946" {
+		t.Errorf("Unexpected members %v", members)
+	}
+	invalid := []string{
+		"hub-1 hub hub-1:8766",
+		"hub-1 proxy hub-1:8766 hub-1:7946",
+		"hub-1 hub hub-1:8766 hub-1",
+		"hub-1 hub hub-1:8766 hub-1:7946\nhub-1 edge edge-1:8765 edge-1:7946",
+	}
+	for _, text := range invalid {
+		if _, err := cluster.ParseMembers(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	members := []cluster.Member{
+		{Name: "hub-1", Role: cluster.RoleHub, Address: "localhost:8766", Heartbeat: freeHeartbeat(t)},
+		{Name: "edge-1", Role: cluster.RoleEdge, Address: "localhost:8765", Heartbeat: freeHeartbeat(t)},
+		{Name: "edge-2", Role: cluster.RoleEdge, Address: "localhost:8767", Heartbeat: freeHeartbeat(t)},
+	}
+	var nodes []cluster.Membership
+	for _, member := range members {
+		m, err := cluster.MakeStaticMembership(member.Name, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		nodes = append(nodes, m)
+	}
+	var changes []string
+	var lock sync.Mutex
+	nodes[0].OnChange(func(member cluster.Member) {
+		lock.Lock()
+		changes = append(changes, member.Name+"="+member.State.String())
+		lock.Unlock()
+	})
+	for _, m := range nodes {
+		m := m
+		eventually(t, func() bool { return states(m) == "edge-1=alive edge-2=alive hub-1=alive" })
+	}
+	if alive := nodes[1].Alive(cluster.RoleHub); len(alive) != 1 || alive[0].Name != "hub-1" {
+		t.Errorf("Expected hub-1 alive got %v", alive)
+	}
+	lock.Lock()
+	changes = nil
+	lock.Unlock()
+
+	nodes[2].Close()
+	eventually(t, func() bool { return states(nodes[0]) == "edge-1=alive edge-2=dead hub-1=alive" })
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(changes, " ") != "edge-2=suspect edge-2=dead" {
+		t.Errorf("Unexpected changes %v", changes)
+	}
+}
+
+func TestMembersFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "members")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	hub := "hub-1 hub localhost:8766 " + freeHeartbeat(t) + "\n"
+	write(hub+"edge-1 edge localhost:8765 "+freeHeartbeat(t)+"\n", time.Now().Add(-time.Hour))
+	m, err := cluster.MakeFileMembership("hub-1", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if states(m) != "edge-1=suspect hub-1=alive" {
+		t.Errorf("Unexpected members %s", states(m))
+	}
+
+	var left []string
+	var lock sync.Mutex
+	m.OnChange(func(member cluster.Member) {
+		if member.State == cluster.Left {
+			lock.Lock()
+			left = append(left, member.Name)
+			lock.Unlock()
+		}
+	})
+	write(hub+"edge-2 edge localhost:8767 "+freeHeartbeat(t)+"\n", time.Now())
+	eventually(t, func() bool { return states(m) == "edge-2=suspect hub-1=alive" })
+	lock.Lock()
+	defer lock.Unlock()
+	if len(left) != 1 || left[0] != "edge-1" {
+		t.Errorf("Expected edge-1 to leave got %v", left)
+	}
+
+	// Invalid files are ignored
+	write("edge-3 edge localhost:8768\n", time.Now().Add(time.Hour))
+	time.Sleep(100 * time.Millisecond)
+	if members := m.Members(); len(members) != 2 || members[0].Name != "edge-2" {
+		t.Errorf("Unexpected members %v", members)
+	}
+}
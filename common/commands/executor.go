@@ -22,16 +22,10 @@ func MakeExecutor(r Request) Executor {
 	}
 }
 
-func (r *CallbackExecutor) Execute(registry RegistryReader) error {
+func (r *CallbackExecutor) Execute(registry RegistryReader) ([]byte, error) {
 	callback, ok := registry.Read(r.action)
-	var err error
 	if ok {
-		ok = callback(r.args...)
-		if !ok {
-			err = errors.New(fmt.Sprintf("%q failed", r.action))
-		}
-	} else {
-		err = errors.New(fmt.Sprintf("Unknown Command %q", r.action))
+		return callback(r.args...)
 	}
-	return err
+	return nil, errors.New(fmt.Sprintf("Unknown Command %q", r.action))
 }
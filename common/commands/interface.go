@@ -4,7 +4,9 @@
 
 package commands
 
-type ActionCallback func(...[]byte) bool
+// ActionCallback executes an action with the given args.
+// It returns the encoded reply that has to be sent back to the requester.
+type ActionCallback func(...[]byte) ([]byte, error)
 
 type Request interface {
 	Ok() bool
@@ -13,7 +15,7 @@ type Request interface {
 }
 
 type Executor interface {
-	Execute(registry RegistryReader) error
+	Execute(registry RegistryReader) ([]byte, error)
 }
 
 type RegistryReader interface {
@@ -34,6 +34,11 @@ func (s *SliceDoubleBuffer) Add(a DocId) error {
 func (s *SliceDoubleBuffer) Slice() []DocId {
 	l := &s.lock
 	l.Lock()
+	if len(s.slice) == 0 {
+		//Nothing buffered. Avoid swapping in a fresh slice
+		l.Unlock()
+		return nil
+	}
 	slice := s.slice
 	s.slice = newSlice()
 	l.Unlock()
@@ -5,7 +5,7 @@
 package docid
 
 import (
-	"runtime"
+	"io"
 	"sync"
 )
 
@@ -49,14 +49,18 @@ func (s *HashEdgeSet) Add(source DocId, target DocId) error {
 	if !sourceExists || !targetExists {
 		l.RUnlock()
 		l.Lock()
-		if !sourceExists {
+		// Looked up again as the edges may have been created since the read lock was released
+		if sourceEdges, sourceExists = s.sourceEdges[source.DocId()]; !sourceExists {
 			sourceEdges = s.addSource(source)
 		}
-		if !targetExists {
+		if targetEdges, targetExists = s.targetEdges[target.DocId()]; !targetExists {
 			targetEdges = s.addTarget(target)
 		}
+		// Linked before the write lock is released, the edges can not be removed in between
+		s.addEdge(sourceEdges, target)
+		s.addEdge(targetEdges, source)
 		l.Unlock()
-		l.RLock()
+		return nil
 	}
 	s.addEdge(sourceEdges, target)
 	s.addEdge(targetEdges, source)
@@ -99,102 +103,89 @@ func (s *HashEdgeSet) Contains(source DocId, target DocId) bool {
 func (s *HashEdgeSet) Sources(target DocId) Publisher {
 	l := &s.lock
 	l.RLock()
-	targetEdges, targetExists := s.targetEdges[target.DocId()]
-	if targetExists {
-		publisher := targetEdges.Members()
-		l.RUnlock()
-		return publisher
-	} else {
-		l.RUnlock()
-		return MakeSlicePublisher([]DocId{})
+	defer l.RUnlock()
+	if targetEdges, targetExists := s.targetEdges[target.DocId()]; targetExists {
+		return MakeSlicePublisher(currentMembers(targetEdges))
 	}
+	return MakeSlicePublisher([]DocId{})
 }
 
 //Publish to docIdSliceChannel in slices of size sliceBlockSize all the targets from source DocId. The stream is terminated with empty DocId slice
 func (s *HashEdgeSet) Targets(source DocId) Publisher {
 	l := &s.lock
 	l.RLock()
-	sourceEdges, sourceExists := s.sourceEdges[source.DocId()]
-	if sourceExists {
-		publisher := sourceEdges.Members()
-		l.RUnlock()
-		return publisher
-	} else {
-		l.RUnlock()
-		return MakeSlicePublisher([]DocId{})
+	defer l.RUnlock()
+	if sourceEdges, sourceExists := s.sourceEdges[source.DocId()]; sourceExists {
+		return MakeSlicePublisher(currentMembers(sourceEdges))
 	}
+	return MakeSlicePublisher([]DocId{})
 }
 
-//Removes the source and all the links originating from source
+//Removes the source and all the links originating from source.
+//The links are read and removed under the write lock, so that links added meanwhile are not left dangling
 func (s *HashEdgeSet) RemoveSource(source DocId) error {
-	var err error
 	l := &s.lock
-	sourceId := source.DocId()
-	l.RLock()
-	sourceEdges, sourceExists := s.sourceEdges[source.DocId()]
-	if sourceExists {
-		channel := make(chan []DocId)
-		publisher := sourceEdges.Members()
-		l.RUnlock()
-		l.Lock()
-		delete(s.sourceEdges, sourceId)
-		l.Unlock()
-		publisher.Emit(channel, 0)
-		for slice := range channel {
-			if len(slice) == 0 {
-				break
-			}
-			l.RLock()
-			for _, target := range slice {
-				targetEdges, targetExists := s.targetEdges[target.DocId()]
-				if targetExists {
-					targetEdges.Remove(source)
-				}
+	l.Lock()
+	if sourceEdges, sourceExists := s.sourceEdges[source.DocId()]; sourceExists {
+		delete(s.sourceEdges, source.DocId())
+		for _, target := range currentMembers(sourceEdges) {
+			if targetEdges, targetExists := s.targetEdges[target.DocId()]; targetExists {
+				targetEdges.Remove(source)
 			}
-			l.RUnlock()
-			runtime.Gosched()
 		}
-		close(channel)
-	} else {
-		l.RUnlock()
 	}
-	return err
+	l.Unlock()
+	return nil
 }
 
-//Removes the target and all the links terminating to target
+//Removes the target and all the links terminating to target.
+//The links are read and removed under the write lock, so that links added meanwhile are not left dangling
 func (s *HashEdgeSet) RemoveTarget(target DocId) error {
-	var err error
 	l := &s.lock
-	targetId := target.DocId()
-	l.RLock()
-	targetEdges, targetExists := s.targetEdges[target.DocId()]
-	if targetExists {
-		channel := make(chan []DocId)
-		publisher := targetEdges.Members()
-		l.RUnlock()
-		l.Lock()
-		delete(s.targetEdges, targetId)
-		l.Unlock()
-		publisher.Emit(channel, 0)
-		for slice := range channel {
-			if len(slice) == 0 {
-				break
-			}
-			l.RLock()
-			for _, source := range slice {
-				sourceEdges, sourceExists := s.sourceEdges[source.DocId()]
-				if sourceExists {
-					sourceEdges.Remove(target)
-				}
+	l.Lock()
+	if targetEdges, targetExists := s.targetEdges[target.DocId()]; targetExists {
+		delete(s.targetEdges, target.DocId())
+		for _, source := range currentMembers(targetEdges) {
+			if sourceEdges, sourceExists := s.sourceEdges[source.DocId()]; sourceExists {
+				sourceEdges.Remove(target)
 			}
-			l.RUnlock()
-			runtime.Gosched()
 		}
-		close(channel)
-	} else {
-		l.RUnlock()
 	}
-	return err
+	l.Unlock()
+	return nil
+}
+
+// Invokes callback for each edge, sorted by source and target. Edges added or removed meanwhile may be missed
+func (s *HashEdgeSet) Each(callback func(source DocId, target DocId)) {
+	l := &s.lock
+	l.RLock()
+	sources := make([]DocId, 0, len(s.sourceEdges))
+	sets := make(map[string]Set, len(s.sourceEdges))
+	for id, set := range s.sourceEdges {
+		sources = append(sources, &StrId{Id: id})
+		sets[id] = set
+	}
+	l.RUnlock()
+	sortDocIds(sources)
+	for _, source := range sources {
+		for _, target := range sortedMembers(sets[source.DocId()]) {
+			callback(source, target)
+		}
+	}
+}
+
+// Writes the edges to w, see snapshot.go for the format. Equal sets have equal snapshots
+func (s *HashEdgeSet) Snapshot(w io.Writer) error {
+	return writeEdgeSetSnapshot(w, s.Each)
+}
+
+// Adds the edges read from a snapshot, as edges between StrIds
+func (s *HashEdgeSet) Restore(r io.Reader) error {
+	return s.restore(makeSnapshotReader(r))
+}
+
+func (s *HashEdgeSet) restore(reader *snapshotReader) error {
+	return readEdgeSetSnapshot(reader, s)
 }
 
 func (s *HashEdgeSet) addSource(source DocId) Set {
@@ -6,12 +6,22 @@ package docid
 
 import (
 	"errors"
+	"io"
+	"sort"
 )
 
 var (
 	errorNotFound = errors.New("Index not found")
 )
 
+// EdgeSets of the indexes that can be iterated and snapshotted
+type snapshotEdgeSet interface {
+	EdgeSet
+	Each(callback func(source DocId, target DocId))
+	Snapshot(w io.Writer) error
+	restore(reader *snapshotReader) error
+}
+
 type HashImmutableIndexMap struct {
 	indexmap map[int]EdgeSet
 }
@@ -19,7 +29,7 @@ type HashImmutableIndexMap struct {
 func MakeImmutableIndexMap(indexNames ...int) *HashImmutableIndexMap {
 	indexmap := make(map[int]EdgeSet)
 	for _, indexName := range indexNames {
-		indexmap[indexName] = MakeHashEdgeSet()
+		indexmap[indexName] = MakeShardedEdgeSet(0)
 	}
 	return &HashImmutableIndexMap{indexmap: indexmap}
 }
@@ -67,3 +77,60 @@ func (h *HashImmutableIndexMap) RemoveValue(indexName int, val DocId) error {
 	}
 	return err
 }
+
+// Invokes callback for each entry of the index, see ShardedEdgeSet.Each
+func (h *HashImmutableIndexMap) Each(indexName int, callback func(key DocId, val DocId)) error {
+	edgeset, ok := h.indexmap[indexName].(snapshotEdgeSet)
+	if !ok {
+		return errorNotFound
+	}
+	edgeset.Each(callback)
+	return nil
+}
+
+// Writes every index to w, see snapshot.go for the format
+func (h *HashImmutableIndexMap) Snapshot(w io.Writer) error {
+	names := make([]int, 0, len(h.indexmap))
+	for name := range h.indexmap {
+		names = append(names, name)
+	}
+	sort.Ints(names)
+	writer := makeSnapshotWriter(w)
+	_, writer.err = writer.writer.WriteString(indexMapSnapshotMagic)
+	writer.writeUvarint(indexMapSnapshotVersion)
+	writer.writeUvarint(uint64(len(names)))
+	for _, name := range names {
+		writer.writeVarint(int64(name))
+		edgeset, ok := h.indexmap[name].(snapshotEdgeSet)
+		if !ok {
+			edgeset = MakeHashEdgeSet() // Other EdgeSets are snapshotted empty
+		}
+		if writer.err == nil {
+			writer.err = edgeset.Snapshot(writer.writer)
+		}
+	}
+	return writer.flush()
+}
+
+// Adds the entries read from a snapshot to the indexes, as entries between StrIds.
+// Indexes of the snapshot that are not in the map are skipped
+func (h *HashImmutableIndexMap) Restore(r io.Reader) error {
+	reader := makeSnapshotReader(r)
+	magic := make([]byte, len(indexMapSnapshotMagic))
+	if _, reader.err = io.ReadFull(reader.reader, magic); reader.err == nil && string(magic) != indexMapSnapshotMagic {
+		return errorSnapshotCorrupt
+	}
+	reader.readVersion(indexMapSnapshotVersion)
+	count := reader.readUvarint()
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		name := int(reader.readVarint())
+		edgeset, ok := h.indexmap[name].(snapshotEdgeSet)
+		if !ok {
+			edgeset = MakeHashEdgeSet()
+		}
+		if reader.err == nil {
+			reader.err = edgeset.restore(reader)
+		}
+	}
+	return reader.error()
+}
@@ -5,9 +5,18 @@
 package docid
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	idPrefix = makeIdPrefix() // Random prefix of the message ids generated by the process
+	idSeq    int64            // Sequence number of the last message id generated by the process
+)
+
 type Message struct {
 	StrId
 	Source    DocId
@@ -15,12 +24,33 @@ type Message struct {
 	Timestamp int64
 }
 
+// Makes a message whose id is the hash of the source and the content, the same for every message with that content
 func MakeMessage(source DocId, content []byte) *Message {
 	msg := &Message{Source: source, Content: content, Timestamp: time.Now().Unix()}
 	msg.Id = MD5([]byte(source.DocId()), content)
 	return msg
 }
 
+// Makes a message with a new unique id, see UniqueMessageId. Publishing the same content twice makes distinct messages
+func MakeUniqueMessage(source DocId, content []byte) *Message {
+	msg := &Message{Source: source, Content: content, Timestamp: time.Now().Unix()}
+	msg.Id = UniqueMessageId()
+	return msg
+}
+
+// Returns an id that no other message gets, made of a random prefix drawn once per process and a sequence number
+func UniqueMessageId() string {
+	return idPrefix + strconv.FormatInt(atomic.AddInt64(&idSeq, 1), 36)
+}
+
+func makeIdPrefix() string {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16) + "-"
+	}
+	return hex.EncodeToString(prefix) + "-"
+}
+
 func (m *Message) Body() []byte {
 	return m.Content
 }
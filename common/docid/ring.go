@@ -0,0 +1,93 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package docid
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+  Thread-safe MessageRing that retains the last capacity messages not older than maxAge.
+  A zero maxAge retains messages regardless of their age
+*/
+type MessageRing struct {
+	messages []*Message
+	head     int // Index of the oldest message
+	size     int // Count of messages in the ring
+	maxAge   time.Duration
+	lock     sync.RWMutex //ReadWrite synchronization mutex
+}
+
+func MakeMessageRing(capacity int, maxAge time.Duration) *MessageRing {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &MessageRing{
+		messages: make([]*Message, capacity),
+		maxAge:   maxAge,
+	}
+}
+
+// Adds the message overwriting the oldest one once the ring is full
+func (r *MessageRing) Add(msg *Message) {
+	l := &r.lock
+	l.Lock()
+	capacity := len(r.messages)
+	if r.size < capacity {
+		r.messages[(r.head+r.size)%capacity] = msg
+		r.size++
+	} else {
+		r.messages[r.head] = msg
+		r.head = (r.head + 1) % capacity
+	}
+	l.Unlock()
+}
+
+// Returns at most count latest messages with Timestamp not before since, oldest first.
+// Non positive count returns all the retained messages
+func (r *MessageRing) Last(count int, since int64) []*Message {
+	l := &r.lock
+	l.Lock()
+	r.expire(time.Now())
+	capacity := len(r.messages)
+	first := 0
+	if count > 0 && count < r.size {
+		first = r.size - count
+	}
+	messages := make([]*Message, 0, r.size-first)
+	for i := first; i < r.size; i++ {
+		msg := r.messages[(r.head+i)%capacity]
+		if msg.Timestamp >= since {
+			messages = append(messages, msg)
+		}
+	}
+	l.Unlock()
+	return messages
+}
+
+// Count of retained messages
+func (r *MessageRing) Len() int {
+	l := &r.lock
+	l.Lock()
+	r.expire(time.Now())
+	size := r.size
+	l.Unlock()
+	return size
+}
+
+// Drops the messages older than maxAge. Must be called holding the write lock
+func (r *MessageRing) expire(now time.Time) {
+	if r.maxAge <= 0 {
+		return
+	}
+	oldest := now.Add(-r.maxAge).Unix()
+	capacity := len(r.messages)
+	for r.size > 0 && r.messages[r.head].Timestamp < oldest {
+		r.messages[r.head] = nil
+		r.head = (r.head + 1) % capacity
+		r.size--
+	}
+}
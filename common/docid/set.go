@@ -5,6 +5,7 @@
 package docid
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -72,9 +73,11 @@ func (s *HashSet) Add(a DocId) error {
 		} else {
 			l.RUnlock()
 		}
-		// l.RUnlock()
 		l.Lock()
-		s.add(a)
+		// Checked again as the member may have been added since the read lock was released
+		if _, ok = s.index[id]; !ok {
+			s.add(a)
+		}
 		l.Unlock()
 	} else {
 		l.RUnlock()
@@ -91,9 +94,12 @@ func (s *HashSet) Remove(a DocId) error {
 	if ok {
 		l.RUnlock()
 		l.Lock()
-		delete(s.index, id)
-		s.Count--
-		s.setDirty()
+		// Checked again as the member may have been removed since the read lock was released
+		if _, ok = s.index[id]; ok {
+			delete(s.index, id)
+			s.Count--
+			s.setDirty()
+		}
 		l.Unlock()
 	} else {
 		l.RUnlock()
@@ -141,6 +147,62 @@ func (s *HashSet) RebuildMembers() {
 	l.Unlock()
 }
 
+// Members read from the index. Unlike Members it is consistent after removals
+func (s *HashSet) snapshot() []DocId {
+	l := &s.lock
+	l.RLock()
+	members := make([]DocId, 0, len(s.index))
+	for _, member := range s.index {
+		members = append(members, member)
+	}
+	l.RUnlock()
+	return members
+}
+
+// Members sorted by DocId. Unlike Members it is consistent after removals
+func (s *HashSet) sortedMembers() []DocId {
+	members := s.snapshot()
+	sortDocIds(members)
+	return members
+}
+
+// Members of any Set, consistent after removals
+func currentMembers(set Set) []DocId {
+	if hashSet, ok := set.(*HashSet); ok {
+		return hashSet.snapshot()
+	}
+	return sortedMembers(set)
+}
+
+// Members of any Set sorted by DocId
+func sortedMembers(set Set) []DocId {
+	if hashSet, ok := set.(*HashSet); ok {
+		return hashSet.sortedMembers()
+	}
+	var members []DocId
+	seen := make(map[string]bool)
+	channel := make(chan []DocId)
+	set.Members().Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, member := range slice {
+			if !seen[member.DocId()] && set.Contains(member) {
+				seen[member.DocId()] = true
+				members = append(members, member)
+			}
+		}
+	}
+	close(channel)
+	sortDocIds(members)
+	return members
+}
+
+func sortDocIds(ids []DocId) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].DocId() < ids[j].DocId() })
+}
+
 // Critical Section that adds a member to set
 func (s *HashSet) add(a DocId) {
 	s.index[a.DocId()] = a
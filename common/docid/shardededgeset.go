@@ -0,0 +1,217 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package docid
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+	Lock-striped thread-safe implementation of EdgeSet interface.
+	Forward edges are sharded by source and backward edges by target, each shard guarded by its own lock, so that
+	edges of different nodes do not contend. Edges are added and removed holding the source shard and then the target
+	shard, RemoveSource and RemoveTarget remove them one by one, hence both directions of an edge change together
+	and the shards are never locked in the inverse order.
+*/
+type ShardedEdgeSet struct {
+	sourceShards []edgeShard // Forward Edges
+	targetShards []edgeShard // Backward Edges
+	mask         uint32      // Shard count minus one, the shard count is a power of two
+}
+
+type edgeShard struct {
+	edges map[string]Set // Edges of the nodes of the shard
+	lock  sync.RWMutex   //ReadWrite synchronization mutex
+	_     [32]byte       // Pads the shard to a cache line so that the locks of neighbouring shards do not share one
+}
+
+// Constructor to create ShardedEdgeSets, shardCount is rounded up to a power of two, if non positive DefaultShardCount is used
+func MakeShardedEdgeSet(shardCount int, members ...map[DocId]DocId) *ShardedEdgeSet {
+	count := shardCountOf(shardCount)
+	edges := &ShardedEdgeSet{
+		sourceShards: make([]edgeShard, count),
+		targetShards: make([]edgeShard, count),
+		mask:         uint32(count - 1),
+	}
+	for i := 0; i < count; i++ {
+		edges.sourceShards[i].edges = make(map[string]Set)
+		edges.targetShards[i].edges = make(map[string]Set)
+	}
+	for _, member := range members {
+		for source, target := range member {
+			edges.Add(source, target)
+		}
+	}
+	return edges
+}
+
+//Adds an edge from sourceId to targetId
+func (s *ShardedEdgeSet) Add(source DocId, target DocId) error {
+	sourceEdges, unlockSource := s.sourceShard(source).acquire(source.DocId())
+	targetEdges, unlockTarget := s.targetShard(target).acquire(target.DocId())
+	sourceEdges.Add(target)
+	targetEdges.Add(source)
+	unlockTarget()
+	unlockSource()
+	return nil
+}
+
+//Removes an edge from source to target
+func (s *ShardedEdgeSet) Remove(source DocId, target DocId) error {
+	var err error
+	sourceShard, targetShard := s.sourceShard(source), s.targetShard(target)
+	sourceShard.lock.RLock()
+	targetShard.lock.RLock()
+	sourceEdges, sourceExists := sourceShard.edges[source.DocId()]
+	targetEdges, targetExists := targetShard.edges[target.DocId()]
+	if sourceExists && targetExists {
+		err = sourceEdges.Remove(target)
+		if err == nil {
+			err = targetEdges.Remove(source)
+		}
+	}
+	targetShard.lock.RUnlock()
+	sourceShard.lock.RUnlock()
+	return err
+}
+
+//Checks whether edge between source and target
+func (s *ShardedEdgeSet) Contains(source DocId, target DocId) bool {
+	sourceShard, targetShard := s.sourceShard(source), s.targetShard(target)
+	sourceShard.lock.RLock()
+	targetShard.lock.RLock()
+	sourceEdges, sourceExists := sourceShard.edges[source.DocId()]
+	targetEdges, targetExists := targetShard.edges[target.DocId()]
+	exists := sourceExists && targetExists
+	if exists {
+		exists = sourceEdges.Contains(target) && targetEdges.Contains(source)
+	}
+	targetShard.lock.RUnlock()
+	sourceShard.lock.RUnlock()
+	return exists
+}
+
+//Publish to docIdSliceChannel in slices of size sliceBlockSize all the sources to target DocId. The stream is terminated with empty DocId slice
+func (s *ShardedEdgeSet) Sources(target DocId) Publisher {
+	return s.targetShard(target).members(target.DocId())
+}
+
+//Publish to docIdSliceChannel in slices of size sliceBlockSize all the targets from source DocId. The stream is terminated with empty DocId slice
+func (s *ShardedEdgeSet) Targets(source DocId) Publisher {
+	return s.sourceShard(source).members(source.DocId())
+}
+
+//Removes the source and all the links originating from source
+func (s *ShardedEdgeSet) RemoveSource(source DocId) error {
+	shard := s.sourceShard(source)
+	shard.lock.RLock()
+	sourceEdges, sourceExists := shard.edges[source.DocId()]
+	shard.lock.RUnlock()
+	if !sourceExists {
+		return nil
+	}
+	for _, target := range sortedMembers(sourceEdges) {
+		s.Remove(source, target)
+	}
+	shard.removeEmpty(source.DocId())
+	return nil
+}
+
+//Removes the target and all the links terminating to target
+func (s *ShardedEdgeSet) RemoveTarget(target DocId) error {
+	shard := s.targetShard(target)
+	shard.lock.RLock()
+	targetEdges, targetExists := shard.edges[target.DocId()]
+	shard.lock.RUnlock()
+	if !targetExists {
+		return nil
+	}
+	for _, source := range sortedMembers(targetEdges) {
+		s.Remove(source, target)
+	}
+	shard.removeEmpty(target.DocId())
+	return nil
+}
+
+// Invokes callback for each edge, sorted by source and target. Edges added or removed meanwhile may be missed
+func (s *ShardedEdgeSet) Each(callback func(source DocId, target DocId)) {
+	var sources []DocId
+	sets := make(map[string]Set)
+	for i := range s.sourceShards {
+		shard := &s.sourceShards[i]
+		shard.lock.RLock()
+		for id, set := range shard.edges {
+			sources = append(sources, &StrId{Id: id})
+			sets[id] = set
+		}
+		shard.lock.RUnlock()
+	}
+	sortDocIds(sources)
+	for _, source := range sources {
+		for _, target := range sortedMembers(sets[source.DocId()]) {
+			callback(source, target)
+		}
+	}
+}
+
+// Writes the edges to w, see snapshot.go for the format. Equal sets have equal snapshots
+func (s *ShardedEdgeSet) Snapshot(w io.Writer) error {
+	return writeEdgeSetSnapshot(w, s.Each)
+}
+
+// Adds the edges read from a snapshot, as edges between StrIds
+func (s *ShardedEdgeSet) Restore(r io.Reader) error {
+	return s.restore(makeSnapshotReader(r))
+}
+
+func (s *ShardedEdgeSet) restore(reader *snapshotReader) error {
+	return readEdgeSetSnapshot(reader, s)
+}
+
+func (s *ShardedEdgeSet) sourceShard(source DocId) *edgeShard {
+	return &s.sourceShards[shardHash(source.DocId())&s.mask]
+}
+
+func (s *ShardedEdgeSet) targetShard(target DocId) *edgeShard {
+	return &s.targetShards[shardHash(target.DocId())&s.mask]
+}
+
+// Returns the edges of the node, creating them if needed, with the shard locked until unlock is called.
+// The shard is read locked when the edges exist and write locked when they are created
+func (shard *edgeShard) acquire(id string) (edges Set, unlock func()) {
+	l := &shard.lock
+	l.RLock()
+	if edges, ok := shard.edges[id]; ok {
+		return edges, l.RUnlock
+	}
+	l.RUnlock()
+	l.Lock()
+	// Checked again as the edges may have been created since the read lock was released
+	edges, ok := shard.edges[id]
+	if !ok {
+		edges = MakeHashSet(nil)
+		shard.edges[id] = edges
+	}
+	return edges, l.Unlock
+}
+
+func (shard *edgeShard) members(id string) Publisher {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	if edges, ok := shard.edges[id]; ok {
+		return MakeSlicePublisher(currentMembers(edges))
+	}
+	return MakeSlicePublisher([]DocId{})
+}
+
+// Removes the edges of the node unless edges were added to it meanwhile
+func (shard *edgeShard) removeEmpty(id string) {
+	shard.lock.Lock()
+	if edges, ok := shard.edges[id]; ok && len(sortedMembers(edges)) == 0 {
+		delete(shard.edges, id)
+	}
+	shard.lock.Unlock()
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package docid
+
+import (
+	"sync"
+)
+
+var (
+	DefaultShardCount = 32 // Shards of sharded sets created with a non positive shard count
+)
+
+/*
+	Lock-striped thread-safe implementation of Set interface.
+	Members are spread over shards by the hash of their DocId, each guarded by its own lock, so that writers of
+	different members do not contend. Unlike HashSet it has no members cache, Members is consistent with the shards.
+*/
+type ShardedSet struct {
+	shards []setShard
+	mask   uint32 // Shard count minus one, the shard count is a power of two
+}
+
+type setShard struct {
+	index map[string]DocId //Index keyed with members
+	lock  sync.RWMutex     //ReadWrite synchronization mutex
+	_     [32]byte         // Pads the shard to a cache line so that the locks of neighbouring shards do not share one
+}
+
+/*
+	Constructor to create ShardedSets.
+	shardCount is rounded up to a power of two, if non positive DefaultShardCount is used.
+	Next you can pass on all the members of type docId you would initialize set with.
+*/
+func MakeShardedSet(shardCount int, members ...DocId) *ShardedSet {
+	count := shardCountOf(shardCount)
+	set := &ShardedSet{
+		shards: make([]setShard, count),
+		mask:   uint32(count - 1),
+	}
+	for i := range set.shards {
+		set.shards[i].index = make(map[string]DocId)
+	}
+	for _, member := range members {
+		set.shard(member.DocId()).index[member.DocId()] = member
+	}
+	return set
+}
+
+//Adds member to ShardedSet
+func (s *ShardedSet) Add(a DocId) error {
+	id := a.DocId()
+	shard := s.shard(id)
+	l := &shard.lock
+	l.RLock()
+	_, ok := shard.index[id]
+	l.RUnlock()
+	if !ok {
+		l.Lock()
+		// Checked again as the member may have been added since the read lock was released
+		if _, ok = shard.index[id]; !ok {
+			shard.index[id] = a
+		}
+		l.Unlock()
+	}
+	return nil
+}
+
+//Removes member from ShardedSet
+func (s *ShardedSet) Remove(a DocId) error {
+	id := a.DocId()
+	shard := s.shard(id)
+	l := &shard.lock
+	l.RLock()
+	_, ok := shard.index[id]
+	l.RUnlock()
+	if ok {
+		l.Lock()
+		delete(shard.index, id)
+		l.Unlock()
+	}
+	return nil
+}
+
+//Checks whether a DocId belongs to the Set
+func (s *ShardedSet) Contains(a DocId) bool {
+	id := a.DocId()
+	shard := s.shard(id)
+	shard.lock.RLock()
+	_, ok := shard.index[id]
+	shard.lock.RUnlock()
+	return ok
+}
+
+//Returns members publisher. Each shard is read at once, members added or removed meanwhile in others may be missed
+func (s *ShardedSet) Members() Publisher {
+	members := make([]DocId, 0, s.Len())
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		for _, member := range shard.index {
+			members = append(members, member)
+		}
+		shard.lock.RUnlock()
+	}
+	return MakeSlicePublisher(members)
+}
+
+// Returns the member count
+func (s *ShardedSet) Len() int {
+	count := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		count += len(shard.index)
+		shard.lock.RUnlock()
+	}
+	return count
+}
+
+func (s *ShardedSet) shard(id string) *setShard {
+	return &s.shards[shardHash(id)&s.mask]
+}
+
+// Rounds shardCount up to a power of two, DefaultShardCount if non positive
+func shardCountOf(shardCount int) int {
+	if shardCount <= 0 {
+		shardCount = DefaultShardCount
+	}
+	count := 1
+	for count < shardCount {
+		count <<= 1
+	}
+	return count
+}
+
+// FNV-1a hash of id, spreads ids over the shards
+func shardHash(id string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		hash ^= uint32(id[i])
+		hash *= 16777619
+	}
+	return hash
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package docid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	errorSnapshotCorrupt = errors.New("Corrupt snapshot")
+)
+
+const (
+	edgeSetSnapshotVersion  = 1
+	indexMapSnapshotVersion = 1
+	indexMapSnapshotMagic   = "PGIX"
+	maxSnapshotIdLength     = 1 << 20 // Longer ids are taken for corruption
+)
+
+/*
+	Snapshots are written in a versioned binary format. Integers are varints and ids are length prefixed.
+
+		EdgeSet:  version | source-count | (source | target-count | target ...) ...
+		IndexMap: "PGIX" | version | index-count | (index-name | EdgeSet) ...
+
+	Restored ids are StrIds, owners of richer DocIds map them back with their DocId.
+*/
+
+type snapshotWriter struct {
+	writer *bufio.Writer
+	buffer [binary.MaxVarintLen64]byte
+	err    error
+}
+
+func makeSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{writer: bufio.NewWriter(w)}
+}
+
+func (w *snapshotWriter) writeUvarint(v uint64) {
+	if w.err == nil {
+		_, w.err = w.writer.Write(w.buffer[:binary.PutUvarint(w.buffer[:], v)])
+	}
+}
+
+func (w *snapshotWriter) writeVarint(v int64) {
+	if w.err == nil {
+		_, w.err = w.writer.Write(w.buffer[:binary.PutVarint(w.buffer[:], v)])
+	}
+}
+
+func (w *snapshotWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	if w.err == nil {
+		_, w.err = w.writer.WriteString(s)
+	}
+}
+
+func (w *snapshotWriter) flush() error {
+	if w.err == nil {
+		w.err = w.writer.Flush()
+	}
+	return w.err
+}
+
+type snapshotReader struct {
+	reader *bufio.Reader
+	err    error
+}
+
+// Buffers r, so the reader may read past the end of the snapshot. A *bufio.Reader r is used as is,
+// leaving whatever follows the snapshot unread in it
+func makeSnapshotReader(r io.Reader) *snapshotReader {
+	return &snapshotReader{reader: bufio.NewReader(r)}
+}
+
+func (r *snapshotReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = binary.ReadUvarint(r.reader)
+	return v
+}
+
+func (r *snapshotReader) readVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	var v int64
+	v, r.err = binary.ReadVarint(r.reader)
+	return v
+}
+
+func (r *snapshotReader) readString() string {
+	length := r.readUvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > maxSnapshotIdLength {
+		r.err = errorSnapshotCorrupt
+		return ""
+	}
+	buffer := make([]byte, length)
+	_, r.err = io.ReadFull(r.reader, buffer)
+	return string(buffer)
+}
+
+// Writes the edges iterated by each, sorted by source and target, as an EdgeSet snapshot
+func writeEdgeSetSnapshot(w io.Writer, each func(callback func(source DocId, target DocId))) error {
+	var sources []string
+	targets := make(map[string][]string)
+	each(func(source DocId, target DocId) {
+		id := source.DocId()
+		if _, ok := targets[id]; !ok {
+			sources = append(sources, id)
+		}
+		targets[id] = append(targets[id], target.DocId())
+	})
+	writer := makeSnapshotWriter(w)
+	writer.writeUvarint(edgeSetSnapshotVersion)
+	writer.writeUvarint(uint64(len(sources)))
+	for _, source := range sources {
+		writer.writeString(source)
+		writer.writeUvarint(uint64(len(targets[source])))
+		for _, target := range targets[source] {
+			writer.writeString(target)
+		}
+	}
+	return writer.flush()
+}
+
+// Reads an EdgeSet snapshot and adds its edges to edges
+func readEdgeSetSnapshot(reader *snapshotReader, edges EdgeSet) error {
+	reader.readVersion(edgeSetSnapshotVersion)
+	sources := reader.readUvarint()
+	for i := uint64(0); i < sources && reader.err == nil; i++ {
+		source := &StrId{Id: reader.readString()}
+		targets := reader.readUvarint()
+		for j := uint64(0); j < targets && reader.err == nil; j++ {
+			target := reader.readString()
+			if reader.err == nil {
+				edges.Add(source, &StrId{Id: target})
+			}
+		}
+	}
+	return reader.error()
+}
+
+// Reads the version and checks it is supported
+func (r *snapshotReader) readVersion(supported uint64) {
+	if version := r.readUvarint(); r.err == nil && version != supported {
+		r.err = fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+}
+
+// Error reading the snapshot. A truncated snapshot is corrupt
+func (r *snapshotReader) error() error {
+	if r.err == io.EOF || r.err == io.ErrUnexpectedEOF {
+		return errorSnapshotCorrupt
+	}
+	return r.err
+}
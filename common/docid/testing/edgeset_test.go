@@ -8,6 +8,10 @@ import (
 	"github.com/pigeond-io/pigeond/common/docid"
 	. "github.com/pigeond-io/pigeond/common/docid/testing"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	// "time"
 )
@@ -25,8 +29,151 @@ func BenchmarkHashEdgeSetAdd(b *testing.B) {
 	}
 }
 
+func BenchmarkHashEdgeSetAddParallel(b *testing.B) {
+	benchmarkEdgeSetAddParallel(b, docid.MakeHashEdgeSet())
+}
+
+func BenchmarkShardedEdgeSetAddParallel(b *testing.B) {
+	benchmarkEdgeSetAddParallel(b, docid.MakeShardedEdgeSet(0))
+}
+
+func BenchmarkHashEdgeSetContainsParallel(b *testing.B) {
+	benchmarkEdgeSetContainsParallel(b, docid.MakeHashEdgeSet())
+}
+
+func BenchmarkShardedEdgeSetContainsParallel(b *testing.B) {
+	benchmarkEdgeSetContainsParallel(b, docid.MakeShardedEdgeSet(0))
+}
+
+// Every goroutine subscribes its own sessions to shared topics, run with -cpu 1,2,4,8 to compare the scaling
+func benchmarkEdgeSetAddParallel(b *testing.B, edgeset docid.EdgeSet) {
+	topics := RandStrIds(700)
+	var goroutines int64
+	b.RunParallel(func(pb *testing.PB) {
+		sessions := make([]docid.DocId, 1024)
+		n := atomic.AddInt64(&goroutines, 1) << 32
+		for i := range sessions {
+			sessions[i] = ID(n + int64(i))
+		}
+		for i := 1024; pb.Next(); i++ {
+			edgeset.Add(topics[i%700], sessions[i%1024])
+			edgeset.Remove(topics[(i-512)%700], sessions[(i-512)%1024])
+		}
+	})
+}
+
+func benchmarkEdgeSetContainsParallel(b *testing.B, edgeset docid.EdgeSet) {
+	topics := RandStrIds(700)
+	sessions := make([]docid.DocId, 7000)
+	for n := range sessions {
+		sessions[n] = ID(int64(n))
+		edgeset.Add(topics[n%700], sessions[n])
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			edgeset.Contains(topics[n%700], sessions[n%7000])
+		}
+	})
+}
+
 func TestHashEdgeSetSelfLoop(t *testing.T) {
-	edgeset := docid.MakeHashEdgeSet()
+	testEdgeSetSelfLoop(t, docid.MakeHashEdgeSet())
+}
+
+func TestShardedEdgeSetSelfLoop(t *testing.T) {
+	testEdgeSetSelfLoop(t, docid.MakeShardedEdgeSet(0))
+}
+
+func TestHashEdgeSetDuplicates(t *testing.T) {
+	testEdgeSetDuplicates(t, docid.MakeHashEdgeSet())
+}
+
+func TestShardedEdgeSetDuplicates(t *testing.T) {
+	testEdgeSetDuplicates(t, docid.MakeShardedEdgeSet(0))
+}
+
+func TestHashEdgeSet(t *testing.T) {
+	testEdgeSet(t, docid.MakeHashEdgeSet())
+}
+
+func TestShardedEdgeSet(t *testing.T) {
+	testEdgeSet(t, docid.MakeShardedEdgeSet(2))
+}
+
+// Edges added concurrently to new sources and targets are not lost, nor left behind by concurrent removals
+func TestHashEdgeSetConcurrency(t *testing.T) {
+	testEdgeSetConcurrency(t, docid.MakeHashEdgeSet())
+}
+
+func TestShardedEdgeSetConcurrency(t *testing.T) {
+	testEdgeSetConcurrency(t, docid.MakeShardedEdgeSet(2))
+}
+
+func testEdgeSetConcurrency(t *testing.T, edgeset docid.EdgeSet) {
+	var wg sync.WaitGroup
+	for i := int64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			for n := int64(0); n < 200; n++ {
+				edgeset.Add(ID(n%10), ID(n))
+				edgeset.Add(ID(n%10), ID(1000+i))
+				edgeset.Add(ID(100+i), ID(n))
+			}
+			edgeset.RemoveSource(ID(100 + i))
+			edgeset.RemoveTarget(ID(1000 + i))
+		}(i)
+	}
+	wg.Wait()
+	tt := TestEdgeSet(t, edgeset)
+	for n := int64(0); n < 200; n++ {
+		tt.ShouldContain(ID(n%10), ID(n))
+		for i := int64(0); i < 8; i++ {
+			tt.ShouldNotContain(ID(n%10), ID(1000+i))
+			tt.ShouldNotContain(ID(100+i), ID(n))
+		}
+		if sources := publishedIds(edgeset.Sources(ID(n))); sources != ID(n%10).DocId() {
+			t.Errorf("Sources of %d expected %d got %s", n, n%10, sources)
+		}
+	}
+	for k := int64(0); k < 10; k++ {
+		var targets []docid.DocId
+		for n := k; n < 200; n += 10 {
+			targets = append(targets, ID(n))
+		}
+		if expected, got := publishedIds(docid.MakeSlicePublisher(targets)), publishedIds(edgeset.Targets(ID(k))); got != expected {
+			t.Errorf("Targets of %d expected %s got %s", k, expected, got)
+		}
+	}
+	for i := int64(0); i < 8; i++ {
+		if targets := publishedIds(edgeset.Targets(ID(100 + i))); targets != "" {
+			t.Errorf("Removed source %d has targets %s", 100+i, targets)
+		}
+		if sources := publishedIds(edgeset.Sources(ID(1000 + i))); sources != "" {
+			t.Errorf("Removed target %d has sources %s", 1000+i, sources)
+		}
+	}
+}
+
+// Sorted ids emitted by publisher, space separated
+func publishedIds(publisher docid.Publisher) string {
+	var ids []string
+	channel := make(chan []docid.DocId)
+	publisher.Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, docId := range slice {
+			ids = append(ids, docId.DocId())
+		}
+	}
+	close(channel)
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func testEdgeSetSelfLoop(t *testing.T, edgeset docid.EdgeSet) {
 	tt := TestEdgeSet(t, edgeset)
 	a := ID(1)
 	edgeset.Add(a, a)
@@ -37,8 +184,7 @@ func TestHashEdgeSetSelfLoop(t *testing.T) {
 		ShouldNotContain(a, a)
 }
 
-func TestHashEdgeSetDuplicates(t *testing.T) {
-	edgeset := docid.MakeHashEdgeSet()
+func testEdgeSetDuplicates(t *testing.T, edgeset docid.EdgeSet) {
 	tt := TestEdgeSet(t, edgeset)
 	a := ID(1)
 	b := ID(2)
@@ -53,8 +199,7 @@ func TestHashEdgeSetDuplicates(t *testing.T) {
 		ShouldNotContain(a, b)
 }
 
-func TestHashEdgeSet(t *testing.T) {
-	edgeset := docid.MakeHashEdgeSet()
+func testEdgeSet(t *testing.T, edgeset docid.EdgeSet) {
 	tt := TestEdgeSet(t, edgeset)
 
 	a := ID(1)
@@ -0,0 +1,57 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func makeMessage(i int, timestamp int64) *docid.Message {
+	msg := docid.MakeMessage(&docid.StrId{Id: "topic"}, []byte(strconv.Itoa(i)))
+	msg.Timestamp = timestamp
+	return msg
+}
+
+func ringBodies(messages []*docid.Message) string {
+	var bodies string
+	for _, msg := range messages {
+		bodies += string(msg.Body())
+	}
+	return bodies
+}
+
+func TestMessageRingCapacity(t *testing.T) {
+	ring := docid.MakeMessageRing(3, 0)
+	now := time.Now().Unix()
+	for i := 1; i <= 5; i++ {
+		ring.Add(makeMessage(i, now))
+	}
+	if ring.Len() != 3 {
+		t.Errorf("Expected 3 messages got %d", ring.Len())
+	}
+	if bodies := ringBodies(ring.Last(0, 0)); bodies != "345" {
+		t.Errorf("Expected 345 got %s", bodies)
+	}
+	if bodies := ringBodies(ring.Last(2, 0)); bodies != "45" {
+		t.Errorf("Expected 45 got %s", bodies)
+	}
+}
+
+func TestMessageRingAge(t *testing.T) {
+	ring := docid.MakeMessageRing(10, time.Minute)
+	now := time.Now().Unix()
+	ring.Add(makeMessage(1, now-120))
+	ring.Add(makeMessage(2, now-30))
+	ring.Add(makeMessage(3, now))
+	if bodies := ringBodies(ring.Last(0, 0)); bodies != "23" {
+		t.Errorf("Expected 23 got %s", bodies)
+	}
+	if bodies := ringBodies(ring.Last(0, now-10)); bodies != "3" {
+		t.Errorf("Expected 3 got %s", bodies)
+	}
+}
@@ -7,6 +7,8 @@ package testing_test
 import (
 	"github.com/pigeond-io/pigeond/common/docid"
 	. "github.com/pigeond-io/pigeond/common/docid/testing"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -45,20 +47,113 @@ func BenchmarkHashSetAdd3Threads(b *testing.B) {
 	<-done
 }
 
+func BenchmarkHashSetAddParallel(b *testing.B) {
+	benchmarkSetAddParallel(b, docid.MakeHashSet(nil))
+}
+
+func BenchmarkShardedSetAddParallel(b *testing.B) {
+	benchmarkSetAddParallel(b, docid.MakeShardedSet(0))
+}
+
+func BenchmarkHashSetContainsParallel(b *testing.B) {
+	benchmarkSetContainsParallel(b, docid.MakeHashSet(nil))
+}
+
+func BenchmarkShardedSetContainsParallel(b *testing.B) {
+	benchmarkSetContainsParallel(b, docid.MakeShardedSet(0))
+}
+
+// Every goroutine adds and removes its own members, run with -cpu 1,2,4,8 to compare the scaling
+func benchmarkSetAddParallel(b *testing.B, set docid.Set) {
+	var goroutines int64
+	b.RunParallel(func(pb *testing.PB) {
+		members := make([]docid.DocId, 1024)
+		n := atomic.AddInt64(&goroutines, 1) << 32
+		for i := range members {
+			members[i] = ID(n + int64(i))
+		}
+		for i := 1024; pb.Next(); i++ {
+			set.Add(members[i%1024])
+			set.Remove(members[(i-512)%1024])
+		}
+	})
+}
+
+func benchmarkSetContainsParallel(b *testing.B, set docid.Set) {
+	ids := make([]docid.DocId, 2048)
+	for n := range ids {
+		ids[n] = ID(int64(n))
+	}
+	for _, id := range ids[:1024] {
+		set.Add(id)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			set.Contains(ids[n&2047])
+		}
+	})
+}
+
 func TestHashSet(t *testing.T) {
 	cacheDirtyValidity := time.Duration(0)
 	set := docid.MakeHashSet(&cacheDirtyValidity)
+	testSet(t, set, func() int { return set.Count })
+}
+
+func TestShardedSet(t *testing.T) {
+	set := docid.MakeShardedSet(4)
+	testSet(t, set, set.Len)
+}
+
+// Concurrent adds and removes of the same members are counted once
+func TestHashSetConcurrency(t *testing.T) {
+	set := docid.MakeHashSet(nil)
+	testSetConcurrency(t, set, func() int { return set.Count })
+}
+
+func TestShardedSetConcurrency(t *testing.T) {
+	set := docid.MakeShardedSet(4)
+	testSetConcurrency(t, set, set.Len)
+}
+
+func testSetConcurrency(t *testing.T, set docid.Set, count func() int) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := int64(0); n < 1000; n++ {
+				set.Add(ID(n))
+			}
+			for n := int64(0); n < 1000; n += 2 {
+				set.Remove(ID(n))
+			}
+		}()
+	}
+	wg.Wait()
+	tt := TestSet(t, set)
+	_ = tt.CountShouldBe(500, count())
+	for n := int64(0); n < 1000; n++ {
+		if n%2 == 0 {
+			tt.ShouldNotContain(ID(n))
+		} else {
+			tt.ShouldContain(ID(n))
+		}
+	}
+}
+
+func testSet(t *testing.T, set docid.Set, setCount func() int) {
 	tt := TestSet(t, set)
 	count := 0
 	set.Add(ID(1))
 	count++
-	_ = tt.CountShouldBe(count, set.Count)
+	_ = tt.CountShouldBe(count, setCount())
 	set.Add(ID(2))
 	count++
-	_ = tt.CountShouldBe(count, set.Count)
+	_ = tt.CountShouldBe(count, setCount())
 	// TestDuplicate
 	set.Add(ID(2))
-	_ = tt.CountShouldBe(count, set.Count)
+	_ = tt.CountShouldBe(count, setCount())
 	set.Add(ID(3))
 	count++
 	set.Add(ID(4))
@@ -69,12 +164,14 @@ func TestHashSet(t *testing.T) {
 	count++
 	set.Remove(ID(2))
 	count--
-	_ = tt.CountShouldBe(count, set.Count)
+	_ = tt.CountShouldBe(count, setCount())
 	// TestNonExistence
 	set.Remove(ID(8))
-	_ = tt.CountShouldBe(count, set.Count)
+	_ = tt.CountShouldBe(count, setCount())
 	//Membership
-	set.RebuildMembers()
+	if hashSet, ok := set.(*docid.HashSet); ok {
+		hashSet.RebuildMembers()
+	}
 	publisher := set.Members()
 	channel := make(chan []docid.DocId)
 	publisher.Emit(channel, 0)
@@ -87,7 +184,7 @@ func TestHashSet(t *testing.T) {
 			_ = tt.ShouldContain(docid)
 			index++
 		}
-		_ = tt.CountShouldBe(set.Count, index)
+		_ = tt.CountShouldBe(setCount(), index)
 	}
 	var (
 		nonmembers = []int64{2, 6, 8}
@@ -0,0 +1,98 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing_test
+
+import (
+	"bytes"
+	"github.com/pigeond-io/pigeond/common/docid"
+	. "github.com/pigeond-io/pigeond/common/docid/testing"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHashEdgeSetSnapshot(t *testing.T) {
+	edgeset := docid.MakeHashEdgeSet()
+	edgeset.Add(SID("news"), SID("s1"))
+	edgeset.Add(SID("news"), SID("s2"))
+	edgeset.Add(SID("chat"), SID("s2"))
+	edgeset.Add(SID("gone"), SID("s3"))
+	edgeset.Remove(SID("news"), SID("s2"))
+	edgeset.RemoveTarget(SID("s3"))
+	var snapshot bytes.Buffer
+	if err := edgeset.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := docid.MakeHashEdgeSet()
+	if err := restored.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	_ = TestEdgeSet(t, restored).
+		ShouldContain(SID("news"), SID("s1")).
+		ShouldContain(SID("chat"), SID("s2")).
+		ShouldNotContain(SID("news"), SID("s2")).
+		ShouldNotContain(SID("gone"), SID("s3"))
+	var again bytes.Buffer
+	restored.Snapshot(&again)
+	if !bytes.Equal(snapshot.Bytes(), again.Bytes()) {
+		t.Errorf("Expected the snapshot of the restored set to be %q got %q", snapshot.Bytes(), again.Bytes())
+	}
+
+	if err := docid.MakeHashEdgeSet().Restore(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-2])); err == nil {
+		t.Error("Expected truncated snapshot to fail")
+	}
+	if err := docid.MakeHashEdgeSet().Restore(bytes.NewReader([]byte{9, 0})); err == nil {
+		t.Error("Expected unsupported version to fail")
+	}
+}
+
+func TestHashImmutableIndexMapSnapshot(t *testing.T) {
+	index := docid.MakeImmutableIndexMap(0, 1, 2)
+	index.Add(0, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(SID("s1"), SID("c1"))
+	})
+	index.Add(2, func(idx docid.AddIndexEntryWriter) error {
+		idx.Add(SID("news"), SID("s1"))
+		return idx.Add(SID("news"), SID("s2"))
+	})
+	var snapshot bytes.Buffer
+	if err := index.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := docid.MakeImmutableIndexMap(0, 2) // Index 1 is skipped
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	expectTargets(t, restored, 0, "s1", "c1")
+	expectTargets(t, restored, 2, "news", "s1 s2")
+	if err := docid.MakeImmutableIndexMap(0).Restore(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("Expected garbage snapshot to fail")
+	}
+}
+
+func expectTargets(t *testing.T, index docid.ImmutableIndexMap, name int, key string, expected string) {
+	publisher, err := index.Query(name, SID(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	channel := make(chan []docid.DocId)
+	publisher.Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, id := range slice {
+			ids = append(ids, id.DocId())
+		}
+	}
+	close(channel)
+	sort.Strings(ids)
+	if got := strings.Join(ids, " "); got != expected {
+		t.Errorf("Expected %s in index %d got %s", expected, name, got)
+	}
+}
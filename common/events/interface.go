@@ -12,8 +12,23 @@ type Message interface {
 type Subscriber interface {
 	Subscribe(topic string) bool
 	Unsubscribe(topic string) bool
+	// Topics currently subscribed
+	Topics() []string
+	// Count of topic and pattern subscriptions
+	Subscriptions() int
+}
+
+// PatternSubscriber subscribes to all the topics matching glob patterns
+type PatternSubscriber interface {
+	PSubscribe(pattern string) bool
+	PUnsubscribe(pattern string) bool
+	// Patterns currently subscribed
+	Patterns() []string
+	// Count of topic and pattern subscriptions
+	Subscriptions() int
 }
 
 type Publisher interface {
-	Publish(topic string, msgs ...Message) bool
+	// Publishes msgs to topic and returns the number of receivers
+	Publish(topic string, msgs ...Message) (int, bool)
 }
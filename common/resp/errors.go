@@ -0,0 +1,35 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package resp
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	ReplyError is an error with its own RESP error code, e.g. -NOPERM or -NOPROTO.
+	Clients can branch on the code, the first word of the error reply.
+*/
+type ReplyError struct {
+	Code   string
+	Reason string
+}
+
+func MakeReplyError(code string, format string, args ...interface{}) *ReplyError {
+	return &ReplyError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *ReplyError) Error() string {
+	return e.Code + " " + e.Reason
+}
+
+// Error reply for err. Errors without a code are replied as -Error reason
+func ErrorReply(err error) string {
+	if replyErr, ok := err.(*ReplyError); ok {
+		return "-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(replyErr.Error()) + "\r\n"
+	}
+	return ErrorResponse(err.Error())
+}
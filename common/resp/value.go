@@ -0,0 +1,297 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+	RESP3 value reader. It reads RESP2 as well, as RESP3 is a superset of RESP2.
+	Commands are read using Read, ReadValue is meant for reading replies and pushes.
+
+	https://github.com/antirez/RESP3/blob/master/spec.md
+*/
+
+type ValueType byte
+
+const (
+	SimpleStr ValueType = '+'
+	Err       ValueType = '-'
+	Int       ValueType = ':'
+	BulkStr   ValueType = '$'
+	Array     ValueType = '*'
+	Null      ValueType = '_'
+	Bool      ValueType = '#'
+	Double    ValueType = ','
+	BigNum    ValueType = '('
+	BlobErr   ValueType = '!'
+	Verbatim  ValueType = '='
+	Map       ValueType = '%'
+	Set       ValueType = '~'
+	Attr      ValueType = '|'
+	Push      ValueType = '>'
+)
+
+var (
+	MaxBulkLength   = int64(512 << 20) // Max length of a bulk string
+	MaxAggregateLen = int64(1 << 20)   // Max elements in an aggregate
+	MaxNestingDepth = 64               // Max aggregates nested in one another, so that a value can not exhaust the stack
+	errorProtocol   = errors.New("Protocol error")
+	errorTooDeep    = errors.New("Protocol error: aggregates nested too deep")
+)
+
+type Value struct {
+	Type   ValueType
+	Str    []byte   // SimpleStr, Err, BulkStr, BigNum, BlobErr, Verbatim
+	Format string   // Verbatim format
+	Int    int64    // Int
+	Double float64  // Double
+	Bool   bool     // Bool
+	Elems  []*Value // Array, Set, Push. Key value pairs are flattened for Map
+	Attrs  []*Value // Attributes of the value as flattened key value pairs
+}
+
+func (v *Value) IsNull() bool {
+	return v.Type == Null
+}
+
+func (v *Value) IsAggregate() bool {
+	switch v.Type {
+	case Array, Map, Set, Push:
+		return true
+	}
+	return false
+}
+
+func (v *Value) String() string {
+	switch v.Type {
+	case Null:
+		return "(nil)"
+	case Int:
+		return strconv.FormatInt(v.Int, 10)
+	case Double:
+		return strconv.FormatFloat(v.Double, 'g', -1, 64)
+	case Bool:
+		return strconv.FormatBool(v.Bool)
+	case Array, Map, Set, Push:
+		var buffer bytes.Buffer
+		buffer.WriteByte(byte(v.Type))
+		buffer.WriteString("[")
+		for i, elem := range v.Elems {
+			if i > 0 {
+				buffer.WriteString(" ")
+			}
+			buffer.WriteString(elem.String())
+		}
+		buffer.WriteString("]")
+		return buffer.String()
+	}
+	return string(v.Str)
+}
+
+// Ok, Action and Args let a Value be executed as a commands.Request.
+// A value is a command when it is a non empty array of bulk or simple strings, e.g. *2\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n
+func (v *Value) Ok() bool {
+	if v.Type != Array || len(v.Elems) == 0 {
+		return false
+	}
+	for _, elem := range v.Elems {
+		if elem.Type != BulkStr && elem.Type != SimpleStr {
+			return false
+		}
+	}
+	return true
+}
+
+// Make sure you call this after you have checked if value is Ok()
+func (v *Value) Action() string {
+	return string(v.Elems[0].Str)
+}
+
+// Make sure you call this after you have checked if value is Ok()
+func (v *Value) Args() [][]byte {
+	args := make([][]byte, 0, len(v.Elems)-1)
+	for _, elem := range v.Elems[1:] {
+		args = append(args, elem.Str)
+	}
+	return args
+}
+
+// Reads all the values from slice
+func ReadValues(slice []byte) ([]*Value, error) {
+	reader := bufio.NewReader(bytes.NewReader(slice))
+	values := make([]*Value, 0, 8)
+	for {
+		value, err := ReadValue(reader)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+}
+
+// Reads a single value. Attributes preceding the value are attached to it
+func ReadValue(reader *bufio.Reader) (*Value, error) {
+	return readValue(reader, 0)
+}
+
+// Reads a value nested in depth aggregates
+func readValue(reader *bufio.Reader, depth int) (*Value, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errorProtocol
+	}
+	value := &Value{Type: ValueType(line[0])}
+	body := line[1:]
+	switch value.Type {
+	case SimpleStr, Err, BigNum:
+		value.Str = body
+	case Int:
+		value.Int, err = strconv.ParseInt(string(body), 10, 64)
+	case Null:
+		if len(body) != 0 {
+			err = errorProtocol
+		}
+	case Bool:
+		switch string(body) {
+		case "t":
+			value.Bool = true
+		case "f":
+			value.Bool = false
+		default:
+			err = errorProtocol
+		}
+	case Double:
+		value.Double, err = parseDouble(string(body))
+	case BulkStr, BlobErr, Verbatim:
+		err = readBlob(reader, value, body)
+	case Array, Set, Push, Map, Attr:
+		err = readAggregate(reader, value, body, depth+1)
+	default:
+		err = fmt.Errorf("Unknown RESP type %q", line[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value.Type == Attr {
+		// Attributes describe the value that follows
+		next, err := readValue(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		next.Attrs = value.Elems
+		return next, nil
+	}
+	return value, nil
+}
+
+func readBlob(reader *bufio.Reader, value *Value, body []byte) error {
+	length, err := strconv.ParseInt(string(body), 10, 64)
+	if err != nil {
+		return err
+	}
+	if length < 0 {
+		// RESP2 nil bulk string
+		value.Type = Null
+		return nil
+	}
+	if length > MaxBulkLength {
+		return errorProtocol
+	}
+	blob := make([]byte, length+2)
+	_, err = io.ReadFull(reader, blob)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if blob[length] != '\r' || blob[length+1] != '\n' {
+		return errorProtocol
+	}
+	value.Str = blob[:length]
+	if value.Type == Verbatim {
+		if length < 4 || value.Str[3] != ':' {
+			return errorProtocol
+		}
+		value.Format = string(value.Str[:3])
+		value.Str = value.Str[4:]
+	}
+	return nil
+}
+
+func readAggregate(reader *bufio.Reader, value *Value, body []byte, depth int) error {
+	if depth > MaxNestingDepth {
+		return errorTooDeep
+	}
+	count, err := strconv.ParseInt(string(body), 10, 64)
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		// RESP2 nil array
+		value.Type = Null
+		return nil
+	}
+	if value.Type == Map || value.Type == Attr {
+		count <<= 1
+	}
+	if count > MaxAggregateLen {
+		return errorProtocol
+	}
+	value.Elems = make([]*Value, 0, count)
+	for i := int64(0); i < count; i++ {
+		elem, err := readValue(reader, depth)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		value.Elems = append(value.Elems, elem)
+	}
+	return nil
+}
+
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errorProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Values are never terminated half way, EOF inside a value is unexpected
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package resp_test
+
+import (
+	"bytes"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"math"
+	"strings"
+	"testing"
+)
+
+func testEncoding3(t *testing.T, expected string, write func(*resp.Writer)) {
+	var buffer bytes.Buffer
+	w := resp.MakeVersionedWriter(&buffer, resp.RESP3)
+	write(w)
+	if w.Err() != nil {
+		t.Errorf("Unexpected error %v while writing %q", w.Err(), expected)
+	}
+	if buffer.String() != expected {
+		shouldBeThis(t, "Encoding", expected, buffer.String())
+	}
+}
+
+func readSingleValue(t *testing.T, encoded string) *resp.Value {
+	values, err := resp.ReadValues([]byte(encoded))
+	if err != nil {
+		shouldBeParsedSuccessfully(t, encoded)
+		return nil
+	}
+	if len(values) != 1 {
+		shouldBeThis(t, "values", 1, len(values))
+		return nil
+	}
+	return values[0]
+}
+
+func TestWriteRESP3Types(t *testing.T) {
+	testEncoding3(t, "_\r\n", func(w *resp.Writer) { w.WriteNil() })
+	testEncoding3(t, "#t\r\n#f\r\n", func(w *resp.Writer) { w.WriteBoolean(true).WriteBoolean(false) })
+	testEncoding3(t, ",3.14\r\n,inf\r\n", func(w *resp.Writer) { w.WriteDouble(3.14).WriteDouble(math.Inf(1)) })
+	testEncoding3(t, "(12345678901234567890\r\n", func(w *resp.Writer) { w.WriteBigNumber("12345678901234567890") })
+	testEncoding3(t, "=15\r\ntxt:Some string\r\n", func(w *resp.Writer) { w.WriteVerbatim("txt", "Some string") })
+	testEncoding3(t, "%1\r\n$5\r\nproto\r\n:3\r\n", func(w *resp.Writer) {
+		w.WriteValue(map[string]interface{}{"proto": 3})
+	})
+	testEncoding3(t, "~1\r\n$7\r\nMyTopic\r\n", func(w *resp.Writer) { w.WriteSetHeader(1).WriteBulkString("MyTopic") })
+	testEncoding3(t, "|1\r\n$3\r\nttl\r\n:3600\r\n:1\r\n", func(w *resp.Writer) {
+		w.WriteAttributes(map[string]interface{}{"ttl": 3600}).WriteInteger(1)
+	})
+	testEncoding3(t, ">3\r\n$7\r\nmessage\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n", func(w *resp.Writer) {
+		w.WriteMessage("MyTopic", []byte("hello"))
+	})
+}
+
+func TestWriteRESP3TypesDowngradedToRESP2(t *testing.T) {
+	testEncoding(t, ":1\r\n:0\r\n", func(w *resp.Writer) { w.WriteBoolean(true).WriteBoolean(false) })
+	testEncoding(t, "$4\r\n3.14\r\n", func(w *resp.Writer) { w.WriteDouble(3.14) })
+	testEncoding(t, "$11\r\nSome string\r\n", func(w *resp.Writer) { w.WriteVerbatim("txt", "Some string") })
+	testEncoding(t, "*2\r\n$5\r\nproto\r\n:2\r\n", func(w *resp.Writer) {
+		w.WriteValue(map[string]interface{}{"proto": 2})
+	})
+	testEncoding(t, ":1\r\n", func(w *resp.Writer) {
+		w.WriteAttributes(map[string]interface{}{"ttl": 3600}).WriteInteger(1)
+	})
+}
+
+func TestReadRESP2Values(t *testing.T) {
+	if v := readSingleValue(t, "+OK\r\n"); v != nil && (v.Type != resp.SimpleStr || string(v.Str) != "OK") {
+		shouldBeThis(t, "Simple String", "OK", v)
+	}
+	if v := readSingleValue(t, "-ERR unknown\r\n"); v != nil && (v.Type != resp.Err || string(v.Str) != "ERR unknown") {
+		shouldBeThis(t, "Error", "ERR unknown", v)
+	}
+	if v := readSingleValue(t, ":-42\r\n"); v != nil && v.Int != -42 {
+		shouldBeThis(t, "Integer", -42, v)
+	}
+	if v := readSingleValue(t, "$-1\r\n"); v != nil && !v.IsNull() {
+		shouldBeThis(t, "Nil", "(nil)", v)
+	}
+	if v := readSingleValue(t, "*2\r\n$4\r\na\r\nb\r\n*0\r\n"); v != nil && (len(v.Elems) != 2 || string(v.Elems[0].Str) != "a\r\nb") {
+		shouldBeThis(t, "Array", "*[a\r\nb *[]]", v)
+	}
+}
+
+func TestReadRESP3Values(t *testing.T) {
+	if v := readSingleValue(t, "_\r\n"); v != nil && !v.IsNull() {
+		shouldBeThis(t, "Null", "(nil)", v)
+	}
+	if v := readSingleValue(t, "#t\r\n"); v != nil && !v.Bool {
+		shouldBeThis(t, "Boolean", true, v)
+	}
+	if v := readSingleValue(t, ",-inf\r\n"); v != nil && !math.IsInf(v.Double, -1) {
+		shouldBeThis(t, "Double", "-inf", v)
+	}
+	if v := readSingleValue(t, "=15\r\nmkd:Some string\r\n"); v != nil && (v.Format != "mkd" || string(v.Str) != "Some string") {
+		shouldBeThis(t, "Verbatim", "mkd:Some string", v.Format+":"+string(v.Str))
+	}
+	if v := readSingleValue(t, "%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n"); v != nil && (v.Type != resp.Map || len(v.Elems) != 4) {
+		shouldBeThis(t, "Map", "%[a 1 b 2]", v)
+	}
+	if v := readSingleValue(t, "|1\r\n+ttl\r\n:3600\r\n$2\r\nhi\r\n"); v != nil && (string(v.Str) != "hi" || len(v.Attrs) != 2) {
+		shouldBeThis(t, "Attributed value", "hi", v)
+	}
+}
+
+func TestReadInvalidValues(t *testing.T) {
+	invalid := []string{"?1\r\n", "#x\r\n", "$5\r\nab\r\n", "*2\r\n:1\r\n", "+OK\n", "=5\r\nabcde\r\n"}
+	for _, encoded := range invalid {
+		if _, err := resp.ReadValues([]byte(encoded)); err == nil {
+			t.Errorf("%q should not be parsed", encoded)
+		}
+	}
+}
+
+func TestReadDeeplyNestedArray(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat("*1\r\n", depth) + ":1\r\n")
+	}
+	if _, err := resp.ReadValues(nested(resp.MaxNestingDepth)); err != nil {
+		t.Errorf("Array nested %d deep should be parsed, Err: %v", resp.MaxNestingDepth, err)
+	}
+	if _, err := resp.ReadValues(nested(resp.MaxNestingDepth + 1)); err == nil {
+		t.Errorf("Array nested %d deep should not be parsed", resp.MaxNestingDepth+1)
+	}
+	if _, err := resp.ReadValues(nested(1000000)); err == nil {
+		t.Error("Array nested 1000000 deep should not be parsed")
+	}
+}
+
+func TestRoundTripPushes(t *testing.T) {
+	var buffer bytes.Buffer
+	w := resp.MakeVersionedWriter(&buffer, resp.RESP3)
+	w.WriteSubscription("subscribe", "MyTopic", 1)
+	w.WriteInteger(2)
+	w.WritePMessage("My*", "MyTopic", []byte("hello"))
+	values, err := resp.ReadValues(buffer.Bytes())
+	if err != nil || len(values) != 3 {
+		shouldBeParsedSuccessfully(t, buffer.String())
+		return
+	}
+	// Pushes can be told apart from replies
+	expected := []resp.ValueType{resp.Push, resp.Int, resp.Push}
+	for i, value := range values {
+		if value.Type != expected[i] {
+			shouldBeThis(t, argLiteral(i), string(expected[i]), string(value.Type))
+		}
+	}
+	if push := values[2]; push.Type == resp.Push && (len(push.Elems) != 4 || string(push.Elems[3].Str) != "hello") {
+		shouldBeThis(t, "pmessage", ">[pmessage My* MyTopic hello]", push)
+	}
+}
+
+func TestValueAsCommand(t *testing.T) {
+	values, err := resp.ReadValues([]byte("*3\r\n$7\r\nPUBLISH\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n:1\r\n*0\r\n"))
+	if err != nil || len(values) != 3 {
+		shouldBeParsedSuccessfully(t, "PUBLISH MyTopic hello")
+		return
+	}
+	cmd := values[0]
+	if !cmd.Ok() || cmd.Action() != "PUBLISH" || len(cmd.Args()) != 2 || string(cmd.Args()[1]) != "hello" {
+		shouldBeThis(t, "command", "PUBLISH MyTopic hello", cmd)
+	}
+	if values[1].Ok() || values[2].Ok() {
+		t.Errorf("Integer and empty array should not be commands")
+	}
+}
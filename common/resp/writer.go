@@ -0,0 +1,371 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package resp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Writer encodes RESP replies
+
+	Simple String  +OK\r\n
+	Error          -ERR reason\r\n
+	Integer        :42\r\n
+	Bulk String    $7\r\nmytopic\r\n
+	Nil            $-1\r\n
+	Array          *2\r\n$7\r\nmessage\r\n:1\r\n
+
+	RESP3 (negotiated with HELLO 3) adds the following types
+
+	Null           _\r\n
+	Boolean        #t\r\n
+	Double         ,3.14\r\n
+	Big Number     (3492890328409238509324850943850943825024385\r\n
+	Verbatim       =15\r\ntxt:Some string\r\n
+	Map            %1\r\n+proto\r\n:3\r\n
+	Set            ~1\r\n+mytopic\r\n
+	Attribute      |1\r\n+ttl\r\n:3600\r\n
+	Push           >3\r\n+message\r\n+mytopic\r\n+hello\r\n
+
+	While writing RESP2 the RESP3 types are downgraded the way redis does: null to nil bulk string, boolean to integer,
+	double, big number & verbatim to bulk string, map to a flat array of key value pairs, set & push to array.
+	Attributes can not be represented in RESP2 and are skipped.
+
+	Arrays (and other aggregates) are written by writing the header followed by its elements, which allows nesting.
+	Writer remembers the first error. Once an error occurs all the subsequent writes are skipped.
+*/
+type Writer struct {
+	w        io.Writer
+	protocol int    // RESP protocol version
+	scratch  []byte // Reusable buffer to encode headers
+	err      error  // First error encountered while writing
+}
+
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+var (
+	crlf         = []byte("\r\n")
+	null         = []byte("_\r\n")
+	lineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+)
+
+// Makes a RESP2 writer
+func MakeWriter(w io.Writer) *Writer {
+	return MakeVersionedWriter(w, RESP2)
+}
+
+// Makes a writer for the protocol version. Unknown versions fallback to RESP2
+func MakeVersionedWriter(w io.Writer, protocol int) *Writer {
+	if protocol != RESP3 {
+		protocol = RESP2
+	}
+	return &Writer{w: w, protocol: protocol, scratch: make([]byte, 0, 32)}
+}
+
+// RESP protocol version of the writer
+func (w *Writer) Protocol() int {
+	return w.protocol
+}
+
+// Returns the first error encountered while writing
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) WriteSimpleString(s string) *Writer {
+	return w.writeLine('+', s)
+}
+
+// Writes an error. The reason is expected to start with an error prefix like ERR or NOPERM
+func (w *Writer) WriteError(reason string) *Writer {
+	return w.writeLine('-', reason)
+}
+
+func (w *Writer) WriteInteger(i int64) *Writer {
+	return w.writeHeader(':', i)
+}
+
+func (w *Writer) WriteBulk(slice []byte) *Writer {
+	if slice == nil {
+		return w.WriteNil()
+	}
+	w.writeHeader('$', int64(len(slice)))
+	w.write(slice)
+	return w.write(crlf)
+}
+
+func (w *Writer) WriteBulkString(s string) *Writer {
+	w.writeHeader('$', int64(len(s)))
+	w.writeString(s)
+	return w.write(crlf)
+}
+
+func (w *Writer) WriteNil() *Writer {
+	if w.protocol == RESP3 {
+		return w.write(null)
+	}
+	return w.writeHeader('$', -1)
+}
+
+func (w *Writer) WriteBoolean(b bool) *Writer {
+	if w.protocol == RESP3 {
+		if b {
+			return w.writeLine('#', "t")
+		}
+		return w.writeLine('#', "f")
+	}
+	if b {
+		return w.WriteInteger(1)
+	}
+	return w.WriteInteger(0)
+}
+
+func (w *Writer) WriteDouble(f float64) *Writer {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if w.protocol == RESP3 {
+		return w.writeLine(',', s)
+	}
+	return w.WriteBulkString(s)
+}
+
+// Writes a big number. The number is expected to be a valid integer in base 10
+func (w *Writer) WriteBigNumber(number string) *Writer {
+	if w.protocol == RESP3 {
+		return w.writeLine('(', number)
+	}
+	return w.WriteBulkString(number)
+}
+
+// Writes a verbatim string with a three letter format like txt or mkd
+func (w *Writer) WriteVerbatim(format string, s string) *Writer {
+	if w.protocol == RESP3 {
+		w.writeHeader('=', int64(len(format)+1+len(s)))
+		w.writeString(format)
+		w.writeString(":")
+		w.writeString(s)
+		return w.write(crlf)
+	}
+	return w.WriteBulkString(s)
+}
+
+// Writes the array header. It has to be followed by count elements
+func (w *Writer) WriteArrayHeader(count int) *Writer {
+	return w.writeHeader('*', int64(count))
+}
+
+// Writes the map header. It has to be followed by count key value pairs
+func (w *Writer) WriteMapHeader(count int) *Writer {
+	if w.protocol == RESP3 {
+		return w.writeHeader('%', int64(count))
+	}
+	return w.writeHeader('*', int64(count<<1))
+}
+
+// Writes the set header. It has to be followed by count elements
+func (w *Writer) WriteSetHeader(count int) *Writer {
+	if w.protocol == RESP3 {
+		return w.writeHeader('~', int64(count))
+	}
+	return w.writeHeader('*', int64(count))
+}
+
+// Writes the push header. It has to be followed by count elements
+func (w *Writer) WritePushHeader(count int) *Writer {
+	if w.protocol == RESP3 {
+		return w.writeHeader('>', int64(count))
+	}
+	return w.writeHeader('*', int64(count))
+}
+
+// Writes attributes of the reply that follows. Attributes are skipped in RESP2
+func (w *Writer) WriteAttributes(attrs map[string]interface{}) *Writer {
+	if w.protocol != RESP3 {
+		return w
+	}
+	w.writeHeader('|', int64(len(attrs)))
+	for _, key := range sortedKeys(attrs) {
+		w.WriteBulkString(key)
+		w.WriteValue(attrs[key])
+	}
+	return w
+}
+
+// Writes an array of bulk strings
+func (w *Writer) WriteStrings(strs ...string) *Writer {
+	w.WriteArrayHeader(len(strs))
+	for _, s := range strs {
+		w.WriteBulkString(s)
+	}
+	return w
+}
+
+/*
+	Writes a value based on its type
+
+	nil                     Nil
+	string, []byte          Bulk String
+	int, int32, int64       Integer
+	bool                    Boolean
+	float32, float64        Double
+	error                   Error
+	[]string, [][]byte      Array of Bulk Strings
+	[]interface{}           Array of values
+	map[string]interface{}  Map of values sorted by keys
+*/
+func (w *Writer) WriteValue(v interface{}) *Writer {
+	switch val := v.(type) {
+	case nil:
+		return w.WriteNil()
+	case string:
+		return w.WriteBulkString(val)
+	case []byte:
+		return w.WriteBulk(val)
+	case int:
+		return w.WriteInteger(int64(val))
+	case int32:
+		return w.WriteInteger(int64(val))
+	case int64:
+		return w.WriteInteger(val)
+	case bool:
+		return w.WriteBoolean(val)
+	case float32:
+		return w.WriteDouble(float64(val))
+	case float64:
+		return w.WriteDouble(val)
+	case error:
+		return w.WriteError(val.Error())
+	case []string:
+		return w.WriteStrings(val...)
+	case [][]byte:
+		w.WriteArrayHeader(len(val))
+		for _, slice := range val {
+			w.WriteBulk(slice)
+		}
+		return w
+	case []interface{}:
+		w.WriteArrayHeader(len(val))
+		for _, elem := range val {
+			w.WriteValue(elem)
+		}
+		return w
+	case map[string]interface{}:
+		w.WriteMapHeader(len(val))
+		for _, key := range sortedKeys(val) {
+			w.WriteBulkString(key)
+			w.WriteValue(val[key])
+		}
+		return w
+	}
+	if w.err == nil {
+		w.err = fmt.Errorf("Unsupported RESP value %T", v)
+	}
+	return w
+}
+
+// Subscription confirmation (kind, topic, subscription count) similar to redis subscribe/unsubscribe replies.
+// Empty topic is written as nil
+func (w *Writer) WriteSubscription(kind string, topic string, count int) *Writer {
+	w.WritePushHeader(3)
+	w.WriteBulkString(kind)
+	if topic == "" {
+		w.WriteNil()
+	} else {
+		w.WriteBulkString(topic)
+	}
+	return w.WriteInteger(int64(count))
+}
+
+// Message push on topic similar to redis pub/sub message
+func (w *Writer) WriteMessage(topic string, content []byte) *Writer {
+	w.WritePushHeader(3)
+	w.WriteBulkString("message")
+	w.WriteBulkString(topic)
+	return w.WriteBulk(content)
+}
+
+// Message push on topic matching the pattern similar to redis pub/sub pmessage
+func (w *Writer) WritePMessage(pattern string, topic string, content []byte) *Writer {
+	w.WritePushHeader(4)
+	w.WriteBulkString("pmessage")
+	w.WriteBulkString(pattern)
+	w.WriteBulkString(topic)
+	return w.WriteBulk(content)
+}
+
+// Message push on topic followed by the message id. Sent to the clients that can resume their session
+func (w *Writer) WriteMessageWithId(topic string, content []byte, id string) *Writer {
+	w.WritePushHeader(4)
+	w.WriteBulkString("message")
+	w.WriteBulkString(topic)
+	w.WriteBulk(content)
+	return w.WriteBulkString(id)
+}
+
+// Message push on topic matching the pattern followed by the message id. Sent to the clients that can resume their session
+func (w *Writer) WritePMessageWithId(pattern string, topic string, content []byte, id string) *Writer {
+	w.WritePushHeader(5)
+	w.WriteBulkString("pmessage")
+	w.WriteBulkString(pattern)
+	w.WriteBulkString(topic)
+	w.WriteBulk(content)
+	return w.WriteBulkString(id)
+}
+
+func (w *Writer) writeHeader(prefix byte, i int64) *Writer {
+	scratch := append(w.scratch[:0], prefix)
+	scratch = strconv.AppendInt(scratch, i, 10)
+	scratch = append(scratch, crlf...)
+	return w.write(scratch)
+}
+
+// Simple strings and errors can not contain CR or LF, hence they are replaced with spaces
+func (w *Writer) writeLine(prefix byte, s string) *Writer {
+	scratch := append(w.scratch[:0], prefix)
+	w.write(scratch)
+	w.writeString(lineReplacer.Replace(s))
+	return w.write(crlf)
+}
+
+func (w *Writer) writeString(s string) *Writer {
+	if w.err == nil {
+		_, w.err = io.WriteString(w.w, s)
+	}
+	return w
+}
+
+func (w *Writer) write(slice []byte) *Writer {
+	if w.err == nil {
+		_, w.err = w.w.Write(slice)
+	}
+	return w
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
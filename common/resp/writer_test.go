@@ -0,0 +1,130 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package resp_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"testing"
+)
+
+func testEncoding(t *testing.T, expected string, write func(*resp.Writer)) {
+	var buffer bytes.Buffer
+	w := resp.MakeWriter(&buffer)
+	write(w)
+	if w.Err() != nil {
+		t.Errorf("Unexpected error %v while writing %q", w.Err(), expected)
+	}
+	if buffer.String() != expected {
+		shouldBeThis(t, "Encoding", expected, buffer.String())
+	}
+}
+
+func TestWriteSimpleTypes(t *testing.T) {
+	testEncoding(t, "+OK\r\n", func(w *resp.Writer) { w.WriteSimpleString("OK") })
+	testEncoding(t, "-ERR unknown\r\n", func(w *resp.Writer) { w.WriteError("ERR unknown") })
+	testEncoding(t, "-ERR multi line\r\n", func(w *resp.Writer) { w.WriteError("ERR multi\nline") })
+	testEncoding(t, ":42\r\n", func(w *resp.Writer) { w.WriteInteger(42) })
+	testEncoding(t, ":-1\r\n", func(w *resp.Writer) { w.WriteInteger(-1) })
+	testEncoding(t, "$7\r\nMyTopic\r\n", func(w *resp.Writer) { w.WriteBulkString("MyTopic") })
+	testEncoding(t, "$0\r\n\r\n", func(w *resp.Writer) { w.WriteBulk([]byte{}) })
+	testEncoding(t, "$-1\r\n", func(w *resp.Writer) { w.WriteNil() })
+	testEncoding(t, "$-1\r\n", func(w *resp.Writer) { w.WriteBulk(nil) })
+}
+
+func TestWriteNestedArrays(t *testing.T) {
+	testEncoding(t, "*2\r\n*1\r\n:1\r\n*2\r\n$1\r\na\r\n$-1\r\n", func(w *resp.Writer) {
+		w.WriteArrayHeader(2)
+		w.WriteArrayHeader(1).WriteInteger(1)
+		w.WriteArrayHeader(2).WriteBulkString("a").WriteNil()
+	})
+	testEncoding(t, "*3\r\n$1\r\na\r\n:2\r\n*1\r\n-ERR x\r\n", func(w *resp.Writer) {
+		w.WriteValue([]interface{}{"a", 2, []interface{}{errors.New("ERR x")}})
+	})
+	testEncoding(t, "*0\r\n", func(w *resp.Writer) { w.WriteStrings() })
+}
+
+func TestWritePushes(t *testing.T) {
+	testEncoding(t, "*3\r\n$9\r\nsubscribe\r\n$7\r\nMyTopic\r\n:1\r\n", func(w *resp.Writer) {
+		w.WriteSubscription("subscribe", "MyTopic", 1)
+	})
+	testEncoding(t, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", func(w *resp.Writer) {
+		w.WriteSubscription("unsubscribe", "", 0)
+	})
+	testEncoding(t, "*3\r\n$7\r\nmessage\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n", func(w *resp.Writer) {
+		w.WriteMessage("MyTopic", []byte("hello"))
+	})
+	testEncoding(t, "*4\r\n$8\r\npmessage\r\n$3\r\nMy*\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n", func(w *resp.Writer) {
+		w.WritePMessage("My*", "MyTopic", []byte("hello"))
+	})
+	testEncoding(t, "*4\r\n$7\r\nmessage\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n$2\r\n42\r\n", func(w *resp.Writer) {
+		w.WriteMessageWithId("MyTopic", []byte("hello"), "42")
+	})
+	testEncoding(t, "*5\r\n$8\r\npmessage\r\n$3\r\nMy*\r\n$7\r\nMyTopic\r\n$5\r\nhello\r\n$2\r\n42\r\n", func(w *resp.Writer) {
+		w.WritePMessageWithId("My*", "MyTopic", []byte("hello"), "42")
+	})
+}
+
+func TestWriteUnsupportedValue(t *testing.T) {
+	var buffer bytes.Buffer
+	w := resp.MakeWriter(&buffer)
+	w.WriteValue(complex(1, 2)).WriteInteger(1)
+	if w.Err() == nil {
+		t.Errorf("Expected error while writing unsupported value")
+	}
+	if buffer.Len() != 0 {
+		shouldBeThis(t, "Encoding", "", buffer.String())
+	}
+}
+
+func TestRoundTripSingleCommands(t *testing.T) {
+	var buffer bytes.Buffer
+	resp.MakeWriter(&buffer).WriteSimpleString("SUBSCRIBE")
+	testCommand(t, buffer.String(), "SUBSCRIBE")
+
+	buffer.Reset()
+	resp.MakeWriter(&buffer).WriteBulkString("SUBSCRIBE")
+	testCommand(t, buffer.String(), "SUBSCRIBE")
+
+	buffer.Reset()
+	resp.MakeWriter(&buffer).WriteStrings("SUBSCRIBE")
+	testCommand(t, buffer.String(), "SUBSCRIBE")
+
+	buffer.Reset()
+	resp.MakeWriter(&buffer).WriteStrings("SUBSCRIBE", "MyTopic")
+	testCommand(t, buffer.String(), "SUBSCRIBE", "MyTopic")
+
+	buffer.Reset()
+	resp.MakeWriter(&buffer).WriteValue([][]byte{[]byte("PUBLISH"), []byte("MyTopic"), []byte("multi\r\nline")})
+	testCommand(t, buffer.String(), "PUBLISH", "MyTopic", "multi\r\nline")
+}
+
+func TestRoundTripMultipleCommands(t *testing.T) {
+	var buffer bytes.Buffer
+	w := resp.MakeWriter(&buffer)
+	w.WriteStrings("SUBSCRIBE", "MyTopic")
+	w.WriteStrings("SUBSCRIBE", "MyTopic", "MySubTopic")
+	w.WriteStrings("SUBSCRIBE")
+	w.WriteSimpleString("UNSUBSCRIBE")
+	cmds, ok := testMultiCommand(t, buffer.String(), 4)
+	if ok {
+		testRespCommand(t, cmds[0], "SUBSCRIBE", "MyTopic")
+		testRespCommand(t, cmds[1], "SUBSCRIBE", "MyTopic", "MySubTopic")
+		testRespCommand(t, cmds[2], "SUBSCRIBE")
+		testRespCommand(t, cmds[3], "UNSUBSCRIBE")
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	reply := resp.ErrorReply(resp.MakeReplyError("NOPERM", "no permission to subscribe to %q", "news"))
+	if reply != "-NOPERM no permission to subscribe to \"news\"\r\n" {
+		shouldBeThis(t, "NOPERM reply", "-NOPERM ...", reply)
+	}
+	reply = resp.ErrorReply(errors.New("failed"))
+	if reply != "-Error failed\r\n" {
+		shouldBeThis(t, "Error reply", "-Error failed", reply)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package seglog
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLogClosed      = errors.New("Log is closed")
+	ErrRecordTooLarge = errors.New("Message is larger than MaxRecordSize")
+	ErrIdTooLong      = errors.New("Message id is longer than 65535 bytes")
+	errorEmptyTopic   = errors.New("Empty topic")
+)
+
+type Options struct {
+	SegmentSize   int64         // Active segment of a topic is rolled once it holds SegmentSize bytes
+	RetentionSize int64         // Max bytes kept per topic, the oldest segments are removed beyond. 0 keeps everything
+	RetentionAge  time.Duration // Segments whose newest message is older are removed. 0 keeps everything
+	SyncWrites    bool          // Syncs the segment to disk after every append. Disabling trades durability for throughput
+}
+
+var DefaultOptions = Options{SegmentSize: 64 << 20, SyncWrites: true}
+
+// Message of a topic along with its offset in the topic
+type Record struct {
+	Offset  int64
+	Message *docid.Message
+}
+
+/*
+	Log is an append-only log of the messages of the topics, each in a directory of segment files named after the
+	hex encoded topic. Offsets of a topic start at 0 and increase with every message; retention removes whole
+	segments from the start and compaction drops duplicated messages, so the offsets may have gaps.
+	Subscribers keep the offset after the last message they processed and resume with Read from it.
+
+	Records are CRC checked. On open a record torn by a crash is truncated along with everything after it.
+	Log is thread-safe.
+*/
+type Log struct {
+	dir     string
+	options Options
+	topics  map[string]*topicLog
+	closed  bool
+	lock    sync.RWMutex //ReadWrite synchronization mutex
+}
+
+// Opens the log in dir, creating it if needed
+func MakeLog(dir string, options Options) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, options: options, topics: make(map[string]*topicLog)}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name, err := hex.DecodeString(info.Name())
+		if !info.IsDir() || err != nil {
+			continue
+		}
+		t, err := openTopic(filepath.Join(dir, info.Name()), string(name), &l.options)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.topics[t.name] = t
+	}
+	log.WithFields("seglog.log", "MakeLog", dir).Info(len(l.topics), " topics")
+	return l, nil
+}
+
+// Appends msgs to the topic. Returns the offset of the first one.
+// Nothing is appended if a message does not fit in a record, see checkRecord
+func (l *Log) Append(topic string, msgs ...*docid.Message) (int64, error) {
+	for _, msg := range msgs {
+		if err := checkRecord(msg); err != nil {
+			return 0, err
+		}
+	}
+	t, err := l.topic(topic, true)
+	if err != nil {
+		return 0, err
+	}
+	return t.append(msgs)
+}
+
+// Returns at most limit records of the topic from offset on, oldest first. Non positive limit returns all
+func (l *Log) Read(topic string, offset int64, limit int) ([]Record, error) {
+	t, err := l.topic(topic, false)
+	if t == nil {
+		return nil, err
+	}
+	return t.read(offset, limit)
+}
+
+// Returns the last count records of the topic, oldest first
+func (l *Log) Last(topic string, count int) ([]Record, error) {
+	t, err := l.topic(topic, false)
+	if t == nil {
+		return nil, err
+	}
+	return t.last(count)
+}
+
+// Returns the offset of the oldest record kept and the offset the next message will have
+func (l *Log) Offsets(topic string) (int64, int64) {
+	t, _ := l.topic(topic, false)
+	if t == nil {
+		return 0, 0
+	}
+	return t.offsets()
+}
+
+// Returns the topics of the log, sorted
+func (l *Log) Topics() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	topics := make([]string, 0, len(l.topics))
+	for topic := range l.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Removes the segments of every topic that are beyond the retention. Segments are checked on roll too.
+// Enforce is meant to be called periodically so that idle topics expire
+func (l *Log) Enforce() {
+	now := time.Now()
+	for _, topic := range l.Topics() {
+		if t, _ := l.topic(topic, false); t != nil {
+			t.lock.Lock()
+			t.enforce(now)
+			t.lock.Unlock()
+		}
+	}
+}
+
+// Compacts the closed segments of the topic, see topicLog.compact. Returns the count of records removed
+func (l *Log) Compact(topic string) (int, error) {
+	t, err := l.topic(topic, false)
+	if t == nil {
+		return 0, err
+	}
+	return t.compact()
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	var err error
+	for _, t := range l.topics {
+		if e := t.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Returns the log of the topic, opening it when create is set and it does not exist. Nil when unknown
+func (l *Log) topic(topic string, create bool) (*topicLog, error) {
+	l.lock.RLock()
+	t, closed := l.topics[topic], l.closed
+	l.lock.RUnlock()
+	if closed {
+		return nil, ErrLogClosed
+	}
+	if t != nil || !create {
+		return t, nil
+	}
+	if topic == "" {
+		return nil, errorEmptyTopic
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	if t = l.topics[topic]; t == nil {
+		var err error
+		if t, err = openTopic(filepath.Join(l.dir, hex.EncodeToString([]byte(topic))), topic, &l.options); err != nil {
+			return nil, err
+		}
+		l.topics[topic] = t
+	}
+	return t, nil
+}
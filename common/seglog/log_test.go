@@ -0,0 +1,230 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package seglog_test
+
+import (
+	"encoding/hex"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/seglog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var options = seglog.Options{SegmentSize: 4 << 10, SyncWrites: true}
+
+func openLog(t *testing.T, dir string, options seglog.Options) *seglog.Log {
+	l, err := seglog.MakeLog(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "seglog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Appends the messages first to first + count - 1, whose content is their number
+func appendMessages(t *testing.T, l *seglog.Log, topic string, first int, count int) {
+	for i := first; i < first+count; i++ {
+		msg := docid.MakeMessage(&docid.StrId{Id: topic}, []byte(strconv.Itoa(i)))
+		if _, err := l.Append(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Checks the offsets and contents of the records, space separated offset:content pairs
+func expectRecords(t *testing.T, records []seglog.Record, err error, expected string) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pairs []string
+	for _, record := range records {
+		pairs = append(pairs, strconv.FormatInt(record.Offset, 10)+":"+string(record.Message.Content))
+	}
+	if got := strings.Join(pairs, " "); got != expected {
+		t.Errorf("Expected records %.60q got %.60q", expected, got)
+	}
+}
+
+func segments(t *testing.T, dir string, topic string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, hex.EncodeToString([]byte(topic)), "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Subscribers resume from any offset, across segments and reopens
+func TestLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := openLog(t, dir, options)
+	appendMessages(t, l, "news", 0, 500)
+	appendMessages(t, l, "chat/room", 0, 3)
+	if len(segments(t, dir, "news")) < 3 {
+		t.Fatalf("Expected several segments got %v", segments(t, dir, "news"))
+	}
+	records, err := l.Read("news", 298, 3)
+	expectRecords(t, records, err, "298:298 299:299 300:300")
+	records, err = l.Read("news", 499, 0)
+	expectRecords(t, records, err, "499:499")
+	records, err = l.Last("chat/room", 5)
+	expectRecords(t, records, err, "0:0 1:1 2:2")
+	if records[0].Message.Source.DocId() != "chat/room" || records[0].Message.Timestamp == 0 {
+		t.Errorf("Expected the source and timestamp of the message got %v", records[0].Message)
+	}
+	l.Close()
+	if _, err = l.Append("news"); err != seglog.ErrLogClosed {
+		t.Errorf("Expected ErrLogClosed got %v", err)
+	}
+
+	l = openLog(t, dir, options)
+	defer l.Close()
+	if topics := strings.Join(l.Topics(), " "); topics != "chat/room news" {
+		t.Errorf("Expected the topics to be reopened got %s", topics)
+	}
+	appendMessages(t, l, "news", 500, 1)
+	records, err = l.Last("news", 2)
+	expectRecords(t, records, err, "499:499 500:500")
+	if first, next := l.Offsets("news"); first != 0 || next != 501 {
+		t.Errorf("Expected offsets 0 501 got %d %d", first, next)
+	}
+	records, err = l.Read("unknown", 0, 10)
+	expectRecords(t, records, err, "")
+}
+
+// Messages that do not fit in a record are refused before anything is written
+func TestLogLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := openLog(t, dir, options)
+	defer l.Close()
+	appendMessages(t, l, "news", 0, 1)
+	long := &docid.Message{StrId: docid.StrId{Id: strings.Repeat("i", 1<<16)}, Source: &docid.StrId{Id: "news"}, Content: []byte("1")}
+	if _, err := l.Append("news", docid.MakeMessage(&docid.StrId{Id: "news"}, []byte("1")), long); err != seglog.ErrIdTooLong {
+		t.Errorf("Expected ErrIdTooLong got %v", err)
+	}
+	large := &docid.Message{StrId: docid.StrId{Id: "large"}, Source: &docid.StrId{Id: "news"}, Content: make([]byte, seglog.MaxRecordSize)}
+	if _, err := l.Append("news", large); err != seglog.ErrRecordTooLarge {
+		t.Errorf("Expected ErrRecordTooLarge got %v", err)
+	}
+	if _, next := l.Offsets("news"); next != 1 {
+		t.Errorf("Expected nothing appended got next offset %d", next)
+	}
+}
+
+// A torn or corrupt record is truncated with everything after it, and so is a mismatching index
+func TestLogRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := openLog(t, dir, options)
+	appendMessages(t, l, "news", 0, 300)
+	l.Close()
+
+	files := segments(t, dir, "news")
+	active := files[len(files)-1]
+	info, _ := os.Stat(active)
+	os.Truncate(active, info.Size()-3) // Torn last record
+	closed := files[len(files)-2]
+	ioutil.WriteFile(strings.TrimSuffix(closed, ".log")+".index", []byte("garbage!"), 0644)
+
+	l = openLog(t, dir, options)
+	records, err := l.Last("news", 2)
+	expectRecords(t, records, err, "297:297 298:298")
+	records, err = l.Read("news", 0, 2)
+	expectRecords(t, records, err, "0:0 1:1")
+	appendMessages(t, l, "news", 299, 1)
+	l.Close()
+
+	data, _ := ioutil.ReadFile(active)
+	data[len(data)-1] ^= 0xff // Corrupt content of the last record
+	ioutil.WriteFile(active, data, 0644)
+	l = openLog(t, dir, options)
+	defer l.Close()
+	records, err = l.Read("news", 297, 0)
+	expectRecords(t, records, err, "297:297 298:298")
+}
+
+// The oldest segments are removed beyond the retention size and age, the active one is kept
+func TestLogRetention(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := openLog(t, dir, seglog.Options{SegmentSize: 4 << 10, RetentionSize: 12 << 10})
+	defer l.Close()
+	appendMessages(t, l, "news", 0, 2000)
+	first, next := l.Offsets("news")
+	if first == 0 || next != 2000 {
+		t.Errorf("Expected the oldest messages to be removed got offsets %d %d", first, next)
+	}
+	if files := segments(t, dir, "news"); len(files) > 4 {
+		t.Errorf("Expected at most 4 segments got %d", len(files))
+	}
+	records, err := l.Read("news", 0, 1)
+	expectRecords(t, records, err, strconv.FormatInt(first, 10)+":"+strconv.FormatInt(first, 10))
+
+	agedDir := tempDir(t)
+	defer os.RemoveAll(agedDir)
+	aged := openLog(t, agedDir, seglog.Options{SegmentSize: 1 << 10, RetentionAge: time.Hour})
+	defer aged.Close()
+	for i := 0; i < 100; i++ {
+		msg := docid.MakeMessage(&docid.StrId{Id: "news"}, []byte(strconv.Itoa(i)))
+		if i < 50 {
+			msg.Timestamp -= 2 * 3600
+		}
+		aged.Append("news", msg)
+	}
+	aged.Enforce()
+	records, err = aged.Read("news", 0, 1)
+	if err != nil || len(records) != 1 || records[0].Offset > 50 || records[0].Offset < 30 {
+		t.Errorf("Expected the messages older than an hour to be removed got %v %v", records, err)
+	}
+}
+
+// Compaction keeps the latest copy of every message at its offset, and survives a reopen
+func TestLogCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l := openLog(t, dir, options)
+	appendMessages(t, l, "news", 0, 100)
+	appendMessages(t, l, "news", 0, 100)    // Delivered again at offsets 100 to 199
+	appendMessages(t, l, "news", 1000, 100) // Offsets 200 to 299, the active segment starts after them
+	before := len(segments(t, dir, "news"))
+	removed, err := l.Compact("news")
+	if err != nil || removed != 100 {
+		t.Fatalf("Expected 100 records removed got %d %v", removed, err)
+	}
+	if after := len(segments(t, dir, "news")); after >= before {
+		t.Errorf("Expected segments to be merged, %d before %d after", before, after)
+	}
+	records, err := l.Read("news", 50, 2)
+	expectRecords(t, records, err, "100:0 101:1")
+	l.Close()
+	leftover := filepath.Join(dir, hex.EncodeToString([]byte("news")), "00000000000000000100.log.compact")
+	ioutil.WriteFile(leftover, []byte("torn"), 0644)
+
+	l = openLog(t, dir, options)
+	defer l.Close()
+	records, err = l.Read("news", 0, 0)
+	if err != nil || len(records) != 200 || records[0].Offset != 100 || records[199].Offset != 299 {
+		t.Fatalf("Expected offsets 100 to 299 got %d records %v", len(records), err)
+	}
+	appendMessages(t, l, "news", 300, 1)
+	records, err = l.Last("news", 2)
+	expectRecords(t, records, err, "299:1099 300:300")
+	if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Expected compaction leftovers to be removed got %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package seglog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	IndexInterval = int64(4 << 10) // Bytes of records between two entries of the sparse index
+	MaxRecordSize = 64 << 20       // Max size of a record. Larger sizes are taken for corruption
+)
+
+var (
+	errorCorrupt = errors.New("Corrupt record")
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	headerSize     = 8  // Payload length and CRC
+	indexEntrySize = 8  // Offset relative to the segment base and position
+	fixedSize      = 18 // Offset, timestamp and id length of a payload
+	maxIdLength    = 1<<16 - 1
+)
+
+/*
+	Segment of the log of a topic. Records are framed as
+		length uint32 | crc uint32 | offset int64 | timestamp int64 | id-length uint16 | id | content
+	in big endian, the CRC-32C covering everything after it. Offsets increase within and across segments.
+
+	The sparse index maps every IndexInterval bytes of records the relative offset of a record to its position,
+	as pairs of uint32. Files are named with the offset of the first record, e.g. 00000000000000001000.log
+	and 00000000000000001000.index. A segment being compacted has the suffix .compact until it replaces the old ones.
+*/
+type segment struct {
+	dir       string
+	suffix    string
+	base      int64 // Offset of the first record, or of the next one while empty
+	next      int64 // Offset after the last record
+	newest    int64 // Timestamp of the newest message
+	file      *os.File
+	size      int64
+	index     []indexEntry
+	indexFile *os.File
+	indexed   int64 // Position of the last index entry
+}
+
+type indexEntry struct {
+	offset   int64
+	position int64
+}
+
+type record struct {
+	offset  int64
+	message *docid.Message
+	size    int64 // Framed size
+}
+
+func segmentName(dir string, base int64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, ext))
+}
+
+func (s *segment) name(ext string) string {
+	return segmentName(s.dir, s.base, ext+s.suffix)
+}
+
+// Creates an empty segment whose first record will have the offset base
+func createSegment(dir string, base int64, suffix string) (*segment, error) {
+	s := &segment{dir: dir, suffix: suffix, base: base, next: base, indexed: -1}
+	var err error
+	if s.file, err = os.OpenFile(s.name(".log"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); err != nil {
+		return nil, err
+	}
+	if s.indexFile, err = os.OpenFile(s.name(".index"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Opens the segment. The records after the last index entry are scanned to find the end of the segment,
+// the whole segment is scanned and its index rebuilt if the index does not match the records.
+// A torn or corrupt record ends the segment, it is truncated along with everything after it
+func openSegment(dir string, base int64) (*segment, error) {
+	s := &segment{dir: dir, base: base, next: base, indexed: -1}
+	var err error
+	if s.file, err = os.OpenFile(s.name(".log"), os.O_RDWR, 0644); err != nil {
+		return nil, err
+	}
+	if s.indexFile, err = os.OpenFile(s.name(".index"), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	if err = s.recover(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) recover() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+	from, last := int64(0), int64(-1)
+	valid := s.loadIndex() == nil
+	if valid && len(s.index) > 0 {
+		from, last = s.index[len(s.index)-1].position, s.index[len(s.index)-1].offset
+		s.indexed = from
+	}
+	end, err := s.scan(from, func(position int64, rec *record) bool {
+		return position != from || last < 0 || rec.offset == last // Last index entry must point to its record
+	})
+	if err == errorIndexMismatch || from > 0 && end == from {
+		valid = false
+		s.index, s.indexed, s.next, s.newest = nil, -1, s.base, 0
+		end, _ = s.scan(0, func(int64, *record) bool { return true })
+	}
+	if !valid {
+		if err = s.writeIndex(); err != nil {
+			return err
+		}
+	}
+	if end < s.size {
+		if err = s.file.Truncate(end); err != nil {
+			return err
+		}
+		s.size = end
+	}
+	return nil
+}
+
+var errorIndexMismatch = errors.New("Index mismatch")
+
+// Reads the records from position on, indexing them and tracking the end of the segment.
+// Returns the position after the last valid record
+func (s *segment) scan(from int64, visit func(position int64, rec *record) bool) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, from, s.size-from))
+	position := from
+	for {
+		rec, err := readRecord(reader)
+		if err != nil {
+			return position, nil // End of the segment, or a torn record to truncate
+		}
+		if !visit(position, rec) {
+			return position, errorIndexMismatch
+		}
+		if rec.offset < s.next {
+			return position, nil // Offsets must increase, the rest is garbage
+		}
+		s.track(position, rec)
+		position += rec.size
+	}
+}
+
+// Updates the end of the segment with the record at position and indexes it if due
+func (s *segment) track(position int64, rec *record) {
+	if s.indexed < 0 || position-s.indexed >= IndexInterval {
+		s.index = append(s.index, indexEntry{offset: rec.offset, position: position})
+		s.indexed = position
+	}
+	s.next = rec.offset + 1
+	if rec.message.Timestamp > s.newest {
+		s.newest = rec.message.Timestamp
+	}
+}
+
+// Loads the index file. Entries must be within the segment and increase
+func (s *segment) loadIndex() error {
+	info, err := s.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size()%indexEntrySize != 0 {
+		return errorCorrupt
+	}
+	buffer := make([]byte, info.Size())
+	if _, err = s.indexFile.ReadAt(buffer, 0); err != nil && err != io.EOF {
+		return err
+	}
+	for i := 0; i < len(buffer); i += indexEntrySize {
+		entry := indexEntry{
+			offset:   s.base + int64(binary.BigEndian.Uint32(buffer[i:])),
+			position: int64(binary.BigEndian.Uint32(buffer[i+4:])),
+		}
+		if entry.position >= s.size || len(s.index) > 0 && (entry.position <= s.index[len(s.index)-1].position ||
+			entry.offset <= s.index[len(s.index)-1].offset) {
+			s.index = nil
+			return errorCorrupt
+		}
+		s.index = append(s.index, entry)
+	}
+	return nil
+}
+
+// Rewrites the index file from the index
+func (s *segment) writeIndex() error {
+	buffer := make([]byte, 0, len(s.index)*indexEntrySize)
+	for _, entry := range s.index {
+		buffer = appendIndexEntry(buffer, s.base, entry)
+	}
+	if err := s.indexFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := s.indexFile.WriteAt(buffer, 0)
+	return err
+}
+
+func appendIndexEntry(buffer []byte, base int64, entry indexEntry) []byte {
+	var b [indexEntrySize]byte
+	binary.BigEndian.PutUint32(b[:], uint32(entry.offset-base))
+	binary.BigEndian.PutUint32(b[4:], uint32(entry.position))
+	return append(buffer, b[:]...)
+}
+
+// Appends the records, whose offsets must increase from next on. Nothing is appended on error
+func (s *segment) append(records []*record, sync bool) error {
+	next, newest, indexed, entries := s.next, s.newest, s.indexed, len(s.index)
+	var buffer []byte
+	position := s.size
+	for _, rec := range records {
+		framed := encodeRecord(rec.offset, rec.message)
+		s.track(position, rec)
+		buffer = append(buffer, framed...)
+		position += int64(len(framed))
+	}
+	var added []byte
+	for _, entry := range s.index[entries:] {
+		added = appendIndexEntry(added, s.base, entry)
+	}
+	_, err := s.file.WriteAt(buffer, s.size)
+	if err == nil && len(added) > 0 {
+		_, err = s.indexFile.WriteAt(added, int64(entries*indexEntrySize))
+	}
+	if err == nil && sync {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.size) // Later records must not follow a partial one
+		s.indexFile.Truncate(int64(entries * indexEntrySize))
+		s.next, s.newest, s.indexed, s.index = next, newest, indexed, s.index[:entries]
+		return err
+	}
+	s.size = position
+	return nil
+}
+
+// Reads the records from offset on, until visit returns false
+func (s *segment) read(offset int64, visit func(rec *record) bool) error {
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].offset > offset
+	})
+	from := int64(0)
+	if i > 0 {
+		from = s.index[i-1].position
+	}
+	reader := bufio.NewReader(io.NewSectionReader(s.file, from, s.size-from))
+	for position := from; position < s.size; {
+		rec, err := readRecord(reader)
+		if err != nil {
+			return fmt.Errorf("%s at %d: %v", s.name(".log"), position, err)
+		}
+		position += rec.size
+		if rec.offset >= offset && !visit(rec) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *segment) close() error {
+	err := s.file.Close()
+	if e := s.indexFile.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Flushes the records and the index to disk
+func (s *segment) sync() error {
+	err := s.file.Sync()
+	if e := s.indexFile.Sync(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Closes and deletes the files of the segment
+func (s *segment) remove() error {
+	s.close()
+	err := os.Remove(s.name(".log"))
+	if e := os.Remove(s.name(".index")); err == nil && e != nil && !os.IsNotExist(e) {
+		err = e
+	}
+	return err
+}
+
+// Checks that the id length fits its uint16 field and the record is not taken for corruption when read
+func checkRecord(msg *docid.Message) error {
+	if len(msg.Id) > maxIdLength {
+		return ErrIdTooLong
+	}
+	if fixedSize+len(msg.Id)+len(msg.Content) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+	return nil
+}
+
+func encodeRecord(offset int64, msg *docid.Message) []byte {
+	size := headerSize + fixedSize + len(msg.Id) + len(msg.Content)
+	buffer := make([]byte, size)
+	binary.BigEndian.PutUint32(buffer, uint32(size-headerSize))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(offset))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(msg.Timestamp))
+	binary.BigEndian.PutUint16(buffer[24:], uint16(len(msg.Id)))
+	copy(buffer[26:], msg.Id)
+	copy(buffer[26+len(msg.Id):], msg.Content)
+	binary.BigEndian.PutUint32(buffer[4:], crc32.Checksum(buffer[8:], crcTable))
+	return buffer
+}
+
+// Reads and verifies the next record. Returns io.EOF at the end of the records and errorCorrupt
+// for a record that is torn or does not match its CRC
+func readRecord(reader *bufio.Reader) (*record, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errorCorrupt
+	}
+	length := int(binary.BigEndian.Uint32(header[:]))
+	if length < fixedSize || length > MaxRecordSize {
+		return nil, errorCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errorCorrupt
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errorCorrupt
+	}
+	idLength := int(binary.BigEndian.Uint16(payload[16:]))
+	if fixedSize+idLength > length {
+		return nil, errorCorrupt
+	}
+	return &record{
+		offset: int64(binary.BigEndian.Uint64(payload)),
+		message: &docid.Message{
+			StrId:     docid.StrId{Id: string(payload[fixedSize : fixedSize+idLength])},
+			Timestamp: int64(binary.BigEndian.Uint64(payload[8:])),
+			Content:   payload[fixedSize+idLength:],
+		},
+		size: int64(headerSize + length),
+	}, nil
+}
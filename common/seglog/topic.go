@@ -0,0 +1,312 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package seglog
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log of a topic, in its own directory
+type topicLog struct {
+	name     string
+	dir      string
+	options  *Options
+	segments []*segment   // Oldest first, the last one is active
+	lock     sync.RWMutex //ReadWrite synchronization mutex
+}
+
+// Opens the segments in dir, creating the first one if there is none. Leftovers of an interrupted compaction
+// are removed: the files still suffixed .compact, and the old segments overlapping the compacted one replacing them
+func openTopic(dir string, name string, options *Options) (*topicLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &topicLog{name: name, dir: dir, options: options}
+	bases, err := segmentBases(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, base := range bases {
+		seg, err := openSegment(dir, base)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		if len(t.segments) > 0 && seg.base < t.segments[len(t.segments)-1].next {
+			log.WithFields("seglog.topic", "openTopic", name).Info("Removing compacted segment ", base)
+			seg.remove()
+			continue
+		}
+		t.segments = append(t.segments, seg)
+	}
+	if len(t.segments) == 0 {
+		seg, err := createSegment(dir, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		t.segments = append(t.segments, seg)
+	}
+	return t, nil
+}
+
+func (t *topicLog) append(msgs []*docid.Message) (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	active := t.segments[len(t.segments)-1]
+	if active.size > 0 && active.size >= t.options.SegmentSize {
+		if err := t.roll(); err != nil {
+			return 0, err
+		}
+		active = t.segments[len(t.segments)-1]
+	}
+	first := active.next
+	records := make([]*record, 0, len(msgs))
+	for i, msg := range msgs {
+		records = append(records, &record{offset: first + int64(i), message: msg})
+	}
+	return first, active.append(records, t.options.SyncWrites)
+}
+
+// Starts a new active segment and enforces the retention. Must be called holding the write lock
+func (t *topicLog) roll() error {
+	active := t.segments[len(t.segments)-1]
+	seg, err := createSegment(t.dir, active.next, "")
+	if err != nil {
+		return err
+	}
+	if err = active.sync(); err != nil {
+		seg.remove()
+		return err
+	}
+	t.segments = append(t.segments, seg)
+	t.enforce(time.Now())
+	return nil
+}
+
+// Returns the records from offset on, at most limit of them when positive
+func (t *topicLog) read(offset int64, limit int) ([]Record, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var records []Record
+	i := sort.Search(len(t.segments), func(i int) bool {
+		return t.segments[i].next > offset
+	})
+	for ; i < len(t.segments); i++ {
+		err := t.segments[i].read(offset, func(rec *record) bool {
+			records = append(records, t.record(rec))
+			return limit <= 0 || len(records) < limit
+		})
+		if err != nil {
+			return records, err
+		}
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// Returns the last count records, all of them when count is not positive
+func (t *topicLog) last(count int) ([]Record, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var records []Record
+	for i := len(t.segments) - 1; i >= 0 && (count <= 0 || len(records) < count); i-- {
+		var segRecords []Record
+		err := t.segments[i].read(t.segments[i].base, func(rec *record) bool {
+			segRecords = append(segRecords, t.record(rec))
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		records = append(segRecords, records...)
+	}
+	if count > 0 && len(records) > count {
+		records = records[len(records)-count:]
+	}
+	return records, nil
+}
+
+func (t *topicLog) record(rec *record) Record {
+	rec.message.Source = &docid.StrId{Id: t.name}
+	return Record{Offset: rec.offset, Message: rec.message}
+}
+
+func (t *topicLog) offsets() (int64, int64) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.segments[0].base, t.segments[len(t.segments)-1].next
+}
+
+// Removes the oldest segments beyond RetentionSize or whose newest message is older than RetentionAge.
+// The active segment is always kept. Must be called holding the write lock
+func (t *topicLog) enforce(now time.Time) {
+	var size int64
+	for _, seg := range t.segments {
+		size += seg.size
+	}
+	expired := now.Add(-t.options.RetentionAge).Unix()
+	for len(t.segments) > 1 {
+		oldest := t.segments[0]
+		if !(t.options.RetentionSize > 0 && size > t.options.RetentionSize ||
+			t.options.RetentionAge > 0 && oldest.newest < expired) {
+			return
+		}
+		if err := oldest.remove(); err != nil {
+			log.WithFields("seglog.topic", "enforce", t.name).Error(err)
+		}
+		size -= oldest.size
+		t.segments = t.segments[1:]
+	}
+}
+
+/*
+	Rewrites the closed segments keeping only the latest record of each message id, so that the messages delivered
+	more than once are stored once. Ids must identify a publish, not its content, see docid.MakeUniqueMessage. Offsets are preserved, leaving gaps where records are dropped. Consecutive
+	segments are merged up to SegmentSize.
+
+	Every group of merged segments is written to new files suffixed .compact, named after the first segment of the
+	group. Once synced, they replace the files of that first segment and the other segments of the group are removed.
+	A crash in between leaves segments overlapping the compacted one, which are removed on open.
+	Appends and reads wait for the compaction.
+*/
+func (t *topicLog) compact() (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	latest := make(map[string]int64)
+	for _, seg := range t.segments {
+		err := seg.read(seg.base, func(rec *record) bool {
+			latest[rec.message.Id] = rec.offset
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	closed := t.segments[:len(t.segments)-1]
+	compacted := make([]*segment, 0, len(t.segments))
+	removed := 0
+	var group []*segment
+	var out *segment
+	for i, seg := range closed {
+		if out == nil {
+			var err error
+			if out, err = createSegment(t.dir, seg.base, ".compact"); err != nil {
+				return removed, err
+			}
+		}
+		group = append(group, seg)
+		var kept []*record
+		err := seg.read(seg.base, func(rec *record) bool {
+			if latest[rec.message.Id] == rec.offset {
+				kept = append(kept, rec)
+			} else {
+				removed++
+			}
+			return true
+		})
+		if err == nil {
+			err = out.append(kept, false)
+		}
+		if err != nil {
+			out.remove()
+			t.segments = append(compacted, t.segments[i-len(group)+1:]...)
+			return removed, err
+		}
+		if i == len(closed)-1 || out.size >= t.options.SegmentSize {
+			if out, err = t.replace(out, group); err != nil {
+				t.segments = append(compacted, t.segments[i-len(group)+1:]...)
+				return removed, err
+			}
+			if out != nil {
+				compacted = append(compacted, out)
+			}
+			out, group = nil, nil
+		}
+	}
+	t.segments = append(compacted, t.segments[len(t.segments)-1])
+	return removed, nil
+}
+
+// Replaces the group of segments with the compacted one. Returns the compacted segment, or nil when it is empty
+func (t *topicLog) replace(out *segment, group []*segment) (*segment, error) {
+	if out.next == out.base {
+		out.remove()
+		for _, seg := range group {
+			if err := seg.remove(); err != nil {
+				log.WithFields("seglog.topic", "replace", t.name).Error(err)
+			}
+		}
+		return nil, nil
+	}
+	if err := out.sync(); err != nil {
+		out.remove()
+		return nil, err
+	}
+	first := group[0]
+	first.close()
+	os.Remove(first.name(".index")) // Rebuilt on open if the log is replaced but not its index
+	if err := os.Rename(out.name(".log"), first.name(".log")); err != nil {
+		out.remove()
+		if reopened, e := openSegment(t.dir, first.base); e == nil {
+			*first = *reopened // Still listed in the segments of the topic
+		}
+		return nil, err
+	}
+	os.Rename(out.name(".index"), first.name(".index"))
+	out.suffix = ""
+	for _, seg := range group[1:] {
+		if err := seg.remove(); err != nil {
+			log.WithFields("seglog.topic", "replace", t.name).Error(err)
+		}
+	}
+	return out, nil
+}
+
+func (t *topicLog) close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var err error
+	for _, seg := range t.segments {
+		if e := seg.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Base offsets of the segments in dir, sorted. Files left by an interrupted compaction are removed
+func segmentBases(dir string) ([]int64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bases []int64
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, ".compact") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if info.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		if base, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64); err == nil && base >= 0 {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
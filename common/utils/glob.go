@@ -0,0 +1,121 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package utils
+
+var (
+	MaxGlobLength = 256 // Longest pattern accepted by ValidGlob
+	MaxGlobStars  = 16  // Most * a pattern accepted by ValidGlob can have
+)
+
+/*
+	Redis style glob matching used by pattern subscriptions
+
+	h?llo matches hello, hallo and hxllo
+	h*llo matches hllo and heeeello
+	h[ae]llo matches hello and hallo, but not hillo
+	h[^e]llo matches hallo, hbllo, ... but not hello
+	h[a-b]llo matches hallo and hbllo
+
+	Use \ to escape special characters
+
+	Matching is iterative and only backtracks to the last *, as every other token matches exactly one character,
+	hence it takes at most len(pattern) * len(subject) steps and is linear in practice.
+*/
+func GlobMatch(pattern string, subject string) bool {
+	p, s := 0, 0
+	star, starSubject := -1, 0 // Position of the last * in pattern and of the subject it matched up to
+	for s < len(subject) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starSubject = p, s
+				p++
+				continue
+			}
+			if next, ok := matchToken(pattern, p, subject[s]); ok {
+				p, s = next, s+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Backtracks to the last *, letting it match one more character
+		starSubject++
+		p, s = star+1, starSubject
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Checks that pattern is short enough and has few enough * to be matched against every published topic
+func ValidGlob(pattern string) bool {
+	if len(pattern) > MaxGlobLength {
+		return false
+	}
+	stars := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*':
+			stars++
+		}
+	}
+	return stars <= MaxGlobStars
+}
+
+// Matches c against the token of the pattern at p, other than *.
+// Returns the position of the next token and whether c matches
+func matchToken(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		end, ok := matchClass(pattern, p+1, c)
+		return end + 1, ok
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, pattern[p] == c
+}
+
+// Matches c against the character class starting at pattern[p] (right after '[').
+// Returns the index of the closing ']' and whether c belongs to the class.
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	not := p < len(pattern) && pattern[p] == '^'
+	if not {
+		p++
+	}
+	match := false
+	for ; p < len(pattern) && pattern[p] != ']'; p++ {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if pattern[p] == c {
+				match = true
+			}
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				match = true
+			}
+			p += 2
+		case pattern[p] == c:
+			match = true
+		}
+	}
+	if p == len(pattern) {
+		// Unterminated class is matched till the end of the pattern
+		p--
+	}
+	return p, match != not
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package utils_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testGlob(t *testing.T, pattern string, subject string, expected bool) {
+	if utils.GlobMatch(pattern, subject) != expected {
+		t.Errorf("Expected %q matching %q to be %v", pattern, subject, expected)
+	}
+}
+
+func TestGlobLiteral(t *testing.T) {
+	testGlob(t, "org.42.room", "org.42.room", true)
+	testGlob(t, "org.42.room", "org.42.rooms", false)
+	testGlob(t, "", "", true)
+	testGlob(t, "", "a", false)
+}
+
+func TestGlobStar(t *testing.T) {
+	testGlob(t, "org.42.room.*", "org.42.room.1", true)
+	testGlob(t, "org.42.room.*", "org.42.room.", true)
+	testGlob(t, "org.42.room.*", "org.42.room.1.members", true)
+	testGlob(t, "org.42.room.*", "org.43.room.1", false)
+	testGlob(t, "org.*.room.*", "org.42.room.1", true)
+	testGlob(t, "h*llo", "hllo", true)
+	testGlob(t, "h*llo", "heeeello", true)
+	testGlob(t, "h**llo", "hello", true)
+	testGlob(t, "*", "", true)
+}
+
+func TestGlobQuestionMark(t *testing.T) {
+	testGlob(t, "h?llo", "hello", true)
+	testGlob(t, "h?llo", "hllo", false)
+	testGlob(t, "org.4?", "org.42", true)
+}
+
+func TestGlobClass(t *testing.T) {
+	testGlob(t, "h[ae]llo", "hello", true)
+	testGlob(t, "h[ae]llo", "hallo", true)
+	testGlob(t, "h[ae]llo", "hillo", false)
+	testGlob(t, "h[^e]llo", "hallo", true)
+	testGlob(t, "h[^e]llo", "hello", false)
+	testGlob(t, "h[a-b]llo", "hbllo", true)
+	testGlob(t, "h[a-b]llo", "hcllo", false)
+	testGlob(t, "room.[0-9]", "room.7", true)
+}
+
+func TestGlobEscape(t *testing.T) {
+	testGlob(t, "room.\\*", "room.*", true)
+	testGlob(t, "room.\\*", "room.1", false)
+	testGlob(t, "h\\?llo", "h?llo", true)
+	testGlob(t, "h\\?llo", "hello", false)
+}
+
+// Patterns with many * must not backtrack exponentially
+func TestGlobWorstCase(t *testing.T) {
+	start := time.Now()
+	testGlob(t, strings.Repeat("*a", 12)+"*b", strings.Repeat("a", 40), false)
+	testGlob(t, strings.Repeat("*a", 16), strings.Repeat("a", 4096), true)
+	testGlob(t, strings.Repeat("*?", 16)+"b", strings.Repeat("a", 4096), false)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected worst case matching to be fast, took %v", elapsed)
+	}
+	testGlob(t, "*a*b*c", "xaybzc", true)
+	testGlob(t, "*a*b*c", "xaybz", false)
+	testGlob(t, "a*[0-9]", "abc1", true)
+	testGlob(t, "*\\**", "a*b", true)
+	testGlob(t, "*\\*", "a*b", false)
+}
+
+func TestValidGlob(t *testing.T) {
+	if !utils.ValidGlob("org.*.room.*") || !utils.ValidGlob(strings.Repeat("\\*", 64)) {
+		t.Error("Expected short patterns with few * to be valid")
+	}
+	if utils.ValidGlob(strings.Repeat("*a", 17)) {
+		t.Error("Expected patterns with too many * to be invalid")
+	}
+	if utils.ValidGlob(strings.Repeat("a", utils.MaxGlobLength+1)) {
+		t.Error("Expected too long patterns to be invalid")
+	}
+}
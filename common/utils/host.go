@@ -0,0 +1,88 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package utils
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+/*
+	Host allow-list matching
+
+	*                 matches any host
+	example.com       matches example.com on any port
+	example.com:8765  matches example.com on port 8765 only
+	*.example.com     matches the subdomains of example.com e.g. ws.example.com, a.ws.example.com but not example.com
+
+	Matching is case insensitive
+*/
+func HostMatch(pattern string, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(pattern); err != nil {
+		host = stripPort(host)
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
+
+/*
+	Origin allow-list matching. Patterns are host patterns optionally prefixed with a scheme
+
+	*.example.com          matches http://app.example.com and https://app.example.com
+	https://*.example.com  matches https://app.example.com only
+*/
+func OriginMatch(pattern string, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil || originUrl.Host == "" {
+		return false
+	}
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], originUrl.Scheme) {
+			return false
+		}
+		pattern = pattern[i+3:]
+	}
+	return HostMatch(pattern, originUrl.Host)
+}
+
+// Returns true if the host matches any of the patterns. Empty patterns allows every host
+func HostAllowed(patterns []string, host string) bool {
+	return allowed(patterns, host, HostMatch)
+}
+
+// Returns true if the origin matches any of the patterns. Empty patterns allows every origin
+func OriginAllowed(patterns []string, origin string) bool {
+	return allowed(patterns, origin, OriginMatch)
+}
+
+func allowed(patterns []string, value string, match func(string, string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
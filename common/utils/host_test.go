@@ -0,0 +1,58 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package utils_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/utils"
+	"testing"
+)
+
+func TestHostMatch(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{"*", "anything:80", true},
+		{"example.com", "example.com", true},
+		{"example.com", "Example.COM:8765", true},
+		{"example.com", "evil-example.com", false},
+		{"example.com:8765", "example.com:8765", true},
+		{"example.com:8765", "example.com:80", false},
+		{"*.example.com", "ws.example.com", true},
+		{"*.example.com", "a.ws.example.com:443", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"[::1]:8765", "[::1]:8765", true},
+	}
+	for _, c := range cases {
+		if utils.HostMatch(c.pattern, c.host) != c.expected {
+			t.Errorf("HostMatch(%q, %q) should be %v", c.pattern, c.host, c.expected)
+		}
+	}
+}
+
+func TestOriginMatch(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		origin   string
+		expected bool
+	}{
+		{"*.example.com", "https://app.example.com", true},
+		{"*.example.com", "http://app.example.com:8080", true},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"https://example.com", "https://example.com", true},
+		{"example.com", "https://example.com.evil.org", false},
+		{"example.com", "null", false},
+	}
+	for _, c := range cases {
+		if utils.OriginMatch(c.pattern, c.origin) != c.expected {
+			t.Errorf("OriginMatch(%q, %q) should be %v", c.pattern, c.origin, c.expected)
+		}
+	}
+	if !utils.OriginAllowed(nil, "https://any.org") || utils.OriginAllowed([]string{"example.com"}, "https://any.org") {
+		t.Error("OriginAllowed failed")
+	}
+}
@@ -9,20 +9,37 @@ import (
 	"github.com/pigeond-io/pigeond/common/log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
+var (
+	exitClosures []func() // Closures run on SIGINT or SIGTERM, see OnProcessExit
+	exitLock     sync.Mutex
+)
+
 func InitProcess(processName string, initClosure func(string)) {
 	initClosure(fmt.Sprintf("%s-%d", processName, os.Getpid()))
 }
 
+// Runs the closure on SIGINT or SIGTERM before the process exits.
+// Closures run one after the other in the reverse order of their registration
 func OnProcessExit(exitClosure func()) {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	exitClosures = append(exitClosures, exitClosure)
+	if len(exitClosures) > 1 {
+		return
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
 		log.Debug("Exiting...")
-		exitClosure()
+		exitLock.Lock()
+		for i := len(exitClosures) - 1; i >= 0; i-- {
+			exitClosures[i]()
+		}
 		os.Exit(0)
 	}()
 }
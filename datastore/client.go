@@ -0,0 +1,207 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	DialTimeout    = 5 * time.Second  // Max wait for a connection to the data store
+	RequestTimeout = 10 * time.Second // Max wait for the reply to a request
+)
+
+var (
+	errorUnexpectedReply = errors.New("Unexpected reply")
+)
+
+/*
+	Client is the Store of a remote data store, see DataStoreServer for the protocol.
+	Requests are sent one at a time on a single connection, which is dialed again after a failure.
+	Appended messages are given their timestamp by the data store, and a unique id when they have none.
+*/
+type Client struct {
+	address string
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	closed  bool
+	lock    sync.Mutex // Synchronizes the connection and the requests
+}
+
+// Makes a client of the data store at address. It connects on the first request
+func MakeClient(address string) *Client {
+	return &Client{address: address}
+}
+
+func (c *Client) Append(topic string, msgs ...*docid.Message) (int64, error) {
+	args := make([]string, 0, 2*len(msgs)+2)
+	args = append(args, "APPEND", topic)
+	for _, msg := range msgs {
+		args = append(args, msg.Id, string(msg.Content))
+	}
+	reply, err := c.request(args...)
+	if err != nil {
+		return 0, err
+	}
+	if reply.Type != resp.Int {
+		return 0, errorUnexpectedReply
+	}
+	return reply.Int, nil
+}
+
+func (c *Client) Read(topic string, offset int64, limit int) ([]Record, error) {
+	reply, err := c.request("READ", topic, strconv.FormatInt(offset, 10), strconv.Itoa(limit))
+	return decodeRecords(topic, reply, err)
+}
+
+func (c *Client) Last(topic string, count int) ([]Record, error) {
+	reply, err := c.request("LAST", topic, strconv.Itoa(count))
+	return decodeRecords(topic, reply, err)
+}
+
+func (c *Client) SaveSubscriptions(session string, subs Subscriptions) error {
+	args := []string{"SAVESUBSCRIPTIONS", session, strconv.Itoa(len(subs.Topics))}
+	args = append(args, subs.Topics...)
+	args = append(args, subs.Patterns...)
+	_, err := c.request(args...)
+	return err
+}
+
+func (c *Client) Subscriptions(session string) (Subscriptions, error) {
+	var subs Subscriptions
+	reply, err := c.request("SUBSCRIPTIONS", session)
+	if err != nil {
+		return subs, err
+	}
+	if reply.Type != resp.Array || len(reply.Elems) != 2 {
+		return subs, errorUnexpectedReply
+	}
+	for _, topic := range reply.Elems[0].Elems {
+		subs.Topics = append(subs.Topics, string(topic.Str))
+	}
+	for _, pattern := range reply.Elems[1].Elems {
+		subs.Patterns = append(subs.Patterns, string(pattern.Str))
+	}
+	return subs, nil
+}
+
+func (c *Client) SavePresence(topic string, users map[string]int) error {
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	args := []string{"SAVEPRESENCE", topic}
+	for _, user := range names {
+		args = append(args, user, strconv.Itoa(users[user]))
+	}
+	_, err := c.request(args...)
+	return err
+}
+
+func (c *Client) Presence(topic string) (map[string]int, error) {
+	reply, err := c.request("PRESENCE", topic)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != resp.Array || len(reply.Elems)%2 != 0 {
+		return nil, errorUnexpectedReply
+	}
+	users := make(map[string]int, len(reply.Elems)/2)
+	for i := 0; i < len(reply.Elems); i += 2 {
+		users[string(reply.Elems[i].Str)] = int(reply.Elems[i+1].Int)
+	}
+	return users, nil
+}
+
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return c.disconnect()
+}
+
+// Sends the command and reads its reply. Error replies are returned as errors
+func (c *Client) request(args ...string) (*resp.Value, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrStoreClosed
+	}
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+		c.writer = bufio.NewWriter(conn)
+	}
+	c.conn.SetDeadline(time.Now().Add(RequestTimeout))
+	reply, err := c.exchange(args)
+	if err != nil {
+		c.disconnect()
+		return nil, err
+	}
+	if reply.Type == resp.Err {
+		return nil, errors.New(string(reply.Str))
+	}
+	return reply, nil
+}
+
+func (c *Client) exchange(args []string) (*resp.Value, error) {
+	if err := resp.MakeWriter(c.writer).WriteStrings(args...).Err(); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return resp.ReadValue(c.reader)
+}
+
+func (c *Client) disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Decodes the records replied by READ and LAST
+func decodeRecords(topic string, reply *resp.Value, err error) ([]Record, error) {
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != resp.Array {
+		return nil, errorUnexpectedReply
+	}
+	source := &docid.StrId{Id: topic}
+	records := make([]Record, 0, len(reply.Elems))
+	for _, elem := range reply.Elems {
+		if elem.Type != resp.Array || len(elem.Elems) != 4 {
+			return nil, errorUnexpectedReply
+		}
+		records = append(records, Record{
+			Offset: elem.Elems[0].Int,
+			Message: &docid.Message{
+				StrId:     docid.StrId{Id: string(elem.Elems[1].Str)},
+				Source:    source,
+				Content:   elem.Elems[3].Str,
+				Timestamp: elem.Elems[2].Int,
+			},
+		})
+	}
+	return records, nil
+}
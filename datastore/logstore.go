@@ -0,0 +1,442 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/common/seglog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SegmentSize       = int64(64 << 20)  // Active segment is rolled once it holds SegmentSize bytes
+	SyncWrites        = true             // Syncs the segment to disk after every write. Disabling trades durability for throughput
+	RetentionSize     = int64(0)         // Max bytes of messages kept per topic. 0 keeps everything
+	RetentionAge      = time.Duration(0) // Max age of the messages kept. 0 keeps everything
+	RetentionInterval = time.Minute      // Interval between two checks of the retention
+	CompactInterval   = time.Hour        // Interval between two compactions of the topics. 0 disables the compaction
+)
+
+// Segment file of the journal
+type segment struct {
+	seq  int // Sequence number of the segment, in its file name
+	file *os.File
+	size int64
+}
+
+/*
+	Store persisting everything on disk. The messages are kept in a segmented log per topic under dir/topics,
+	see seglog.Log, which enforces the retention and compacts the messages delivered more than once.
+
+	The subscriptions and the presence snapshots are appended to a journal of segment files in dir as RESP arrays,
+	and the journal segment is rolled once it reaches SegmentSize. On open the journal is replayed, and a record
+	torn by a crash at the end of its active segment is truncated.
+
+		SUBSCRIPTIONS session topic-count topic ... pattern ...
+		PRESENCE topic user count [user count ...]
+
+	Journals written before the messages moved to seglog also hold MESSAGE topic offset id timestamp content
+	records, which are moved to the log on replay.
+*/
+type LogStore struct {
+	dir           string
+	segments      []*segment
+	messages      *seglog.Log
+	subscriptions map[string]Subscriptions
+	presence      map[string]map[string]int
+	closed        bool
+	done          chan struct{} // Closed on Close to stop the maintenance of the log
+	lock          sync.RWMutex //ReadWrite synchronization mutex
+}
+
+// Opens the log in dir, creating it if needed
+func MakeLogStore(dir string) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	messages, err := seglog.MakeLog(filepath.Join(dir, "topics"), seglog.Options{
+		SegmentSize:   SegmentSize,
+		RetentionSize: RetentionSize,
+		RetentionAge:  RetentionAge,
+		SyncWrites:    SyncWrites,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStore{
+		dir:           dir,
+		messages:      messages,
+		subscriptions: make(map[string]Subscriptions),
+		presence:      make(map[string]map[string]int),
+		done:          make(chan struct{}),
+	}
+	seqs, err := segmentSeqs(dir)
+	if err != nil {
+		messages.Close()
+		return nil, err
+	}
+	for i, seq := range seqs {
+		if err = s.openSegment(seq, i == len(seqs)-1); err != nil {
+			s.closeSegments()
+			messages.Close()
+			return nil, err
+		}
+	}
+	if len(s.segments) == 0 {
+		if err = s.roll(); err != nil {
+			messages.Close()
+			return nil, err
+		}
+	}
+	log.WithFields("datastore.logstore", "MakeLogStore", dir).Info(len(s.segments), " segments, ", len(messages.Topics()), " topics")
+	go s.maintain()
+	return s, nil
+}
+
+func (s *LogStore) Append(topic string, msgs ...*docid.Message) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+	return s.messages.Append(topic, msgs...)
+}
+
+func (s *LogStore) Read(topic string, offset int64, limit int) ([]Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return toRecords(s.messages.Read(topic, offset, limit))
+}
+
+func (s *LogStore) Last(topic string, count int) ([]Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return toRecords(s.messages.Last(topic, count))
+}
+
+func toRecords(logRecords []seglog.Record, err error) ([]Record, error) {
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(logRecords))
+	for _, record := range logRecords {
+		records = append(records, Record{Offset: record.Offset, Message: record.Message})
+	}
+	return records, nil
+}
+
+func (s *LogStore) SaveSubscriptions(session string, subs Subscriptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	err := s.write(func(w *resp.Writer) {
+		w.WriteArrayHeader(3 + len(subs.Topics) + len(subs.Patterns))
+		w.WriteBulkString("SUBSCRIPTIONS").WriteBulkString(session).WriteBulkString(strconv.Itoa(len(subs.Topics)))
+		for _, topic := range subs.Topics {
+			w.WriteBulkString(topic)
+		}
+		for _, pattern := range subs.Patterns {
+			w.WriteBulkString(pattern)
+		}
+	})
+	if err == nil {
+		s.applySubscriptions(session, subs)
+	}
+	return err
+}
+
+func (s *LogStore) Subscriptions(session string) (Subscriptions, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return Subscriptions{}, ErrStoreClosed
+	}
+	return s.subscriptions[session], nil
+}
+
+func (s *LogStore) SavePresence(topic string, users map[string]int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	err := s.write(func(w *resp.Writer) {
+		w.WriteArrayHeader(2 + 2*len(names))
+		w.WriteBulkString("PRESENCE").WriteBulkString(topic)
+		for _, user := range names {
+			w.WriteBulkString(user).WriteBulkString(strconv.Itoa(users[user]))
+		}
+	})
+	if err == nil {
+		s.applyPresence(topic, copyPresence(users))
+	}
+	return err
+}
+
+func (s *LogStore) Presence(topic string) (map[string]int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return copyPresence(s.presence[topic]), nil
+}
+
+func (s *LogStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.closeSegments()
+	if e := s.messages.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Enforces the retention of the messages every RetentionInterval and compacts them every CompactInterval
+func (s *LogStore) maintain() {
+	retention := time.NewTicker(RetentionInterval)
+	defer retention.Stop()
+	var compaction <-chan time.Time
+	if CompactInterval > 0 {
+		ticker := time.NewTicker(CompactInterval)
+		defer ticker.Stop()
+		compaction = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-retention.C:
+			s.messages.Enforce()
+		case <-compaction:
+			for _, topic := range s.messages.Topics() {
+				removed, err := s.messages.Compact(topic)
+				if err != nil {
+					log.WithFields("datastore.logstore", "maintain", topic).Error(err)
+				} else if removed > 0 {
+					log.WithFields("datastore.logstore", "maintain", topic).Info("Compacted ", removed, " messages")
+				}
+			}
+		}
+	}
+}
+
+// Appends the record written by encode to the active segment of the journal. Must be called holding the write lock
+func (s *LogStore) write(encode func(w *resp.Writer)) error {
+	active := s.segments[len(s.segments)-1]
+	if active.size >= SegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+		active = s.segments[len(s.segments)-1]
+	}
+	var buffer bytes.Buffer
+	encode(resp.MakeWriter(&buffer))
+	start := active.size
+	n, err := active.file.Write(buffer.Bytes())
+	active.size += int64(n)
+	if err == nil && SyncWrites {
+		err = active.file.Sync()
+	}
+	if err != nil {
+		log.WithFields("datastore.logstore", "write").Error(err)
+		if active.file.Truncate(start) == nil { // Later records must not follow a partial one
+			active.size = start
+		}
+		return err
+	}
+	return nil
+}
+
+// Starts a new active segment. Must be called holding the write lock
+func (s *LogStore) roll() error {
+	seq := 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	file, err := os.OpenFile(segmentPath(s.dir, seq), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, &segment{seq: seq, file: file})
+	return nil
+}
+
+// Replays the journal segment. A torn record at the end of the active segment is truncated
+func (s *LogStore) openSegment(seq int, active bool) error {
+	file, err := os.OpenFile(segmentPath(s.dir, seq), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	seg := &segment{seq: seq, file: file}
+	s.segments = append(s.segments, seg)
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReader(counter)
+	for {
+		offset := counter.count - int64(reader.Buffered())
+		value, err := resp.ReadValue(reader)
+		if err == io.EOF {
+			seg.size = offset
+			return nil
+		}
+		if err == nil {
+			err = s.replay(value)
+		}
+		if err != nil {
+			if !active {
+				return fmt.Errorf("%s at %d: %v", file.Name(), offset, err)
+			}
+			log.WithFields("datastore.logstore", "openSegment").Error(file.Name(), " truncated at ", offset, ", Err: ", err)
+			seg.size = offset
+			return file.Truncate(offset)
+		}
+	}
+}
+
+// Applies a record read from the journal
+func (s *LogStore) replay(value *resp.Value) error {
+	if !value.Ok() {
+		return errorInvalidRecord
+	}
+	args := value.Args()
+	switch {
+	case value.Action() == "MESSAGE" && len(args) == 5:
+		topic := string(args[0])
+		offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+		timestamp, e := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil || e != nil {
+			return errorInvalidRecord
+		}
+		if _, next := s.messages.Offsets(topic); offset < next {
+			return nil // Moved to the log by a previous replay
+		}
+		_, err = s.messages.Append(topic, &docid.Message{
+			StrId:     docid.StrId{Id: string(args[2])},
+			Content:   args[4],
+			Timestamp: timestamp,
+		})
+		return err
+	case value.Action() == "SUBSCRIPTIONS" && len(args) >= 2:
+		count, err := strconv.Atoi(string(args[1]))
+		if err != nil || count < 0 || count > len(args)-2 {
+			return errorInvalidRecord
+		}
+		var subs Subscriptions
+		for i, arg := range args[2:] {
+			if i < count {
+				subs.Topics = append(subs.Topics, string(arg))
+			} else {
+				subs.Patterns = append(subs.Patterns, string(arg))
+			}
+		}
+		s.applySubscriptions(string(args[0]), subs)
+	case value.Action() == "PRESENCE" && len(args)%2 == 1:
+		users := make(map[string]int)
+		for i := 1; i < len(args); i += 2 {
+			count, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return errorInvalidRecord
+			}
+			users[string(args[i])] = count
+		}
+		s.applyPresence(string(args[0]), users)
+	default:
+		return errorInvalidRecord
+	}
+	return nil
+}
+
+func (s *LogStore) applySubscriptions(session string, subs Subscriptions) {
+	if subs.IsEmpty() {
+		delete(s.subscriptions, session)
+	} else {
+		s.subscriptions[session] = copySubscriptions(subs)
+	}
+}
+
+func (s *LogStore) applyPresence(topic string, users map[string]int) {
+	if len(users) == 0 {
+		delete(s.presence, topic)
+	} else {
+		s.presence[topic] = users
+	}
+}
+
+func (s *LogStore) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if e := seg.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Counts the bytes read from the segment to locate the records
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.log", seq))
+}
+
+// Sequence numbers of the segments in dir, sorted
+func segmentSeqs(dir string) ([]int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		if seq, err := strconv.Atoi(strings.TrimSuffix(name, ".log")); err == nil && seq > 0 {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
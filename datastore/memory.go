@@ -0,0 +1,113 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package datastore
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"sync"
+)
+
+// Store keeping everything in memory. Meant for tests and for clusters that do not need durability
+type MemoryStore struct {
+	topics        map[string][]*docid.Message
+	subscriptions map[string]Subscriptions
+	presence      map[string]map[string]int
+	closed        bool
+	lock          sync.RWMutex //ReadWrite synchronization mutex
+}
+
+func MakeMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		topics:        make(map[string][]*docid.Message),
+		subscriptions: make(map[string]Subscriptions),
+		presence:      make(map[string]map[string]int),
+	}
+}
+
+func (s *MemoryStore) Append(topic string, msgs ...*docid.Message) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+	offset := int64(len(s.topics[topic]))
+	s.topics[topic] = append(s.topics[topic], msgs...)
+	return offset, nil
+}
+
+func (s *MemoryStore) Read(topic string, offset int64, limit int) ([]Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	msgs := s.topics[topic]
+	start, end := readRange(int64(len(msgs)), offset, limit)
+	records := make([]Record, 0, end-start)
+	for i := start; i < end; i++ {
+		records = append(records, Record{Offset: i, Message: msgs[i]})
+	}
+	return records, nil
+}
+
+func (s *MemoryStore) Last(topic string, count int) ([]Record, error) {
+	s.lock.RLock()
+	size := int64(len(s.topics[topic]))
+	s.lock.RUnlock()
+	return s.Read(topic, lastOffset(size, count), count)
+}
+
+func (s *MemoryStore) SaveSubscriptions(session string, subs Subscriptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if subs.IsEmpty() {
+		delete(s.subscriptions, session)
+	} else {
+		s.subscriptions[session] = copySubscriptions(subs)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Subscriptions(session string) (Subscriptions, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return Subscriptions{}, ErrStoreClosed
+	}
+	return s.subscriptions[session], nil
+}
+
+func (s *MemoryStore) SavePresence(topic string, users map[string]int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if len(users) == 0 {
+		delete(s.presence, topic)
+	} else {
+		s.presence[topic] = copyPresence(users)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Presence(topic string) (map[string]int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return copyPresence(s.presence[topic]), nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	return nil
+}
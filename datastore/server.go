@@ -0,0 +1,328 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/common/stats"
+	"github.com/pigeond-io/pigeond/hub"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+)
+
+var (
+	DataDir       = "data"           // Directory of the segment log
+	DurableTopics = []string{"*"}    // Patterns of the topics whose messages are persisted
+	MaxReadCount  = 1000             // Max messages replied by READ and LAST
+	HubAddress    = ""               // Address of the hub the messages to persist are received from
+	Membership    cluster.Membership // Cluster membership. Messages are received from every alive hub when HubAddress is empty
+)
+
+var (
+	errorInvalidCommand = errors.New("Invalid Command")
+)
+
+/*
+	Data store persists the messages of the DurableTopics and serves its Store over RESP. It links to the hubs
+	like an edge interested in the DurableTopics and persists every message the hubs forward to it.
+	Edges given the data store read the history of the durable topics beyond their memory from it, and save and load
+	the subscriptions of their sessions, see edge.DataStore. Hubs keep no history and do not query it. Backends read
+	the durable topics with Client, presence is stored only when a client saves it.
+
+	Clients send RESP commands and read one reply per command:
+
+		APPEND topic [id msg ...]                :offset of the first message
+		READ topic offset limit                  *records, each *4 :offset $id :timestamp $content
+		LAST topic count                         *records
+		SAVESUBSCRIPTIONS session topic-count topic ... pattern ...   +OK
+		SUBSCRIPTIONS session                    *2 *topics *patterns
+		SAVEPRESENCE topic [user count ...]      +OK
+		PRESENCE topic                           *users, flattened user :count pairs
+		PING                                     +PONG
+
+	See Client for the client side.
+*/
+type DataStoreServer struct {
+	store    Store
+	listener net.Listener
+}
+
+// Opens the log in DataDir, persists the durable topics forwarded by the hubs and serves the store on address
+func InitDataStoreServer(address string) {
+	store, err := MakeLogStore(DataDir)
+	if err != nil {
+		log.WithFields("datastore.server").Fatal(err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.WithFields("datastore.server").Fatal(err)
+	}
+	server := MakeDataStoreServer(store, listener)
+	link, err := hub.MakeLink(HubAddress, Membership, "", server.Persist)
+	if err != nil {
+		log.WithFields("datastore.server").Fatal(err)
+	}
+	if link != nil {
+		link.PSubscribe(DurableTopics...)
+	}
+	log.WithFields("datastore.server").Info("Listening on ", address, ", Data: ", DataDir)
+	server.Serve()
+}
+
+func MakeDataStoreServer(store Store, listener net.Listener) *DataStoreServer {
+	return &DataStoreServer{store: store, listener: listener}
+}
+
+// Accepts the connections until the listener is closed. Each connection is served by its own goroutine
+func (server *DataStoreServer) Serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.WithFields("datastore.server", "Serve").Info(err)
+			return
+		}
+		go server.serveConn(conn)
+	}
+}
+
+// Stops accepting connections and closes the store
+func (server *DataStoreServer) Close() error {
+	server.listener.Close()
+	return server.store.Close()
+}
+
+// Appends a message forwarded by the hub to its topic
+func (server *DataStoreServer) Persist(topic string, msg []byte) {
+	_, err := server.store.Append(topic, docid.MakeUniqueMessage(&docid.StrId{Id: topic}, msg))
+	if err != nil {
+		log.WithFields("datastore.server", "Persist", topic).Error(err)
+	}
+}
+
+func (server *DataStoreServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	stats.IncrServed()
+	registry := server.registerCommands()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		cmd, err := resp.ReadValue(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.WithFields("datastore.server", "serveConn").Error(conn.RemoteAddr(), ", Err: ", err)
+			}
+			return
+		}
+		var reply []byte
+		if !cmd.Ok() {
+			err = errorInvalidCommand
+		} else {
+			reply, err = commands.MakeExecutor(cmd).Execute(registry)
+		}
+		if err != nil {
+			stats.IncrFailed()
+			reply = []byte(resp.ErrorReply(err))
+		}
+		writer.Write(reply)
+		if reader.Buffered() == 0 { // Pipelined replies go out together
+			if err = writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (server *DataStoreServer) registerCommands() commands.Registry {
+	registry := commands.MakeRegistry()
+	registry.Write("APPEND", server.onAppend)
+	registry.Write("READ", server.onRead)
+	registry.Write("LAST", server.onLast)
+	registry.Write("SAVESUBSCRIPTIONS", server.onSaveSubscriptions)
+	registry.Write("SUBSCRIPTIONS", server.onSubscriptions)
+	registry.Write("SAVEPRESENCE", server.onSavePresence)
+	registry.Write("PRESENCE", server.onPresence)
+	registry.Write("PING", func(args ...[]byte) ([]byte, error) {
+		return []byte("+PONG\r\n"), nil
+	})
+	return registry
+}
+
+// APPEND topic [id msg ...]
+// Messages with an empty id are given a unique one
+func (server *DataStoreServer) onAppend(args ...[]byte) ([]byte, error) {
+	if len(args)%2 != 1 {
+		return nil, errorInvalidCommand
+	}
+	source := &docid.StrId{Id: string(args[0])}
+	msgs := make([]*docid.Message, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		msg := docid.MakeUniqueMessage(source, args[i+1])
+		if len(args[i]) > 0 {
+			msg.Id = string(args[i])
+		}
+		msgs = append(msgs, msg)
+	}
+	offset, err := server.store.Append(source.Id, msgs...)
+	if err != nil {
+		return nil, err
+	}
+	return reply(func(w *resp.Writer) {
+		w.WriteInteger(offset)
+	}), nil
+}
+
+// READ topic offset limit
+func (server *DataStoreServer) onRead(args ...[]byte) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errorInvalidCommand
+	}
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errorInvalidCommand
+	}
+	limit, err := readCount(args[2])
+	if err != nil {
+		return nil, err
+	}
+	return replyRecords(server.store.Read(string(args[0]), offset, limit))
+}
+
+// LAST topic count
+func (server *DataStoreServer) onLast(args ...[]byte) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errorInvalidCommand
+	}
+	count, err := readCount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return replyRecords(server.store.Last(string(args[0]), count))
+}
+
+// SAVESUBSCRIPTIONS session topic-count topic ... pattern ...
+func (server *DataStoreServer) onSaveSubscriptions(args ...[]byte) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errorInvalidCommand
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 || count > len(args)-2 {
+		return nil, errorInvalidCommand
+	}
+	var subs Subscriptions
+	for i, arg := range args[2:] {
+		if i < count {
+			subs.Topics = append(subs.Topics, string(arg))
+		} else {
+			subs.Patterns = append(subs.Patterns, string(arg))
+		}
+	}
+	if err = server.store.SaveSubscriptions(string(args[0]), subs); err != nil {
+		return nil, err
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// SUBSCRIPTIONS session
+func (server *DataStoreServer) onSubscriptions(args ...[]byte) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errorInvalidCommand
+	}
+	subs, err := server.store.Subscriptions(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return reply(func(w *resp.Writer) {
+		w.WriteArrayHeader(2)
+		w.WriteStrings(subs.Topics...)
+		w.WriteStrings(subs.Patterns...)
+	}), nil
+}
+
+// SAVEPRESENCE topic [user count ...]
+func (server *DataStoreServer) onSavePresence(args ...[]byte) ([]byte, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, errorInvalidCommand
+	}
+	users := make(map[string]int)
+	for i := 1; i < len(args); i += 2 {
+		count, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return nil, errorInvalidCommand
+		}
+		users[string(args[i])] = count
+	}
+	if err := server.store.SavePresence(string(args[0]), users); err != nil {
+		return nil, err
+	}
+	return []byte("+OK\r\n"), nil
+}
+
+// PRESENCE topic
+func (server *DataStoreServer) onPresence(args ...[]byte) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errorInvalidCommand
+	}
+	users, err := server.store.Presence(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return reply(func(w *resp.Writer) {
+		w.WriteArrayHeader(2 * len(names))
+		for _, user := range names {
+			w.WriteBulkString(user).WriteInteger(int64(users[user]))
+		}
+	}), nil
+}
+
+// Count argument of READ and LAST, capped at MaxReadCount
+func readCount(arg []byte) (int, error) {
+	count, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, errorInvalidCommand
+	}
+	if count <= 0 || count > MaxReadCount {
+		count = MaxReadCount
+	}
+	return count, nil
+}
+
+func replyRecords(records []Record, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return reply(func(w *resp.Writer) {
+		w.WriteArrayHeader(len(records))
+		for _, record := range records {
+			w.WriteArrayHeader(4)
+			w.WriteInteger(record.Offset)
+			w.WriteBulkString(record.Message.Id)
+			w.WriteInteger(record.Message.Timestamp)
+			w.WriteBulk(record.Message.Content)
+		}
+	}), nil
+}
+
+func reply(encode func(w *resp.Writer)) []byte {
+	var buffer bytes.Buffer
+	encode(resp.MakeWriter(&buffer))
+	return buffer.Bytes()
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package datastore
+
+import (
+	"errors"
+	"github.com/pigeond-io/pigeond/common/docid"
+)
+
+var (
+	ErrStoreClosed     = errors.New("Store is closed")
+	errorInvalidRecord = errors.New("Invalid record")
+)
+
+// Message of a topic along with its position in the topic. Offsets of a topic start at 0 and increase,
+// LogStore leaves gaps where it removed duplicated messages or expired ones
+type Record struct {
+	Offset  int64
+	Message *docid.Message
+}
+
+// Topics and patterns subscribed by a session
+type Subscriptions struct {
+	Topics   []string
+	Patterns []string
+}
+
+func (s Subscriptions) IsEmpty() bool {
+	return len(s.Topics) == 0 && len(s.Patterns) == 0
+}
+
+/*
+	Store persists the messages of the topics, the subscriptions of the sessions and the presence of the topics.
+	MemoryStore keeps them in memory, LogStore on disk and Client in a remote data store.
+	Implementations are thread-safe.
+*/
+type Store interface {
+	// Appends msgs to the topic. Returns the offset of the first one
+	Append(topic string, msgs ...*docid.Message) (int64, error)
+	// Returns at most limit messages of the topic starting at offset, oldest first. Non positive limit returns all
+	Read(topic string, offset int64, limit int) ([]Record, error)
+	// Returns the last count messages of the topic, oldest first
+	Last(topic string, count int) ([]Record, error)
+	// Replaces the subscriptions of the session. Empty subscriptions forget the session
+	SaveSubscriptions(session string, subs Subscriptions) error
+	// Returns the subscriptions of the session. Empty when the session is unknown
+	Subscriptions(session string) (Subscriptions, error)
+	// Replaces the snapshot of the users present in the topic along with the count of their sessions
+	SavePresence(topic string, users map[string]int) error
+	// Returns the snapshot of the users present in the topic
+	Presence(topic string) (map[string]int, error)
+	Close() error
+}
+
+// Records between offset and offset + limit of a topic holding size messages
+func readRange(size int64, offset int64, limit int) (int64, int64) {
+	if offset < 0 {
+		offset = 0
+	}
+	end := size
+	if limit > 0 && offset+int64(limit) < end {
+		end = offset + int64(limit)
+	}
+	if offset > end {
+		offset = end
+	}
+	return offset, end
+}
+
+// Start of the last count records of a topic holding size messages
+func lastOffset(size int64, count int) int64 {
+	if count <= 0 || int64(count) > size {
+		return 0
+	}
+	return size - int64(count)
+}
+
+func copyPresence(users map[string]int) map[string]int {
+	snapshot := make(map[string]int, len(users))
+	for user, count := range users {
+		snapshot[user] = count
+	}
+	return snapshot
+}
+
+func copySubscriptions(subs Subscriptions) Subscriptions {
+	return Subscriptions{
+		Topics:   append([]string(nil), subs.Topics...),
+		Patterns: append([]string(nil), subs.Patterns...),
+	}
+}
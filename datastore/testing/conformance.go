@@ -0,0 +1,143 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/datastore"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Runs the conformance suite against the stores made by open. Every Store must pass it.
+// Each subtest gets a new empty store and closes it
+func StoreConformance(t *testing.T, open func(t *testing.T) datastore.Store) {
+	t.Run("Messages", func(t *testing.T) { testMessages(t, open(t)) })
+	t.Run("Subscriptions", func(t *testing.T) { testSubscriptions(t, open(t)) })
+	t.Run("Presence", func(t *testing.T) { testPresence(t, open(t)) })
+}
+
+// Offsets of a topic start at 0, messages are read back in order
+func testMessages(t *testing.T, store datastore.Store) {
+	defer store.Close()
+	AppendMessages(t, store, "news", 0, 5)
+	AppendMessages(t, store, "chat", 0, 2)
+	AppendMessages(t, store, "news", 5, 5)
+	large := strings.Repeat("x", 100<<10)
+	if offset, err := store.Append("news", Message("news", large)); err != nil || offset != 10 {
+		t.Errorf("Expected offset 10 got %d %v", offset, err)
+	}
+
+	ExpectRecords(t, "Read", store, "news", 0, 3, "0 1 2")
+	ExpectRecords(t, "Read", store, "news", 8, 0, "8 9 "+large)
+	ExpectRecords(t, "Read", store, "news", 11, 10, "")
+	ExpectRecords(t, "Read", store, "chat", -1, 10, "0 1")
+	ExpectRecords(t, "Read", store, "unknown", 0, 10, "")
+	ExpectRecords(t, "Last", store, "news", 0, 3, "8 9 "+large)
+	ExpectRecords(t, "Last", store, "chat", 0, 5, "0 1")
+
+	records, err := store.Read("news", 4, 1)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Expected 1 record got %v %v", records, err)
+	}
+	expected := Message("news", "4")
+	if msg := records[0].Message; records[0].Offset != 4 || msg.Id != expected.Id || msg.Timestamp == 0 {
+		t.Errorf("Expected %v got %d %v", expected, records[0].Offset, msg)
+	}
+}
+
+// Saved subscriptions replace the previous ones, empty subscriptions forget the session
+func testSubscriptions(t *testing.T, store datastore.Store) {
+	defer store.Close()
+	subs := datastore.Subscriptions{Topics: []string{"news", "chat"}, Patterns: []string{"sports.*"}}
+	store.SaveSubscriptions("s1", subs)
+	store.SaveSubscriptions("s2", datastore.Subscriptions{Patterns: []string{"*"}})
+	store.SaveSubscriptions("s2", datastore.Subscriptions{Topics: []string{"weather"}})
+	store.SaveSubscriptions("s3", datastore.Subscriptions{Topics: []string{"news"}})
+	if err := store.SaveSubscriptions("s3", datastore.Subscriptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ExpectSubscriptions(t, store, "s1", subs)
+	ExpectSubscriptions(t, store, "s2", datastore.Subscriptions{Topics: []string{"weather"}})
+	ExpectSubscriptions(t, store, "s3", datastore.Subscriptions{})
+}
+
+// Presence snapshots replace the previous ones
+func testPresence(t *testing.T, store datastore.Store) {
+	defer store.Close()
+	store.SavePresence("news", map[string]int{"u1": 1, "u2": 3})
+	store.SavePresence("chat", map[string]int{"u1": 1})
+	if err := store.SavePresence("chat", map[string]int{"u3": 2}); err != nil {
+		t.Fatal(err)
+	}
+	store.SavePresence("weather", map[string]int{"u1": 1})
+	store.SavePresence("weather", nil)
+	ExpectPresence(t, store, "news", map[string]int{"u1": 1, "u2": 3})
+	ExpectPresence(t, store, "chat", map[string]int{"u3": 2})
+	ExpectPresence(t, store, "weather", map[string]int{})
+}
+
+func Message(topic string, content string) *docid.Message {
+	return docid.MakeMessage(&docid.StrId{Id: topic}, []byte(content))
+}
+
+// Appends the messages first to first + count - 1, whose content is their offset
+func AppendMessages(t *testing.T, store datastore.Store, topic string, first int, count int) {
+	var msgs []*docid.Message
+	for i := first; i < first+count; i++ {
+		msgs = append(msgs, Message(topic, strconv.Itoa(i)))
+	}
+	offset, err := store.Append(topic, msgs...)
+	if err != nil || offset != int64(first) {
+		t.Fatalf("Expected offset %d got %d %v", first, offset, err)
+	}
+}
+
+// Checks the content of the records read with Read or Last, space separated
+func ExpectRecords(t *testing.T, method string, store datastore.Store, topic string, offset int64, count int, expected string) {
+	var records []datastore.Record
+	var err error
+	if method == "Last" {
+		records, err = store.Last(topic, count)
+	} else {
+		records, err = store.Read(topic, offset, count)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for i, record := range records {
+		if i > 0 && record.Offset != records[i-1].Offset+1 {
+			t.Errorf("Offsets %d and %d are not contiguous", records[i-1].Offset, record.Offset)
+		}
+		contents = append(contents, string(record.Message.Content))
+	}
+	if strings.Join(contents, " ") != expected {
+		t.Errorf("%s %s %d %d expected %.40q got %.40q", method, topic, offset, count, expected, strings.Join(contents, " "))
+	}
+}
+
+func ExpectSubscriptions(t *testing.T, store datastore.Store, session string, expected datastore.Subscriptions) {
+	subs, err := store.Subscriptions(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(subs.Topics, " ") != strings.Join(expected.Topics, " ") ||
+		strings.Join(subs.Patterns, " ") != strings.Join(expected.Patterns, " ") {
+		t.Errorf("Expected subscriptions %v of %s got %v", expected, session, subs)
+	}
+}
+
+func ExpectPresence(t *testing.T, store datastore.Store, topic string, expected map[string]int) {
+	users, err := store.Presence(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("Expected presence %v in %s got %v", expected, topic, users)
+	}
+}
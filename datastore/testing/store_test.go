@@ -0,0 +1,126 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing_test
+
+import (
+	"github.com/pigeond-io/pigeond/datastore"
+	. "github.com/pigeond-io/pigeond/datastore/testing"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMemoryStore(t *testing.T) {
+	StoreConformance(t, func(t *testing.T) datastore.Store {
+		return datastore.MakeMemoryStore()
+	})
+}
+
+func TestLogStore(t *testing.T) {
+	datastore.SegmentSize = 4 << 10 // Messages span several segments
+	StoreConformance(t, func(t *testing.T) datastore.Store {
+		dir := tempDir(t)
+		store, err := datastore.MakeLogStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &removeOnClose{Store: store, dir: dir}
+	})
+}
+
+func TestClient(t *testing.T) {
+	StoreConformance(t, func(t *testing.T) datastore.Store {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := datastore.MakeDataStoreServer(datastore.MakeMemoryStore(), listener)
+		go server.Serve()
+		return &closeServer{Store: datastore.MakeClient(listener.Addr().String()), server: server}
+	})
+}
+
+// Publishes with the same content are distinct messages, so that compaction keeps them all
+func TestPersistIds(t *testing.T) {
+	store := datastore.MakeMemoryStore()
+	server := datastore.MakeDataStoreServer(store, nil)
+	server.Persist("news", []byte("ping"))
+	server.Persist("news", []byte("ping"))
+	records, err := store.Read("news", 0, 0)
+	if err != nil || len(records) != 2 || records[0].Message.Id == records[1].Message.Id {
+		t.Errorf("Expected 2 messages with distinct ids got %v %v", records, err)
+	}
+}
+
+// Everything is recovered on reopen, and the record torn by a crash is dropped
+func TestLogStoreRecovery(t *testing.T) {
+	datastore.SegmentSize = 4 << 10
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := datastore.MakeLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AppendMessages(t, store, "news", 0, 1000)
+	store.SaveSubscriptions("s1", datastore.Subscriptions{Topics: []string{"news"}})
+	store.SavePresence("news", map[string]int{"u1": 2})
+	AppendMessages(t, store, "news", 1000, 1)
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "topics", "*", "*.log"))
+	if len(segments) < 2 {
+		t.Fatalf("Expected several segments got %v", segments)
+	}
+	active := segments[len(segments)-1]
+	info, _ := os.Stat(active)
+	os.Truncate(active, info.Size()-3) // Torn last message
+
+	store, err = datastore.MakeLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectRecords(t, "Last", store, "news", 0, 2, "998 999")
+	ExpectSubscriptions(t, store, "s1", datastore.Subscriptions{Topics: []string{"news"}})
+	ExpectPresence(t, store, "news", map[string]int{"u1": 2})
+	AppendMessages(t, store, "news", 1000, 1) // Appends after the truncated record
+	store.Close()
+
+	store, err = datastore.MakeLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ExpectRecords(t, "Read", store, "news", 998, 10, "998 999 1000")
+}
+
+type removeOnClose struct {
+	datastore.Store
+	dir string
+}
+
+func (s *removeOnClose) Close() error {
+	defer os.RemoveAll(s.dir)
+	return s.Store.Close()
+}
+
+type closeServer struct {
+	datastore.Store
+	server *datastore.DataStoreServer
+}
+
+func (s *closeServer) Close() error {
+	s.Store.Close()
+	return s.server.Close()
+}
@@ -0,0 +1,21 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"github.com/pigeond-io/pigeond/common/resp"
+)
+
+// Authorizer decides which topics the requester can subscribe & publish
+type Authorizer interface {
+	CanSubscribe(topic string) bool
+	CanPSubscribe(pattern string) bool
+	CanPublish(topic string) bool
+}
+
+// Replied as -NOPERM error
+func noPermission(action string, topic string) error {
+	return resp.MakeReplyError("NOPERM", "no permission to %s %q", action, topic)
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"strconv"
+)
+
+var (
+	errorNoProto = resp.MakeReplyError("NOPROTO", "unsupported protocol version")
+)
+
+// Negotiator keeps the RESP protocol version negotiated with the requester.
+// Replies and pushes are encoded in the negotiated version
+type Negotiator interface {
+	docid.DocId
+	Protocol() int
+	SetProtocol(version int) bool
+}
+
+// HELLO [protover]
+// Switches the requester to protover (2 or 3) and replies with the server info as a map
+func OnHello(negotiator Negotiator) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) > 1 {
+			return nil, wrongNumberOfArgs("HELLO")
+		}
+		if len(args) == 1 {
+			version, err := strconv.Atoi(string(args[0]))
+			if err != nil || !negotiator.SetProtocol(version) {
+				return nil, errorNoProto
+			}
+		}
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		w.WriteValue(map[string]interface{}{
+			"server": "pigeond",
+			"proto":  negotiator.Protocol(),
+			"id":     negotiator.DocId(),
+			"role":   "edge",
+		})
+		return reply.Bytes(), w.Err()
+	}
+}
+
+// Makes a reply writer for the protocol negotiated with the requester
+func makeWriter(reply *bytes.Buffer, negotiator Negotiator) *resp.Writer {
+	return resp.MakeVersionedWriter(reply, negotiator.Protocol())
+}
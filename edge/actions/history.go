@@ -0,0 +1,61 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"strconv"
+)
+
+// Historian keeps the recent messages of the topics
+type Historian interface {
+	History(topic string, count int, since int64) []*docid.Message
+}
+
+// HISTORY topic [count] [since]
+// Replies with at most count latest messages of topic published at or after the unix timestamp since, oldest first.
+// Each message is replied as an array of message id, timestamp and payload. The id is the one the message was pushed with,
+// which RESUME takes. Messages older than the ones retained by the edge are read from the data store, if any,
+// and carry their data store ids instead.
+// Without count all the retained messages are replied. History of a topic requires the permission to subscribe to it
+func OnHistory(historian Historian, negotiator Negotiator, authorizer Authorizer) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) < 1 || len(args) > 3 {
+			return nil, wrongNumberOfArgs("HISTORY")
+		}
+		topic := string(args[0])
+		if !authorizer.CanSubscribe(topic) {
+			return nil, noPermission("read history of", topic)
+		}
+		count, since := 0, int64(0)
+		var err error
+		if len(args) > 1 {
+			count, err = strconv.Atoi(string(args[1]))
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("invalid count %q", args[1])
+			}
+		}
+		if len(args) > 2 {
+			since, err = strconv.ParseInt(string(args[2]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", args[2])
+			}
+		}
+		messages := historian.History(topic, count, since)
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		w.WriteArrayHeader(len(messages))
+		for _, msg := range messages {
+			w.WriteArrayHeader(3)
+			w.WriteBulkString(msg.DocId())
+			w.WriteInteger(msg.Timestamp)
+			w.WriteBulk(msg.Content)
+		}
+		return reply.Bytes(), w.Err()
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"github.com/pigeond-io/pigeond/common/commands"
+)
+
+// Presence lists the users present in the topics through the edge
+type Presence interface {
+	Presence(topic string) []string
+}
+
+// PRESENCE topic
+// Replies with the distinct user ids subscribed to the topic through this edge, as a map with the single key edge
+// whose value is the set of user ids. Sessions on the other edges are not counted, presence is not forwarded by the hubs.
+// Requires the permission to subscribe to the topic
+func OnPresence(presence Presence, negotiator Negotiator, authorizer Authorizer) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) != 1 {
+			return nil, wrongNumberOfArgs("PRESENCE")
+		}
+		topic := string(args[0])
+		if !authorizer.CanSubscribe(topic) {
+			return nil, noPermission("read presence of", topic)
+		}
+		users := presence.Presence(topic)
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		w.WriteMapHeader(1)
+		w.WriteBulkString("edge")
+		w.WriteSetHeader(len(users))
+		for _, userId := range users {
+			w.WriteBulkString(userId)
+		}
+		return reply.Bytes(), w.Err()
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/events"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/common/utils"
+)
+
+// PSUBSCRIBE pattern [pattern ...]
+// Replies with a psubscribe confirmation for each pattern along with the subscription count.
+// Nothing is subscribed if any of the patterns is invalid, see utils.ValidGlob, or not authorized
+func OnPSubscribe(subscriber events.PatternSubscriber, negotiator Negotiator, authorizer Authorizer) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) == 0 {
+			return nil, wrongNumberOfArgs("PSUBSCRIBE")
+		}
+		for _, arg := range args {
+			if !utils.ValidGlob(string(arg)) {
+				return nil, resp.MakeReplyError("ERR", "pattern %.32q is too long or has too many *", string(arg))
+			}
+			if !authorizer.CanPSubscribe(string(arg)) {
+				return nil, noPermission("psubscribe", string(arg))
+			}
+		}
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		for _, arg := range args {
+			pattern := string(arg)
+			if !subscriber.PSubscribe(pattern) {
+				return reply.Bytes(), fmt.Errorf("PSUBSCRIBE %q failed", pattern)
+			}
+			w.WriteSubscription("psubscribe", pattern, subscriber.Subscriptions())
+		}
+		return reply.Bytes(), nil
+	}
+}
@@ -5,18 +5,34 @@
 package actions
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/pigeond-io/pigeond/common/commands"
 	"github.com/pigeond-io/pigeond/common/events"
 )
 
-func OnPublish(publisher events.Publisher) commands.ActionCallback {
-	return func(args ...[]byte) bool {
+// PUBLISH topic msg [msg ...]
+// Replies with the number of receivers
+func OnPublish(publisher events.Publisher, negotiator Negotiator, authorizer Authorizer) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) < 2 {
+			return nil, wrongNumberOfArgs("PUBLISH")
+		}
 		topic := string(args[0])
+		if !authorizer.CanPublish(topic) {
+			return nil, noPermission("publish", topic)
+		}
 		msgs := args[1:]
 		evmsgs := make([]events.Message, 0, len(msgs))
 		for _, msg := range msgs {
 			evmsgs = append(evmsgs, events.MakeSliceMessage(msg))
 		}
-		return publisher.Publish(topic, evmsgs...)
+		receivers, ok := publisher.Publish(topic, evmsgs...)
+		if !ok {
+			return nil, fmt.Errorf("PUBLISH %q failed", topic)
+		}
+		var reply bytes.Buffer
+		makeWriter(&reply, negotiator).WriteInteger(int64(receivers))
+		return reply.Bytes(), nil
 	}
 }
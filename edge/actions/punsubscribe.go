@@ -0,0 +1,38 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/events"
+)
+
+// PUNSUBSCRIBE [pattern ...]
+// Without args the subscriber is unsubscribed from all the patterns
+func OnPUnsubscribe(subscriber events.PatternSubscriber, negotiator Negotiator) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		patterns := make([]string, 0, len(args))
+		for _, arg := range args {
+			patterns = append(patterns, string(arg))
+		}
+		if len(patterns) == 0 {
+			patterns = subscriber.Patterns()
+			if len(patterns) == 0 {
+				w.WriteSubscription("punsubscribe", "", subscriber.Subscriptions())
+			}
+		}
+		for _, pattern := range patterns {
+			if !subscriber.PUnsubscribe(pattern) {
+				return reply.Bytes(), fmt.Errorf("PUNSUBSCRIBE %q failed", pattern)
+			}
+			w.WriteSubscription("punsubscribe", pattern, subscriber.Subscriptions())
+		}
+		return reply.Bytes(), nil
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"strconv"
+)
+
+// Resumer resumes the session of the requester after a reconnect
+type Resumer interface {
+	Resume(lastId int64) (int, error)
+}
+
+// RESUME [last-id]
+// Replays the messages published after last-id that the session missed while it was disconnected
+// and enables message ids on message pushes. Replies with the number of replayed messages.
+// Replayed messages are pushed right after the reply.
+func OnResume(resumer Resumer, negotiator Negotiator) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) > 1 {
+			return nil, wrongNumberOfArgs("RESUME")
+		}
+		lastId := int64(-1)
+		if len(args) == 1 {
+			id, err := strconv.ParseInt(string(args[0]), 10, 64)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid message id %q", args[0])
+			}
+			lastId = id
+		}
+		count, err := resumer.Resume(lastId)
+		if err != nil {
+			return nil, err
+		}
+		var reply bytes.Buffer
+		makeWriter(&reply, negotiator).WriteInteger(int64(count))
+		return reply.Bytes(), nil
+	}
+}
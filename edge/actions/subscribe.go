@@ -5,16 +5,38 @@
 package actions
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/pigeond-io/pigeond/common/commands"
 	"github.com/pigeond-io/pigeond/common/events"
 )
 
-func OnSubscribe(subscriber events.Subscriber) commands.ActionCallback {
-	return func(args ...[]byte) bool {
-		ok := true
-		for arg := range args {
-			ok = ok && subscriber.Subscribe(string(arg))
+// SUBSCRIBE topic [topic ...]
+// Replies with a subscribe confirmation for each topic along with the subscription count.
+// Nothing is subscribed if any of the topics is not authorized
+func OnSubscribe(subscriber events.Subscriber, negotiator Negotiator, authorizer Authorizer) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) == 0 {
+			return nil, wrongNumberOfArgs("SUBSCRIBE")
 		}
-		return ok
+		for _, arg := range args {
+			if !authorizer.CanSubscribe(string(arg)) {
+				return nil, noPermission("subscribe", string(arg))
+			}
+		}
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		for _, arg := range args {
+			topic := string(arg)
+			if !subscriber.Subscribe(topic) {
+				return reply.Bytes(), fmt.Errorf("SUBSCRIBE %q failed", topic)
+			}
+			w.WriteSubscription("subscribe", topic, subscriber.Subscriptions())
+		}
+		return reply.Bytes(), nil
 	}
 }
+
+func wrongNumberOfArgs(action string) error {
+	return fmt.Errorf("wrong number of arguments for %q", action)
+}
@@ -5,16 +5,34 @@
 package actions
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/pigeond-io/pigeond/common/commands"
 	"github.com/pigeond-io/pigeond/common/events"
 )
 
-func OnUnsubscribe(subscriber events.Subscriber) commands.ActionCallback {
-	return func(args ...[]byte) bool {
-		ok := true
-		for arg := range args {
-			ok = ok && subscriber.Unsubscribe(string(arg))
+// UNSUBSCRIBE [topic ...]
+// Without args the subscriber is unsubscribed from all the topics
+func OnUnsubscribe(subscriber events.Subscriber, negotiator Negotiator) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		var reply bytes.Buffer
+		w := makeWriter(&reply, negotiator)
+		topics := make([]string, 0, len(args))
+		for _, arg := range args {
+			topics = append(topics, string(arg))
 		}
-		return ok
+		if len(topics) == 0 {
+			topics = subscriber.Topics()
+			if len(topics) == 0 {
+				w.WriteSubscription("unsubscribe", "", subscriber.Subscriptions())
+			}
+		}
+		for _, topic := range topics {
+			if !subscriber.Unsubscribe(topic) {
+				return reply.Bytes(), fmt.Errorf("UNSUBSCRIBE %q failed", topic)
+			}
+			w.WriteSubscription("unsubscribe", topic, subscriber.Subscriptions())
+		}
+		return reply.Bytes(), nil
 	}
 }
@@ -5,49 +5,67 @@
 package edge
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/pigeond-io/pigeond/common/auth"
 	"github.com/pigeond-io/pigeond/common/commands"
 	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/events"
 	"github.com/pigeond-io/pigeond/common/log"
 	"github.com/pigeond-io/pigeond/common/resp"
 	"github.com/pigeond-io/pigeond/common/stats"
 	"github.com/pigeond-io/pigeond/edge/actions"
 	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const (
-	ConnectionClosed = 0
-)
-
 var (
-	seq                int64
-	emptyBuffer        = []byte{}
-	ClientTickInterval = 80 * time.Millisecond
-	keepAliveCounts    = (KeepAliveInterval / ClientTickInterval).Nanoseconds()
+	errorServerNotFound  = errors.New("Server not found")
+	errorMessageTooLarge = errors.New("Message too large")
+	errorGuestSession    = resp.MakeReplyError("NORESUME", "guest sessions can not be resumed")
+	errorResumeGap       = resp.MakeReplyError("NORESUME", "missed messages are no longer buffered")
+	seq                  int64
+	emptyBuffer          = []byte{}
+	ClientTickInterval   = 80 * time.Millisecond
+	MaxMessageSize       = int64(1 << 20) // Max size of a client message
 )
 
 // WebSocketClient that encapsulates WebSocket Connection.
-// For each WsClient two go routines are created.
-// One goroutine for reading client requests. One goroutine for writing server updates
+// WsClient does not own any goroutine. The connection is parked in the server Poller and
+// client requests are read and executed as soon as the connection is readable.
+// Server updates are queued in the outbox and are written in batches every ClientTickInterval
 type WsClient struct {
 	docid.StrId             // Client Id - Unique for each connection
 	SessionId   docid.DocId // Each connection belongs to a unique Session
 	UserId      docid.DocId // Each may connection belongs to a unique userid or is guest
-	IsClosed    bool        // Is WebSocket closed
 	Conn        net.Conn    // TCP based Websocket Connection
-	RChan       chan int    // ClientRequestsRoutine Control Channel
-	WChan       chan int    // ServerResponsesRoutine Control Channel
 	cmdRegistry commands.Registry
-	once        sync.Once // Singleton to close WebSocket once
-	state       int32     // Internal State of the WsClient
+	acl         *auth.TopicAcl     // Topics the connection is authorized for. nil allows all the topics
+	session     *Session           // Session owning the subscriptions of the connection
+	wlock       sync.Mutex         // Websocket write synchronization mutex
+	outbox      docid.DoubleBuffer // Messages pending delivery
+	pending     int32              // Set when the client is queued for delivery on the server
+	flushing    int32              // Set while the outbox is being written, flushes of a client never overlap
+	protocol    int32              // RESP protocol version negotiated with HELLO
+	resumed     int32              // Set once the client resumes its session. Pushes of resumed clients carry message ids
+	joinedAt    int64              // Count of the deliveries buffered in the session before the client joined it
+	closed      int32              // Set once the WebSocket is closed
+	frame       ws.Header          // Header of the frame being read
+	payload     []byte             // Payload of the frame being read
+	received    int                // Bytes of the payload read so far
+	reading     bool               // Set while the payload of a frame is partially read
+	fragments   []byte             // Payload of a fragmented message being read
+	once        sync.Once          // Singleton to close WebSocket once
 	server      *WsServer
 }
 
@@ -62,159 +80,448 @@ func InitWsClient(server *WsServer, conn net.Conn, token *jwt.Token) {
 		Conn:        conn,
 		SessionId:   getSessionId(claims, connId),
 		UserId:      getUserId(claims),
-		IsClosed:    false,
-		RChan:       make(chan int),
-		WChan:       make(chan int),
+		acl:         auth.ParseTopicAcl(claims),
 		cmdRegistry: commands.MakeRegistry(),
-		state:       0,
+		outbox:      docid.MakeSliceDoubleBuffer(),
+		protocol:    resp.RESP2,
 		server:      server,
 	}
 	client.Id = connId
 	client.registerCommands()
-	client.registerSession()
+	if err := client.registerSession(); err != nil {
+		log.WithFields("edge.client", "InitWsClient").Error(client.String(), ", Err: ", err)
+		conn.Close()
+		return
+	}
 	client.registerUser()
 	stats.IncrServed()
 	stats.IncrLive()
-	log.WithFields("edge.client", "InitWsClient").Debug(client.String(), ", keepAliveCounts: ", keepAliveCounts)
-	go client.wsClientRequestsProcessor()
-	go client.wsServerResponsesProcessor()
+	log.WithFields("edge.client", "InitWsClient").Debug(client.String())
+	server.clients.Add(client)
+	err := server.poller.Start(conn, client.onReadable)
+	if err != nil {
+		log.WithFields("edge.client", "InitWsClient").Error(client.String(), ", Err: ", err)
+		client.Close()
+	}
 }
 
 func (client *WsClient) String() string {
 	return fmt.Sprintf("WsClient #%s", client.DocId())
 }
 
+// Is WebSocket closed
+func (client *WsClient) IsClosed() bool {
+	return atomic.LoadInt32(&client.closed) == 1
+}
+
 func (client *WsClient) IsGuestSession() bool {
-	return docid.Equals(client, client.SessionId)
+	return client.SessionId.DocId() == guestSessionPrefix+client.DocId()
 }
 
+// Adds the client session to the TopicIdx of the server keyed with topic
 func (client *WsClient) Subscribe(topic string) bool {
 	log.WithFields("edge.client", "Subscribe", topic).Debug(client.String())
-	//TODO
+	session := client.session
+	if client.IsClosed() || session == nil {
+		return false
+	}
+	err := errorServerNotFound
+	client.onIndex(func(index docid.ImmutableIndexMap) {
+		err = index.Add(TopicIdx, func(idx docid.AddIndexEntryWriter) error {
+			return idx.Add(&docid.StrId{Id: topic}, session)
+		})
+	})
+	if err != nil {
+		log.WithFields("edge.client", "Subscribe", topic).Error(client.String(), ", Err: ", err)
+		return false
+	}
+	if session.addTopic(topic) {
+		client.server.onSubscribe(topic, session)
+		client.server.saveSubscriptions(session)
+	}
 	return true
 }
 
+// Removes the client session from the TopicIdx of the server keyed with topic
 func (client *WsClient) Unsubscribe(topic string) bool {
 	log.WithFields("edge.client", "Unsubscribe", topic).Debug(client.String())
-	//TODO
+	session := client.session
+	if client.IsClosed() || session == nil {
+		return false
+	}
+	err := errorServerNotFound
+	client.onIndex(func(index docid.ImmutableIndexMap) {
+		err = index.Remove(TopicIdx, func(idx docid.RemoveIndexEntryWriter) error {
+			return idx.Remove(&docid.StrId{Id: topic}, session)
+		})
+	})
+	if err != nil {
+		log.WithFields("edge.client", "Unsubscribe", topic).Error(client.String(), ", Err: ", err)
+		return false
+	}
+	if session.removeTopic(topic) {
+		client.server.onUnsubscribe(topic, session)
+		client.server.saveSubscriptions(session)
+	}
+	return true
+}
+
+// Topics subscribed by the client session
+func (client *WsClient) Topics() []string {
+	if client.session == nil {
+		return nil
+	}
+	return client.session.Topics()
+}
+
+// Adds the client session to the PatternIdx of the server keyed with pattern
+func (client *WsClient) PSubscribe(pattern string) bool {
+	log.WithFields("edge.client", "PSubscribe", pattern).Debug(client.String())
+	server := client.server
+	session := client.session
+	if client.IsClosed() || server == nil || session == nil {
+		return false
+	}
+	err := server.indexMap.Add(PatternIdx, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(&docid.StrId{Id: pattern}, session)
+	})
+	if err != nil {
+		log.WithFields("edge.client", "PSubscribe", pattern).Error(client.String(), ", Err: ", err)
+		return false
+	}
+	if session.addPattern(pattern) {
+		server.addPattern(pattern)
+		server.saveSubscriptions(session)
+	}
+	return true
+}
+
+// Removes the client session from the PatternIdx of the server keyed with pattern
+func (client *WsClient) PUnsubscribe(pattern string) bool {
+	log.WithFields("edge.client", "PUnsubscribe", pattern).Debug(client.String())
+	server := client.server
+	session := client.session
+	if client.IsClosed() || server == nil || session == nil {
+		return false
+	}
+	err := server.indexMap.Remove(PatternIdx, func(idx docid.RemoveIndexEntryWriter) error {
+		return idx.Remove(&docid.StrId{Id: pattern}, session)
+	})
+	if err != nil {
+		log.WithFields("edge.client", "PUnsubscribe", pattern).Error(client.String(), ", Err: ", err)
+		return false
+	}
+	if session.removePattern(pattern) {
+		server.removePattern(pattern)
+		server.saveSubscriptions(session)
+	}
+	return true
+}
+
+// Patterns subscribed by the client session
+func (client *WsClient) Patterns() []string {
+	if client.session == nil {
+		return nil
+	}
+	return client.session.Patterns()
+}
+
+// Count of topics and patterns subscribed by the client session
+func (client *WsClient) Subscriptions() int {
+	if client.session == nil {
+		return 0
+	}
+	return client.session.Subscriptions()
+}
+
+// Publishes msgs on topic using the server and forwards them to the other edges through the hub.
+// Returns the number of receivers on this edge
+func (client *WsClient) Publish(topic string, msgs ...events.Message) (int, bool) {
+	log.WithFields("edge.client", "Publish", topic).Debug(client.String())
+	server := client.server
+	if client.IsClosed() || server == nil {
+		return 0, false
+	}
+	server.forward(topic, msgs...)
+	return server.Publish(topic, msgs...)
+}
+
+// RESP protocol version of the client
+func (client *WsClient) Protocol() int {
+	return int(atomic.LoadInt32(&client.protocol))
+}
+
+// Switches the RESP protocol version of the client. Only RESP2 & RESP3 are supported
+func (client *WsClient) SetProtocol(version int) bool {
+	if version != resp.RESP2 && version != resp.RESP3 {
+		return false
+	}
+	atomic.StoreInt32(&client.protocol, int32(version))
+	return true
+}
+
+// Presence topics can be subscribed by the clients authorized to subscribe to the topic
+func (client *WsClient) CanSubscribe(topic string) bool {
+	return client.acl.CanSubscribe(strings.TrimPrefix(topic, PresencePrefix))
+}
+
+func (client *WsClient) CanPSubscribe(pattern string) bool {
+	return client.acl.CanPSubscribe(strings.TrimPrefix(pattern, PresencePrefix))
+}
+
+// Presence events are published by the server only
+func (client *WsClient) CanPublish(topic string) bool {
+	return !isPresenceTopic(topic) && client.acl.CanPublish(topic)
+}
+
+// Distinct users subscribed to topic
+func (client *WsClient) Presence(topic string) []string {
+	log.WithFields("edge.client", "Presence", topic).Debug(client.String())
+	server := client.server
+	if client.IsClosed() || server == nil {
+		return nil
+	}
+	return server.Presence(topic)
+}
+
+// Recent messages of topic retained by the server
+func (client *WsClient) History(topic string, count int, since int64) []*docid.Message {
+	log.WithFields("edge.client", "History", topic).Debug(client.String())
+	server := client.server
+	if client.IsClosed() || server == nil {
+		return nil
+	}
+	return server.History(topic, count, since)
+}
+
+// Resumes the session of the client. Messages published after lastId that the session missed before the client connected
+// are replayed and message ids are sent along with the pushes from now on. Negative lastId replays nothing.
+// Returns the number of replayed messages
+func (client *WsClient) Resume(lastId int64) (int, error) {
+	log.WithFields("edge.client", "Resume", lastId).Debug(client.String())
+	session := client.session
+	if client.IsClosed() || session == nil {
+		return 0, errorServerNotFound
+	}
+	if session.guest {
+		return 0, errorGuestSession
+	}
+	atomic.StoreInt32(&client.resumed, 1)
+	if lastId < 0 {
+		return 0, nil
+	}
+	deliveries, ok := session.replay(lastId, client.joinedAt)
+	if !ok {
+		return 0, errorResumeGap
+	}
+	client.enqueue(deliveries)
+	return len(deliveries), nil
+}
+
+// Adds deliveries to the outbox and marks the client for delivery on the next server tick
+func (client *WsClient) enqueue(deliveries []*delivery) bool {
+	server := client.server
+	if client.IsClosed() || server == nil {
+		return false
+	}
+	for _, d := range deliveries {
+		client.outbox.Add(d)
+	}
+	if atomic.CompareAndSwapInt32(&client.pending, 0, 1) {
+		server.dirty.Add(client)
+	}
 	return true
 }
 
+// Drains the outbox and writes all the pending messages ordered by id as a single websocket frame.
+// The caller must have set the flushing flag, see tryFlush
+func (client *WsClient) flush() {
+	defer atomic.StoreInt32(&client.flushing, 0)
+	atomic.StoreInt32(&client.pending, 0)
+	pending := client.outbox.Slice()
+	if len(pending) == 0 {
+		return
+	}
+	deliveries := make([]*delivery, 0, len(pending))
+	for _, docId := range pending {
+		if d, ok := docId.(*delivery); ok {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].id < deliveries[j].id
+	})
+	withIds := atomic.LoadInt32(&client.resumed) == 1
+	var buffer bytes.Buffer
+	w := resp.MakeVersionedWriter(&buffer, client.Protocol())
+	for _, d := range deliveries {
+		topic := d.message.Source.DocId()
+		switch {
+		case d.pattern == "" && withIds:
+			w.WriteMessageWithId(topic, d.message.Content, d.DocId())
+		case d.pattern == "":
+			w.WriteMessage(topic, d.message.Content)
+		case withIds:
+			w.WritePMessageWithId(d.pattern, topic, d.message.Content, d.DocId())
+		default:
+			w.WritePMessage(d.pattern, topic, d.message.Content)
+		}
+	}
+	client.write(ws.OpText, buffer.Bytes())
+}
+
+// Flushes the client in a new goroutine unless a flush is already in progress. Returns false if the client is still flushing
+func (client *WsClient) tryFlush() bool {
+	if !atomic.CompareAndSwapInt32(&client.flushing, 0, 1) {
+		return false
+	}
+	go client.flush()
+	return true
+}
+
+// Writes a websocket frame. Frames are written one at a time
+// Connection is closed if the frame could not be written within WriteTimeout
+func (client *WsClient) write(op ws.OpCode, slice []byte) error {
+	client.wlock.Lock()
+	client.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	err := wsutil.WriteServerMessage(client.Conn, op, slice)
+	client.wlock.Unlock()
+	if err != nil {
+		log.WithFields("edge.client", "write").Debug(client.String(), ", Err: ", err)
+		client.Close()
+	}
+	return err
+}
+
+// Pings the client to keep the connection alive
+func (client *WsClient) ping() {
+	if !client.IsClosed() {
+		log.WithFields("edge.client", "Ping").Debug(client.String())
+		client.write(ws.OpPing, emptyBuffer)
+	}
+}
+
+// Deinit method invoked when client connection is terminated.
 func (client *WsClient) Close() {
 	client.once.Do(func() {
 		log.WithFields("edge.client", "Close").Debug(client.String())
-		client.IsClosed = true
+		atomic.StoreInt32(&client.closed, 1)
 		stats.DecrLive()
-		go func() {
-			client.WChan <- ConnectionClosed
-			client.RChan <- ConnectionClosed
-		}()
+		server := client.server
+		if server != nil {
+			server.poller.Stop(client.Conn)
+			server.clients.Remove(client)
+		}
+		client.Conn.Close()
+		client.deregisterSession()
+		client.deregisterUser()
 	})
 }
 
 func (client *WsClient) registerCommands() {
 	registry := client.cmdRegistry
-	registry.Write("SUBSCRIBE", actions.OnSubscribe(client))
-	registry.Write("UNSUBSCRIBE", actions.OnSubscribe(client))
-}
-
-func (client *WsClient) wsClientRequestsProcessor() {
-	for {
-		time.Sleep(ClientTickInterval)
-		select {
-		case v := <-client.RChan:
-			if v == ConnectionClosed {
-				onConnClose(client)
-				return
-			}
-			break
-		default:
-			bts, _, err := wsutil.ReadClientData(client.Conn)
-			if err != nil {
-				_, ok := err.(wsutil.ClosedError)
-				if err == io.EOF || ok {
-					client.Close()
-				} else {
-					log.WithFields("edge.client").Error(client.String(), ", Err: ", err)
-				}
-				break
-			}
-			go client.executeClientRequest(bts)
+	registry.Write("HELLO", actions.OnHello(client))
+	registry.Write("SUBSCRIBE", actions.OnSubscribe(client, client, client))
+	registry.Write("UNSUBSCRIBE", actions.OnUnsubscribe(client, client))
+	registry.Write("PSUBSCRIBE", actions.OnPSubscribe(client, client, client))
+	registry.Write("PUNSUBSCRIBE", actions.OnPUnsubscribe(client, client))
+	registry.Write("PUBLISH", actions.OnPublish(client, client, client))
+	registry.Write("RESUME", actions.OnResume(client, client))
+	registry.Write("HISTORY", actions.OnHistory(client, client, client))
+	registry.Write("PRESENCE", actions.OnPresence(client, client, client))
+}
+
+// Poller callback invoked when the connection is readable
+// Requests are executed in place, so replies are written in the order requests are received
+func (client *WsClient) onReadable() {
+	bts, err := client.readFrame()
+	if err != nil {
+		if err != io.EOF {
+			log.WithFields("edge.client", "onReadable").Debug(client.String(), ", Err: ", err)
 		}
+		client.Close()
+		return
+	}
+	if bts != nil {
+		client.executeClientRequest(bts)
 	}
 }
 
+// Reads a websocket frame, a single read at a time. Control frames are handled in place.
+// The payload of a large frame is read over several calls, as the connection becomes readable again, so that
+// ReadTimeout bounds every read and not the whole frame, and slow clients do not hold the poller goroutine.
+// Returns the message payload once the final frame of a data message is read, otherwise nil.
+func (client *WsClient) readFrame() ([]byte, error) {
+	if !client.reading {
+		header, err := ws.ReadHeader(client.Conn)
+		if err != nil {
+			return nil, err
+		}
+		if header.Length > MaxMessageSize || int64(len(client.fragments))+header.Length > MaxMessageSize {
+			return nil, errorMessageTooLarge
+		}
+		client.frame, client.payload, client.received, client.reading = header, make([]byte, header.Length), 0, true
+	}
+	if client.received < len(client.payload) {
+		n, err := client.Conn.Read(client.payload[client.received:])
+		client.received += n
+		if err != nil {
+			return nil, err
+		}
+		if client.received < len(client.payload) {
+			return nil, nil
+		}
+	}
+	header, payload := client.frame, client.payload
+	client.payload, client.reading = nil, false
+	if header.Masked {
+		ws.Cipher(payload, header.Mask, 0)
+	}
+	switch header.OpCode {
+	case ws.OpPing:
+		return nil, client.write(ws.OpPong, payload)
+	case ws.OpPong:
+		return nil, nil
+	case ws.OpClose:
+		client.write(ws.OpClose, payload)
+		return nil, io.EOF
+	case ws.OpContinuation:
+		client.fragments = append(client.fragments, payload...)
+	default:
+		client.fragments = payload
+	}
+	if !header.Fin {
+		return nil, nil
+	}
+	payload = client.fragments
+	client.fragments = nil
+	return payload, nil
+}
+
 // RESP Based Command Executor
 func (client *WsClient) executeClientRequest(commandBytes []byte) {
 	log.WithFields("edge.clientRequest").Debug(client.String(), string(commandBytes))
 	cmds, ok := resp.Read(commandBytes)
 	if ok {
 		for _, cmd := range cmds {
-			response := resp.OkResponse
+			var response []byte
 			if cmd.Ok() {
 				executor := commands.MakeExecutor(cmd)
-				result := executor.Execute(client.cmdRegistry)
-				if result != nil {
-					response = resp.ErrorResponse(result.Error())
+				reply, err := executor.Execute(client.cmdRegistry)
+				response = reply
+				if err != nil {
+					response = append(response, resp.ErrorReply(err)...)
 				}
 			} else {
-				response = resp.ErrorResponse(cmd.Error())
+				response = []byte(resp.ErrorResponse(cmd.Error()))
 			}
-			wsutil.WriteServerMessage(client.Conn, ws.OpText, []byte(response))
+			client.write(ws.OpText, response)
 		}
 	} else {
-		wsutil.WriteServerMessage(client.Conn, ws.OpText, []byte(resp.ErrorResponse("Parsing Failed")))
+		client.write(ws.OpText, []byte(resp.ErrorResponse("Parsing Failed")))
 	}
 }
 
-func (client *WsClient) wsServerResponsesProcessor() {
-	var count int64
-	for {
-		time.Sleep(ClientTickInterval)
-		count += 1
-		select {
-		case v := <-client.WChan:
-			if v == ConnectionClosed {
-				onConnClose(client)
-				return
-			}
-			break
-		default:
-			// TODO
-			// if my topics has updates {
-			//  batch up updates to me
-			// }
-			if count == keepAliveCounts {
-				count = 0
-				log.WithFields("edge.client", "Ping").Debug(client.String())
-				wsutil.WriteServerMessage(client.Conn, ws.OpPing, emptyBuffer)
-			}
-		}
-	}
-}
-
-func (client *WsClient) incrUserCount() {
-	//TODO Track User Counts
-	//If user is in dirty list. remove user from it.
-}
-
-func (client *WsClient) decrUserCount() {
-	//TODO Track User Counts
-	//If user count is zero then add the user to dirty list
-	//Dirty sessions will expire after timeout. When they expire user is unsubscribed from all the topics subscribed.
-}
-
-func (client *WsClient) incrSessionCount() {
-	//TODO Track Session Counts
-	//If session is in dirty list. remove session from it.
-}
-
-func (client *WsClient) decrSessionCount() {
-	//TODO Track Session Counts
-	//If session count is zero then add the session to dirty list
-	//Dirty sessions will expire after timeout. When they expire session is unsubscribed from all the topics subscribed.
-}
-
 // Helper function that wraps OnIndex call on the server
 func (client *WsClient) onIndex(indexActionCallback func(docid.ImmutableIndexMap)) {
 	server := client.server
@@ -223,60 +530,64 @@ func (client *WsClient) onIndex(indexActionCallback func(docid.ImmutableIndexMap
 	}
 }
 
-// Adds Session to SessionIdx and Does Session Management
-func (client *WsClient) registerSession() {
-	client.onIndex(func(index docid.ImmutableIndexMap) {
-		index.Add(SessionIdx, func(idx docid.AddIndexEntryWriter) error {
-			return idx.Add(client.SessionId, client)
-		})
-	})
-	if !client.IsGuestSession() {
-		client.incrSessionCount()
+// Adds Session to SessionIdx and acquires the session. Subscriptions of a session that is not expired are restored,
+// those of a session new to the edge are loaded from the DataStore
+func (client *WsClient) registerSession() error {
+	server := client.server
+	if server == nil {
+		return nil
+	}
+	session, err := server.acquireSession(client.SessionId, client.UserId, client.IsGuestSession())
+	if err != nil {
+		return err
 	}
+	server.loadSubscriptions(session)
+	client.session = session
+	// Deliveries are buffered and pushed holding block, so each of them is either buffered before the client joins
+	// and replayed by RESUME or pushed live, never both
+	session.block.Lock()
+	server.indexMap.Add(SessionIdx, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(client.SessionId, client)
+	})
+	client.joinedAt = session.buffered
+	session.block.Unlock()
+	return nil
 }
 
-// Adds User to UserIdx and Does User Management
+// Adds User to UserIdx and acquires the user
 func (client *WsClient) registerUser() {
-	if docid.IsNil(client.UserId) {
+	server := client.server
+	if server == nil || docid.IsNil(client.UserId) {
 		return
 	}
-	client.onIndex(func(index docid.ImmutableIndexMap) {
-		index.Add(UserIdx, func(idx docid.AddIndexEntryWriter) error {
-			return idx.Add(client.UserId, client)
-		})
+	server.indexMap.Add(UserIdx, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(client.UserId, client)
 	})
-	if !client.IsGuestSession() {
-		client.incrUserCount()
-	}
+	server.acquireUser(client.UserId)
 }
 
-// Removes Session from SessionIdx and Does Session Management
+// Removes Session from SessionIdx and releases the session
 func (client *WsClient) deregisterSession() {
-	client.onIndex(func(index docid.ImmutableIndexMap) {
-		index.Remove(SessionIdx, func(idx docid.RemoveIndexEntryWriter) error {
-			return idx.Remove(client.SessionId, client)
-		})
-		if client.IsGuestSession() {
-			index.RemoveValue(TopicIdx, client)
-		} else {
-			client.decrSessionCount()
-		}
+	server := client.server
+	if server == nil || client.session == nil {
+		return
+	}
+	server.indexMap.Remove(SessionIdx, func(idx docid.RemoveIndexEntryWriter) error {
+		return idx.Remove(client.SessionId, client)
 	})
+	server.releaseSession(client.session)
 }
 
-// Removes User from UserIdx and Does User Management
+// Removes User from UserIdx and releases the user
 func (client *WsClient) deregisterUser() {
-	if docid.IsNil(client.UserId) {
+	server := client.server
+	if server == nil || docid.IsNil(client.UserId) {
 		return
 	}
-	client.onIndex(func(index docid.ImmutableIndexMap) {
-		index.Remove(UserIdx, func(idx docid.RemoveIndexEntryWriter) error {
-			return idx.Remove(client.UserId, client)
-		})
+	server.indexMap.Remove(UserIdx, func(idx docid.RemoveIndexEntryWriter) error {
+		return idx.Remove(client.UserId, client)
 	})
-	if !client.IsGuestSession() {
-		client.decrUserCount()
-	}
+	server.releaseUser(client.UserId)
 }
 
 func getNextId() string {
@@ -285,7 +596,7 @@ func getNextId() string {
 
 func getSessionId(claims jwt.MapClaims, connId string) docid.DocId {
 	var docId docid.DocId
-	docId = &docid.StrId{Id: connId}
+	docId = &docid.StrId{Id: guestSessionPrefix + connId}
 	if claims != nil {
 		sid, ok := claims["sid"].(string)
 		if ok {
@@ -306,19 +617,3 @@ func getUserId(claims jwt.MapClaims) docid.DocId {
 	}
 	return docId
 }
-
-// Deinit method invoked when client connection is terminated.
-func onConnClose(client *WsClient) {
-	state := atomic.AddInt32(&client.state, 1)
-	if state == 2 {
-		log.WithFields("edge.client", "Conn.Close").Debug(client.String())
-		client.Conn.Close()
-		close(client.WChan)
-		close(client.RChan)
-		client.deregisterSession()
-		client.deregisterUser()
-		client.cmdRegistry.Close()
-		client.cmdRegistry = nil
-		client.server = nil
-	}
-}
@@ -7,15 +7,24 @@ package client
 import (
 	"github.com/gorilla/websocket"
 	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/utils"
 	"net/http"
 )
 
+var (
+	AllowedOrigins []string // Origin header allow-list e.g. https://*.example.com. Empty allows every origin
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     checkOrigin,
+}
+
+// Requests without Origin are from non browser clients and are allowed
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || utils.OriginAllowed(AllowedOrigins, origin)
 }
 
 func Handler(w http.ResponseWriter, r *http.Request, reader MessageReader) {
@@ -8,14 +8,11 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pigeond-io/pigeond/common/log"
 	. "github.com/pigeond-io/pigeond/edge/client"
-	"github.com/pigeond-io/pigeond/edge/hub"
 )
 
 type DefaultMessageReader struct {
 }
 
-var hubSender *hub.Sender
-
 func (reader DefaultMessageReader) Read(conn *websocket.Conn, messageBytes []byte) {
 	log.Info("Received message: ", string(messageBytes))
 
@@ -27,8 +24,7 @@ func (reader DefaultMessageReader) Read(conn *websocket.Conn, messageBytes []byt
 		Subscribe(conn, message.Topic)
 		break
 	case PUBLISH:
-		hubSender, _ = hub.GetSender()
-		hubSender.Send(string(messageBytes))
+		Publish(message.Topic, message.Data)
 		break
 	}
 }
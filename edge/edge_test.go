@@ -0,0 +1,213 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge_test
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/gorilla/websocket"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/datastore"
+	"github.com/pigeond-io/pigeond/edge"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Frames taking longer than a read are read over several reads, see TestSlowFrame
+	edge.ReadTimeout = 100 * time.Millisecond
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+}
+
+func serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := edge.MakeWsServer(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, address string) *wsClient {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsClient{conn}
+}
+
+func command(strs ...string) []byte {
+	var buffer bytes.Buffer
+	resp.MakeWriter(&buffer).WriteStrings(strs...)
+	return buffer.Bytes()
+}
+
+func (c *wsClient) send(t *testing.T, strs ...string) {
+	if err := c.conn.WriteMessage(websocket.TextMessage, command(strs...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads a websocket frame and checks the values it carries
+func (c *wsClient) expect(t *testing.T, expected ...string) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, frame, err := c.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	reader := bufio.NewReader(bytes.NewReader(frame))
+	for {
+		value, err := resp.ReadValue(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value.String())
+	}
+	if strings.Join(values, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected %v got %v", expected, values)
+	}
+}
+
+func TestPublishFansOut(t *testing.T) {
+	address := serve(t)
+	subscribers := []*wsClient{dial(t, address), dial(t, address), dial(t, address)}
+	for _, subscriber := range subscribers {
+		defer subscriber.conn.Close()
+		subscriber.send(t, "SUBSCRIBE", "news")
+		subscriber.expect(t, "*[subscribe news 1]")
+	}
+	publisher := dial(t, address)
+	defer publisher.conn.Close()
+	publisher.send(t, "PUBLISH", "news", "hello")
+	publisher.expect(t, "3")
+	for _, subscriber := range subscribers {
+		subscriber.expect(t, "*[message news hello]")
+	}
+	publisher.send(t, "PUBLISH", "sports", "goal")
+	publisher.expect(t, "0")
+}
+
+func TestPushesAreBatched(t *testing.T) {
+	address := serve(t)
+	subscriber := dial(t, address)
+	defer subscriber.conn.Close()
+	subscriber.send(t, "SUBSCRIBE", "news", "sports")
+	subscriber.expect(t, "*[subscribe news 1]", "*[subscribe sports 2]")
+	publisher := dial(t, address)
+	defer publisher.conn.Close()
+
+	// Requests of a frame are executed in order, the pushes of a tick go out as a single frame
+	batch := append(command("PUBLISH", "news", "a", "b"), command("PUBLISH", "sports", "c")...)
+	if err := publisher.conn.WriteMessage(websocket.TextMessage, batch); err != nil {
+		t.Fatal(err)
+	}
+	publisher.expect(t, "1")
+	publisher.expect(t, "1")
+	subscriber.expect(t, "*[message news a]", "*[message news b]", "*[message sports c]")
+}
+
+func TestClosedClientsReceiveNothing(t *testing.T) {
+	address := serve(t)
+	subscriber := dial(t, address)
+	subscriber.send(t, "SUBSCRIBE", "news")
+	subscriber.expect(t, "*[subscribe news 1]")
+	closing := dial(t, address)
+	closing.send(t, "SUBSCRIBE", "news")
+	closing.expect(t, "*[subscribe news 1]")
+
+	// Close handshake is answered with a close frame
+	closing.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	closing.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := closing.conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected close frame got %v", err)
+	}
+	closing.conn.Close()
+	subscriber.conn.Close()
+
+	publisher := dial(t, address)
+	defer publisher.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		publisher.send(t, "PUBLISH", "news", "hello")
+		publisher.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, reply, err := publisher.conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) == ":0\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Closed clients still receive, reply %q", reply)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowFrame(t *testing.T) {
+	address := serve(t)
+	client := dial(t, address)
+	defer client.conn.Close()
+
+	// Masked text frame trickled over several read timeouts
+	payload := command("SUBSCRIBE", strings.Repeat("t", 80))
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	raw := client.conn.UnderlyingConn()
+	for i := 0; i < len(frame); i += 30 {
+		end := i + 30
+		if end > len(frame) {
+			end = len(frame)
+		}
+		if _, err := raw.Write(frame[i:end]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(edge.ReadTimeout / 2)
+	}
+	client.expect(t, "*[subscribe "+strings.Repeat("t", 80)+" 1]")
+}
+
+func TestHistoryReadsOlderMessagesFromDataStore(t *testing.T) {
+	store := datastore.MakeMemoryStore()
+	stored := &docid.Message{Content: []byte("old"), Timestamp: 1000}
+	stored.Id = "stored"
+	store.Append("news", stored)
+	edge.DataStore = store
+	defer func() { edge.DataStore = nil }()
+
+	// Cold edge retains nothing yet
+	client := dial(t, serve(t))
+	defer client.conn.Close()
+	client.send(t, "HISTORY", "news", "5")
+	client.expect(t, "*[*[stored 1000 old]]")
+	client.send(t, "HISTORY", "news", "5", "2000")
+	client.expect(t, "*[]")
+}
+
+func TestPresenceIsPerEdge(t *testing.T) {
+	client := dial(t, serve(t))
+	defer client.conn.Close()
+	client.send(t, "PRESENCE", "news")
+	client.expect(t, "*[edge *[]]")
+}
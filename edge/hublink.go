@@ -0,0 +1,97 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/events"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/hub"
+)
+
+var (
+	HubAddress = ""               // Address of the hub routing messages between edges
+	Membership cluster.Membership // Cluster membership. Edge links to every alive hub when HubAddress is empty
+)
+
+/*
+	Edges are linked through the hubs.
+	The hubs learn the interest set of the edge, the topics and patterns subscribed by at least one session of the edge.
+	Messages published by the clients of the edge are forwarded to the hubs, which forward them to the other interested edges.
+	With a membership each topic is owned by one hub, see hub.Router. Presence events are local to the edge and are not forwarded.
+	Edge runs standalone when there is neither HubAddress nor Membership.
+*/
+
+// Links the server to the hubs. The links connect in the background and reconnect when they fail
+func (server *WsServer) connectHub() error {
+	link, err := hub.MakeLink(HubAddress, Membership, "", server.onHubMessage)
+	if err != nil || link == nil {
+		return err
+	}
+	server.hub = link
+	return nil
+}
+
+// Publishes the message forwarded by the hub to the local subscribers
+func (server *WsServer) onHubMessage(topic string, msg []byte) {
+	server.Publish(topic, events.MakeSliceMessage(msg))
+}
+
+// Forwards msgs published by a client of the edge to the hub
+func (server *WsServer) forward(topic string, msgs ...events.Message) {
+	if server.hub == nil || isPresenceTopic(topic) {
+		return
+	}
+	payloads := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		payloads = append(payloads, msg.Body())
+	}
+	err := server.hub.Publish(topic, payloads...)
+	if err != nil {
+		log.WithFields("edge.hublink", "forward", topic).Error(err)
+	}
+}
+
+// Registers topic interest with the hub when the first session of the edge subscribes to it.
+// Hub commands are sent holding ilock, so that the hub sees them in the order of the interest changes
+func (server *WsServer) addInterest(topic string) {
+	if server.hub == nil || isPresenceTopic(topic) {
+		return
+	}
+	server.ilock.Lock()
+	server.interest[topic]++
+	if server.interest[topic] == 1 {
+		server.hubCommand(server.hub.Subscribe, topic)
+	}
+	server.ilock.Unlock()
+}
+
+// Deregisters topic interest with the hub when the last session of the edge unsubscribes from it
+func (server *WsServer) removeInterest(topic string) {
+	if server.hub == nil || isPresenceTopic(topic) {
+		return
+	}
+	server.ilock.Lock()
+	count, ok := server.interest[topic]
+	if count > 1 {
+		server.interest[topic] = count - 1
+	} else {
+		delete(server.interest, topic)
+	}
+	if ok && count <= 1 {
+		server.hubCommand(server.hub.Unsubscribe, topic)
+	}
+	server.ilock.Unlock()
+}
+
+func (server *WsServer) hubCommand(command func(...string) error, args ...string) {
+	if server.hub == nil {
+		return
+	}
+	err := command(args...)
+	if err != nil {
+		log.WithFields("edge.hublink", "hubCommand").Error(args, ", Err: ", err)
+	}
+}
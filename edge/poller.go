@@ -0,0 +1,28 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ReadTimeout         = 5 * time.Second // Max time a read waits once the connection is readable. Large frames take several reads
+	WriteTimeout        = 5 * time.Second // Max time to write a frame
+	errorNotWatched     = errors.New("Connection not watched")
+	errorAlreadyWatched = errors.New("Connection already watched")
+)
+
+// Poller notifies when connections have data to be read.
+// Idle connections are parked in the poller and do not hold any goroutine.
+type Poller interface {
+	// Starts watching conn. onReadable is invoked each time conn has data to be read.
+	// onReadable is never invoked concurrently for the same conn.
+	Start(conn net.Conn, onReadable func()) error
+	// Stops watching conn. Must be called before closing conn.
+	Stop(conn net.Conn) error
+}
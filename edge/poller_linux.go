@@ -0,0 +1,143 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+//go:build linux
+// +build linux
+
+package edge
+
+import (
+	"errors"
+	"github.com/pigeond-io/pigeond/common/log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	epollReadEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+	epollBatchSize  = 1024
+)
+
+var (
+	errorUnsupportedConn = errors.New("Connection does not expose file descriptor")
+)
+
+type epollDesc struct {
+	fd         int
+	conn       net.Conn
+	onReadable func()
+	lock       sync.Mutex // Orders the onReadable calls, so that each sees the reads of the previous one
+}
+
+/*
+  Epoll based implementation of Poller interface.
+  Connections are registered as one shot. They are re-armed once onReadable returns,
+  so that a connection is never read by two goroutines at the same time.
+*/
+type EpollPoller struct {
+	fd    int                // Epoll file descriptor
+	descs map[int]*epollDesc // Watched connections keyed with file descriptor
+	lock  sync.RWMutex       //ReadWrite synchronization mutex
+}
+
+func MakePoller() (Poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	poller := &EpollPoller{
+		fd:    fd,
+		descs: make(map[int]*epollDesc),
+	}
+	go poller.wait()
+	return poller, nil
+}
+
+func (p *EpollPoller) Start(conn net.Conn, onReadable func()) error {
+	fd, err := connFd(conn)
+	if err != nil {
+		return err
+	}
+	l := &p.lock
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := p.descs[fd]; ok {
+		return errorAlreadyWatched
+	}
+	err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: epollReadEvents, Fd: int32(fd)})
+	if err == nil {
+		p.descs[fd] = &epollDesc{fd: fd, conn: conn, onReadable: onReadable}
+	}
+	return err
+}
+
+func (p *EpollPoller) Stop(conn net.Conn) error {
+	fd, err := connFd(conn)
+	if err != nil {
+		return err
+	}
+	l := &p.lock
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := p.descs[fd]; !ok {
+		return errorNotWatched
+	}
+	delete(p.descs, fd)
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{})
+}
+
+// Poller run loop that dispatches readable connections
+func (p *EpollPoller) wait() {
+	events := make([]syscall.EpollEvent, epollBatchSize)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.WithFields("edge.poller").Fatal(err)
+		}
+		l := &p.lock
+		l.RLock()
+		for i := 0; i < n; i++ {
+			desc, ok := p.descs[int(events[i].Fd)]
+			if ok {
+				go p.dispatch(desc)
+			}
+		}
+		l.RUnlock()
+	}
+}
+
+// Invokes onReadable and re-arms the connection unless it was stopped in the meantime
+func (p *EpollPoller) dispatch(desc *epollDesc) {
+	desc.lock.Lock()
+	desc.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	desc.onReadable()
+	desc.lock.Unlock()
+	l := &p.lock
+	l.RLock()
+	if p.descs[desc.fd] == desc {
+		syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, desc.fd, &syscall.EpollEvent{Events: epollReadEvents, Fd: int32(desc.fd)})
+	}
+	l.RUnlock()
+}
+
+func connFd(conn net.Conn) (int, error) {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, errorUnsupportedConn
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	err = rawConn.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+	})
+	return fd, err
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package edge
+
+import (
+	"net"
+	"sync"
+)
+
+/*
+  Portable implementation of Poller interface.
+  It parks a goroutine per connection in a blocking read and is used where epoll is not available.
+*/
+type GoroutinePoller struct {
+	conns map[net.Conn]chan bool // Stop channels keyed with connection
+	lock  sync.Mutex
+}
+
+func MakePoller() (Poller, error) {
+	return &GoroutinePoller{conns: make(map[net.Conn]chan bool)}, nil
+}
+
+func (p *GoroutinePoller) Start(conn net.Conn, onReadable func()) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.conns[conn]; ok {
+		return errorAlreadyWatched
+	}
+	stop := make(chan bool)
+	p.conns[conn] = stop
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				onReadable()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *GoroutinePoller) Stop(conn net.Conn) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stop, ok := p.conns[conn]
+	if !ok {
+		return errorNotWatched
+	}
+	delete(p.conns, conn)
+	close(stop)
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"github.com/pigeond-io/pigeond/common/events"
+	"sort"
+	"strings"
+)
+
+var (
+	PresencePrefix = "__presence__:" // Presence events of a topic are published on the topic prefixed with PresencePrefix
+)
+
+/*
+	Presence of a topic is the set of distinct users whose sessions on the edge are subscribed to the topic.
+	Presence is per edge, the hubs forward neither the presence events nor the subscribed users, so users connected
+	to other edges are not present. PRESENCE names that scope in its reply.
+	A user is present as long as one of its sessions is subscribed, so multiple tabs collapse into a single entry.
+	Sessions keep their subscriptions for SessionGracePeriod after their last connection is closed,
+	hence a user leaves the topic once it unsubscribes or its last session expires.
+
+	Clients opt in for presence events by subscribing to the presence topic, e.g. SUBSCRIBE __presence__:room1
+	Events are published as messages with payload "join <uid>" or "leave <uid>"
+*/
+
+// Presence topic of the topic
+func presenceTopic(topic string) string {
+	return PresencePrefix + topic
+}
+
+func isPresenceTopic(topic string) bool {
+	return strings.HasPrefix(topic, PresencePrefix)
+}
+
+// Counts a session of the user subscribed to the topic. Publishes the join event on the user's first session
+func (server *WsServer) joinTopic(topic string, userId string) {
+	if userId == "" || isPresenceTopic(topic) {
+		return
+	}
+	server.prlock.Lock()
+	users, ok := server.presence[topic]
+	if !ok {
+		users = make(map[string]int)
+		server.presence[topic] = users
+	}
+	users[userId]++
+	joined := users[userId] == 1
+	server.prlock.Unlock()
+	if joined {
+		server.Publish(presenceTopic(topic), events.MakeSliceMessage([]byte("join "+userId)))
+	}
+}
+
+// Uncounts a session of the user subscribed to the topic. Publishes the leave event once the user has no sessions left
+func (server *WsServer) leaveTopic(topic string, userId string) {
+	if userId == "" || isPresenceTopic(topic) {
+		return
+	}
+	server.prlock.Lock()
+	users := server.presence[topic]
+	count, ok := users[userId]
+	if ok {
+		count--
+		if count > 0 {
+			users[userId] = count
+		} else {
+			delete(users, userId)
+		}
+		if len(users) == 0 {
+			delete(server.presence, topic)
+		}
+	}
+	server.prlock.Unlock()
+	if ok && count <= 0 {
+		server.Publish(presenceTopic(topic), events.MakeSliceMessage([]byte("leave "+userId)))
+	}
+}
+
+// Distinct ids of the users subscribed to the topic in sorted order
+func (server *WsServer) Presence(topic string) []string {
+	server.prlock.RLock()
+	users := make([]string, 0, len(server.presence[topic]))
+	for userId := range server.presence[topic] {
+		users = append(users, userId)
+	}
+	server.prlock.RUnlock()
+	sort.Strings(users)
+	return users
+}
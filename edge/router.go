@@ -8,31 +8,13 @@ import (
 	"github.com/pigeond-io/pigeond/common/log"
 	"github.com/pigeond-io/pigeond/edge/client"
 	"github.com/pigeond-io/pigeond/edge/client/message"
-	"github.com/pigeond-io/pigeond/edge/hub"
 	"net/http"
 	"strconv"
-	"sync"
 )
 
-func Init(wsPort int, udpPort int, bufferSize int) {
+func Init(wsPort int) {
 	log.Info("Edge server initialization started....")
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		initClientListener(wsPort)
-	}()
-
-	go func() {
-		defer wg.Done()
-		initHubListener(udpPort, bufferSize)
-	}()
-
-	log.Info("Edge server initialization done ")
-
-	wg.Wait()
+	initClientListener(wsPort)
 }
 
 func initClientListener(port int) {
@@ -46,7 +28,3 @@ func initClientListener(port int) {
 	response := http.ListenAndServe(addr, nil)
 	log.Fatal(response)
 }
-
-func initHubListener(port int, bufferSize int) {
-	hub.Listen(port, bufferSize)
-}
@@ -5,34 +5,69 @@
 package edge
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gobwas/ws"
+	"github.com/pigeond-io/pigeond/common/auth"
 	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/events"
 	"github.com/pigeond-io/pigeond/common/log"
 	"github.com/pigeond-io/pigeond/common/stats"
+	"github.com/pigeond-io/pigeond/common/utils"
+	"github.com/pigeond-io/pigeond/hub"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	KeepAliveInterval         = 1 * time.Minute
-	allowAnonymousConnections = true
-	jwtSecretKey              = []byte("PigeondJWTSecretKey")
+	HistorySize               = 100              // Messages retained per topic for HISTORY. Zero disables the history
+	HistoryAge                = 10 * time.Minute // Max age of the messages retained per topic. Zero retains messages regardless of their age
+	AllowAnonymousConnections = true
+	AllowedHosts              []string      // Host header allow-list e.g. ws.example.com, *.example.com. Empty allows every host
+	AllowedOrigins            []string      // Origin header allow-list e.g. https://*.example.com. Empty allows every origin
+	TokenVerifier             auth.Verifier // Verifies the jwt tokens. When nil every token is rejected
+	errorNoTokenVerifier      = errors.New("Token verification is not configured")
 )
 
 const (
 	SessionIdx int = iota
 	UserIdx
 	TopicIdx
+	PatternIdx
 )
 
 type WsServer struct {
 	indexMap docid.ImmutableIndexMap
 	listener net.Listener
+	poller   Poller             // Notifies when client connections are readable
+	clients  *docid.HashSet     // Live clients
+	dirty    docid.DoubleBuffer // Clients with messages pending delivery
+	patterns map[string]int     // Subscribed patterns along with the subscribers count
+	plock    sync.RWMutex       // Patterns synchronization mutex
+
+	sessions    map[string]*Session // Live and dirty sessions
+	sessionRefs *refCounter         // Connections count of the sessions
+	userRefs    *refCounter         // Connections count of the users
+	slock       sync.Mutex          // Sessions and users synchronization mutex
+	seq         int64               // Id of the last published message
+
+	history map[string]*docid.MessageRing // Recent messages of the topics
+	hlock   sync.RWMutex                  // History synchronization mutex
+
+	presence map[string]map[string]int // Users present in the topics along with the count of their subscribed sessions
+	prlock   sync.RWMutex              // Presence synchronization mutex
+
+	hub      hub.Link       // Link to the hubs. nil for standalone edge
+	interest map[string]int // Topics subscribed on the edge along with the count of subscribed sessions
+	ilock    sync.Mutex     // Interest synchronization mutex
 }
 
 // Zero-copy Upgrade Websocket Server which allows both anonymous and jwt based authorized connections.
@@ -43,11 +78,60 @@ func InitWsServer(address string) {
 	if err != nil {
 		log.WithFields("edge.server").Fatal(err)
 	}
+	server, err := MakeWsServer(listener)
+	if err != nil {
+		log.WithFields("edge.server").Fatal(err)
+	}
+	if SnapshotFile != "" {
+		if err = server.restoreSnapshot(); err != nil {
+			log.WithFields("edge.server").Error("Snapshot not restored, Err: ", err)
+		}
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go server.snapshotIndex(stop, stopped)
+		utils.OnProcessExit(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+	log.WithFields("edge.server").Fatal(server.Serve())
+}
+
+// Makes a WsServer accepting the connections of listener, linked to the hubs configured with HubAddress or Membership
+func MakeWsServer(listener net.Listener) (*WsServer, error) {
+	poller, err := MakePoller()
+	if err != nil {
+		return nil, err
+	}
 	server := &WsServer{
-		indexMap: docid.MakeImmutableIndexMap(SessionIdx, UserIdx, TopicIdx),
+		indexMap: docid.MakeImmutableIndexMap(SessionIdx, UserIdx, TopicIdx, PatternIdx),
 		listener: listener,
+		poller:   poller,
+		clients:  docid.MakeHashSet(nil),
+		dirty:    docid.MakeSliceDoubleBuffer(),
+		patterns: make(map[string]int),
+
+		sessions:    make(map[string]*Session),
+		sessionRefs: makeRefCounter(),
+		userRefs:    makeRefCounter(),
+		seq:         time.Now().UnixNano(), // Message ids keep increasing across restarts
+
+		history: make(map[string]*docid.MessageRing),
+
+		presence: make(map[string]map[string]int),
+
+		interest: make(map[string]int),
 	}
-	server.acceptWsClients()
+	if err = server.connectHub(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Delivers the messages and accepts the client connections until the listener fails. Returns the listener error
+func (server *WsServer) Serve() error {
+	go server.deliverUpdates()
+	go server.reapSessions()
+	return server.acceptWsClients()
 }
 
 // Public interface for clients to perform action on Server Index
@@ -55,20 +139,260 @@ func (server *WsServer) OnIndex(indexActionCallback func(docid.ImmutableIndexMap
 	indexActionCallback(server.indexMap)
 }
 
-// Server run loop that accepts new client connections
-func (server *WsServer) acceptWsClients() {
+// Publishes msgs to all the clients whose session is subscribed to topic or to a pattern matching the topic.
+// Messages are buffered in the subscribed sessions for replay. Returns the number of receivers
+func (server *WsServer) Publish(topic string, msgs ...events.Message) (int, bool) {
+	source := &docid.StrId{Id: topic}
+	now := time.Now()
+	deliveries := make([]*delivery, 0, len(msgs))
+	for _, msg := range msgs {
+		id := atomic.AddInt64(&server.seq, 1)
+		// The message id is the delivery id, so that the history replies the ids the messages were pushed with
+		message := &docid.Message{Source: source, Content: msg.Body(), Timestamp: now.Unix()}
+		message.Id = strconv.FormatInt(id, 10)
+		deliveries = append(deliveries, &delivery{id: id, at: now, message: message})
+	}
+	server.recordHistory(topic, deliveries)
+	receivers, err := server.deliver(TopicIdx, source, func(session *Session) bool {
+		return session.IsSubscribed(topic)
+	}, deliveries)
+	if err != nil {
+		log.WithFields("edge.server", "Publish", topic).Error(err)
+		return 0, false
+	}
+	for _, pattern := range server.matchingPatterns(topic) {
+		pdeliveries := make([]*delivery, 0, len(deliveries))
+		for _, d := range deliveries {
+			pdeliveries = append(pdeliveries, &delivery{id: d.id, at: d.at, message: d.message, pattern: pattern})
+		}
+		count, err := server.deliver(PatternIdx, &docid.StrId{Id: pattern}, func(session *Session) bool {
+			return session.IsPSubscribed(pattern)
+		}, pdeliveries)
+		if err != nil {
+			log.WithFields("edge.server", "Publish", topic).Error(err)
+			return receivers, false
+		}
+		receivers += count
+	}
+	return receivers, true
+}
+
+// Retains the delivered messages in the history of the topic. History is disabled if HistorySize is zero
+func (server *WsServer) recordHistory(topic string, deliveries []*delivery) {
+	if HistorySize <= 0 || len(deliveries) == 0 {
+		return
+	}
+	server.hlock.RLock()
+	ring, ok := server.history[topic]
+	server.hlock.RUnlock()
+	if !ok {
+		server.hlock.Lock()
+		ring, ok = server.history[topic]
+		if !ok {
+			ring = docid.MakeMessageRing(HistorySize, HistoryAge)
+			server.history[topic] = ring
+		}
+		server.hlock.Unlock()
+	}
+	for _, d := range deliveries {
+		ring.Add(d.message)
+	}
+}
+
+// Returns at most count latest messages published on topic since the unix timestamp, oldest first.
+// Non positive count returns all the retained messages. Older messages are read from the DataStore, see storedHistory
+func (server *WsServer) History(topic string, count int, since int64) []*docid.Message {
+	server.hlock.RLock()
+	ring, ok := server.history[topic]
+	server.hlock.RUnlock()
+	var messages []*docid.Message
+	if ok {
+		messages = ring.Last(count, since)
+	}
+	if DataStore == nil || (count > 0 && len(messages) >= count) {
+		return messages
+	}
+	return append(storedHistory(topic, count, since, messages), messages...)
+}
+
+// Forgets the topics whose retained messages are all expired
+func (server *WsServer) trimHistory() {
+	server.hlock.Lock()
+	for topic, ring := range server.history {
+		if ring.Len() == 0 {
+			delete(server.history, topic)
+		}
+	}
+	server.hlock.Unlock()
+}
+
+// Id of the last published message
+func (server *WsServer) lastMessageId() int64 {
+	return atomic.LoadInt64(&server.seq)
+}
+
+// Buffers deliveries in the subscribed sessions indexed with key in the index and queues them
+// in the outbox of the live clients of those sessions. Returns the number of clients
+func (server *WsServer) deliver(indexName int, key docid.DocId, subscribed func(*Session) bool, deliveries []*delivery) (int, error) {
+	var sessions []*Session
+	err := server.forEachDocId(indexName, key, func(docId docid.DocId) {
+		session, ok := docId.(*Session)
+		if ok && subscribed(session) {
+			sessions = append(sessions, session)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	visited := make(map[string]bool)
+	for _, session := range sessions {
+		// Clients joining the session meanwhile wait, see registerSession
+		session.block.Lock()
+		session.bufferDeliveries(deliveries)
+		err = server.forEachDocId(SessionIdx, session, func(docId docid.DocId) {
+			client, ok := docId.(*WsClient)
+			if !ok || visited[client.DocId()] {
+				return
+			}
+			visited[client.DocId()] = true
+			if client.enqueue(deliveries) {
+				count++
+			}
+		})
+		session.block.Unlock()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Invokes callback for each value indexed with key in the index
+func (server *WsServer) forEachDocId(indexName int, key docid.DocId, callback func(docid.DocId)) error {
+	publisher, err := server.indexMap.Query(indexName, key)
+	if err != nil {
+		return err
+	}
+	channel := make(chan []docid.DocId)
+	publisher.Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, docId := range slice {
+			callback(docId)
+		}
+	}
+	close(channel)
+	return nil
+}
+
+// Invoked when a session subscribes to the topic
+func (server *WsServer) onSubscribe(topic string, session *Session) {
+	server.addInterest(topic)
+	server.joinTopic(topic, session.userId)
+}
+
+// Invoked when a session unsubscribes from the topic
+func (server *WsServer) onUnsubscribe(topic string, session *Session) {
+	server.removeInterest(topic)
+	server.leaveTopic(topic, session.userId)
+}
+
+// Registers a pattern subscription. Pattern interest is registered with the hub on the first subscription.
+// Hub commands are sent holding plock, so that the hub sees them in the order of the subscription changes
+func (server *WsServer) addPattern(pattern string) {
+	server.plock.Lock()
+	server.patterns[pattern]++
+	if server.patterns[pattern] == 1 && server.hub != nil {
+		server.hubCommand(server.hub.PSubscribe, pattern)
+	}
+	server.plock.Unlock()
+}
+
+// Deregisters a pattern subscription. Pattern is forgotten once it has no subscribers
+func (server *WsServer) removePattern(pattern string) {
+	server.plock.Lock()
+	count := server.patterns[pattern] - 1
+	if count > 0 {
+		server.patterns[pattern] = count
+	} else {
+		delete(server.patterns, pattern)
+	}
+	if count <= 0 && server.hub != nil {
+		server.hubCommand(server.hub.PUnsubscribe, pattern)
+	}
+	server.plock.Unlock()
+}
+
+// Subscribed patterns matching the topic
+func (server *WsServer) matchingPatterns(topic string) []string {
+	var patterns []string
+	server.plock.RLock()
+	for pattern := range server.patterns {
+		if utils.GlobMatch(pattern, topic) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	server.plock.RUnlock()
+	return patterns
+}
+
+// Server run loop that accepts new client connections. Returns once the listener fails for good, e.g. when closed
+func (server *WsServer) acceptWsClients() error {
 	listener := server.listener
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			stats.IncrFailed()
 			log.WithFields("edge.server").Error(err)
+			if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+				return err
+			}
 		} else {
 			go server.initWsClient(conn)
 		}
 	}
 }
 
+// Server run loop that flushes pending messages of clients every ClientTickInterval and pings clients every KeepAliveInterval
+func (server *WsServer) deliverUpdates() {
+	ticker := time.NewTicker(ClientTickInterval)
+	lastPing := time.Now()
+	for now := range ticker.C {
+		for _, docId := range server.dirty.Slice() {
+			client, ok := docId.(*WsClient)
+			// A client still writing the previous batch is retried on the next tick, so batches are written in order
+			if ok && !client.tryFlush() {
+				server.dirty.Add(client)
+			}
+		}
+		if now.Sub(lastPing) >= KeepAliveInterval {
+			lastPing = now
+			go server.pingClients()
+		}
+	}
+}
+
+// Pings all the live clients
+func (server *WsServer) pingClients() {
+	channel := make(chan []docid.DocId)
+	server.clients.Members().Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, docId := range slice {
+			client, ok := docId.(*WsClient)
+			if ok {
+				client.ping()
+			}
+		}
+	}
+	close(channel)
+}
+
 // Initiating a Websocket Connection
 // This method enables tcp keep alive, upgrades the connection to websocket, parses and validates the jwt token if provided and initiate the wsclient
 func (server *WsServer) initWsClient(conn net.Conn) {
@@ -82,6 +406,7 @@ func (server *WsServer) initWsClient(conn net.Conn) {
 	var token string
 	wsUpgrader := ws.Upgrader{
 		OnRequest:       onWsUpgradeRequest(&token),
+		OnHeader:        onWsUpgradeHeader,
 		OnBeforeUpgrade: beforeWsUpgrade,
 	}
 	_, err := wsUpgrader.Upgrade(conn)
@@ -90,7 +415,7 @@ func (server *WsServer) initWsClient(conn net.Conn) {
 		return
 	}
 	if token == "" {
-		if !allowAnonymousConnections {
+		if !AllowAnonymousConnections {
 			terminateConnection(conn, "Anonymous Connections Not Allowed")
 		} else {
 			InitWsClient(server, conn, nil)
@@ -109,9 +434,14 @@ func (server *WsServer) initWsClient(conn net.Conn) {
 	}
 }
 
-// TODO: Add the Host Check
 func isHostOk(host string) bool {
-	return true
+	return utils.HostAllowed(AllowedHosts, host)
+}
+
+// Browsers always send the Origin header, it is checked to prevent cross-site websocket hijacking.
+// Requests without Origin are from non browser clients and are not checked
+func isOriginOk(origin string) bool {
+	return utils.OriginAllowed(AllowedOrigins, origin)
 }
 
 // Terminates the connection on Error
@@ -122,18 +452,12 @@ func terminateConnection(conn net.Conn, err interface{}) {
 	return
 }
 
-// Parses the JWT token
-// TODO: Define & Validate Manadatory JWT Claims Fields
+// Parses & verifies the JWT token using the configured TokenVerifier
 func parseToken(token string) (*jwt.Token, error) {
-	log.WithFields("edge.server").Debug("Token: %s", token)
-	jToken, err := jwt.Parse(token,
-		func(jToken *jwt.Token) (interface{}, error) {
-			if _, ok := jToken.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", jToken.Header["alg"])
-			}
-			return jwtSecretKey, nil
-		})
-	return jToken, err
+	if TokenVerifier == nil {
+		return nil, errorNoTokenVerifier
+	}
+	return TokenVerifier.Parse(token)
 }
 
 // Before WebSocket Uprade OnRequest Callback
@@ -141,7 +465,7 @@ func parseToken(token string) (*jwt.Token, error) {
 func onWsUpgradeRequest(token *string) func([]byte, []byte) (error, int) {
 	return func(host, uri []byte) (err error, code int) {
 		if !isHostOk(string(host)) {
-			return fmt.Errorf("Bad Request"), 403
+			return fmt.Errorf("Host %q is not allowed", host), http.StatusForbidden
 		}
 		urlObj, err := url.Parse(string(uri))
 		if err == nil {
@@ -153,6 +477,15 @@ func onWsUpgradeRequest(token *string) func([]byte, []byte) (error, int) {
 	}
 }
 
+// Before WebSocket Uprade OnHeader Callback
+// Here we check the Origin header
+func onWsUpgradeHeader(key, value []byte) (err error, code int) {
+	if http.CanonicalHeaderKey(string(key)) == "Origin" && !isOriginOk(string(value)) {
+		return fmt.Errorf("Origin %q is not allowed", value), http.StatusForbidden
+	}
+	return
+}
+
 // Before WebSocket Uprade OnUpgrade Callback
 // We modify the response headers to add X-Server tag
 func beforeWsUpgrade() (headerWriter func(io.Writer), err error, code int) {
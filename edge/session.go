@@ -0,0 +1,375 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"errors"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SessionGracePeriod  = 2 * time.Minute  // Time a session without connections keeps its subscriptions
+	SessionReapInterval = 10 * time.Second // Interval at which expired sessions and users are reaped
+	SessionBufferSize   = 1000             // Max messages buffered per session for replay on resume
+	SessionBufferAge    = 2 * time.Minute  // Max age of the messages buffered per session for replay on resume
+)
+
+const guestSessionPrefix = "guest:" // Prefix of the guest session ids, so that they never collide with the jwt sids
+
+var (
+	errorSessionMismatch = errors.New("Session id is taken by a session of another kind")
+)
+
+// Session owns the topics and patterns subscribed by its connections.
+// A guest session belongs to a single connection and ends with it, its id is the connection id prefixed with guestSessionPrefix.
+// Other sessions are reference counted and once their last connection is closed they are added to the dirty list.
+// Dirty sessions expire after SessionGracePeriod and are then unsubscribed from all their topics and patterns,
+// unless a connection of the session comes back in the meantime.
+// Messages delivered to a session that is not a guest are buffered, so that a resumed connection can replay the ones it missed.
+type Session struct {
+	docid.StrId
+	guest    bool
+	userId   string          // User of the session. Empty for anonymous sessions
+	topics   map[string]bool // Topics subscribed by the session
+	patterns map[string]bool // Patterns subscribed by the session
+	lock     sync.RWMutex    // Topics and Patterns synchronization mutex
+	buffer   []*delivery     // Recent deliveries from head on, oldest first
+	head     int             // Index of the oldest delivery still buffered. Evicted ones before it are compacted away lazily
+	evicted  int64           // Highest id of the deliveries evicted from the buffer
+	buffered int64           // Count of the deliveries ever buffered, the last buffered delivery is the buffered-th
+	block    sync.Mutex      // Buffer synchronization mutex
+	loaded   int32           // Set once the subscriptions are loaded from the DataStore
+	savelock sync.Mutex      // Serializes the saves of the subscriptions to the DataStore
+}
+
+func makeSession(id string, userId string, guest bool, seq int64) *Session {
+	return &Session{
+		StrId:    docid.StrId{Id: id},
+		guest:    guest,
+		userId:   userId,
+		topics:   make(map[string]bool),
+		patterns: make(map[string]bool),
+		evicted:  seq, // Messages published before the session was created are unknown
+	}
+}
+
+// Message delivered to the sessions subscribed to its topic or to the pattern matching its topic.
+// Each published message has an id greater than the ids of the messages published before on the server
+type delivery struct {
+	id      int64
+	at      time.Time
+	message *docid.Message
+	pattern string // Pattern matching the message topic. Empty for topic subscriptions
+}
+
+func (d *delivery) DocId() string {
+	return strconv.FormatInt(d.id, 10)
+}
+
+// Buffers the deliveries for replay. Guest sessions can not be resumed and buffer nothing. Must be called holding block
+func (session *Session) bufferDeliveries(deliveries []*delivery) {
+	if session.guest {
+		return
+	}
+	for _, d := range deliveries {
+		session.buffer = append(session.buffer, d)
+	}
+	session.buffered += int64(len(deliveries))
+	session.trimBuffer(time.Now())
+}
+
+// Evicts the deliveries exceeding SessionBufferSize or older than SessionBufferAge. Must be called holding block.
+// Evicted slots are compacted once they make up half of the buffer, so that evictions cost O(1) amortized
+func (session *Session) trimBuffer(now time.Time) {
+	for session.head < len(session.buffer) {
+		d := session.buffer[session.head]
+		if len(session.buffer)-session.head <= SessionBufferSize && now.Sub(d.at) <= SessionBufferAge {
+			break
+		}
+		if d.id > session.evicted {
+			session.evicted = d.id
+		}
+		session.buffer[session.head] = nil
+		session.head++
+	}
+	if session.head > 0 && session.head >= len(session.buffer)/2 {
+		live := copy(session.buffer, session.buffer[session.head:])
+		for i := live; i < len(session.buffer); i++ {
+			session.buffer[i] = nil
+		}
+		session.buffer = session.buffer[:live]
+		session.head = 0
+	}
+}
+
+// Buffered deliveries with ids greater than after, among the first until deliveries ever buffered, ordered by id.
+// Returns false if some deliveries after the id are not buffered anymore
+func (session *Session) replay(after int64, until int64) ([]*delivery, bool) {
+	session.block.Lock()
+	defer session.block.Unlock()
+	session.trimBuffer(time.Now())
+	if after < session.evicted {
+		return nil, false
+	}
+	var deliveries []*delivery
+	live := session.buffer[session.head:]
+	first := session.buffered - int64(len(live)) // Deliveries buffered before the oldest one still buffered
+	for i, d := range live {
+		if d.id > after && first+int64(i) < until {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].id < deliveries[j].id
+	})
+	return deliveries, true
+}
+
+// Marks topic as subscribed. Returns false if the topic was already subscribed
+func (session *Session) addTopic(topic string) bool {
+	session.lock.Lock()
+	subscribed := session.topics[topic]
+	session.topics[topic] = true
+	session.lock.Unlock()
+	return !subscribed
+}
+
+// Marks topic as unsubscribed. Returns false if the topic was not subscribed
+func (session *Session) removeTopic(topic string) bool {
+	session.lock.Lock()
+	subscribed := session.topics[topic]
+	delete(session.topics, topic)
+	session.lock.Unlock()
+	return subscribed
+}
+
+// Marks pattern as subscribed. Returns false if the pattern was already subscribed
+func (session *Session) addPattern(pattern string) bool {
+	session.lock.Lock()
+	subscribed := session.patterns[pattern]
+	session.patterns[pattern] = true
+	session.lock.Unlock()
+	return !subscribed
+}
+
+// Marks pattern as unsubscribed. Returns false if the pattern was not subscribed
+func (session *Session) removePattern(pattern string) bool {
+	session.lock.Lock()
+	subscribed := session.patterns[pattern]
+	delete(session.patterns, pattern)
+	session.lock.Unlock()
+	return subscribed
+}
+
+// Checks whether session is subscribed to the topic
+func (session *Session) IsSubscribed(topic string) bool {
+	session.lock.RLock()
+	ok := session.topics[topic]
+	session.lock.RUnlock()
+	return ok
+}
+
+// Checks whether session is subscribed to the pattern
+func (session *Session) IsPSubscribed(pattern string) bool {
+	session.lock.RLock()
+	ok := session.patterns[pattern]
+	session.lock.RUnlock()
+	return ok
+}
+
+// Topics subscribed by the session
+func (session *Session) Topics() []string {
+	session.lock.RLock()
+	topics := make([]string, 0, len(session.topics))
+	for topic := range session.topics {
+		topics = append(topics, topic)
+	}
+	session.lock.RUnlock()
+	return topics
+}
+
+// Patterns subscribed by the session
+func (session *Session) Patterns() []string {
+	session.lock.RLock()
+	patterns := make([]string, 0, len(session.patterns))
+	for pattern := range session.patterns {
+		patterns = append(patterns, pattern)
+	}
+	session.lock.RUnlock()
+	return patterns
+}
+
+// Count of topics and patterns subscribed by the session
+func (session *Session) Subscriptions() int {
+	session.lock.RLock()
+	count := len(session.topics) + len(session.patterns)
+	session.lock.RUnlock()
+	return count
+}
+
+// Reference counts with delayed expiry. When the count of an id drops to zero the id is added to the dirty list
+// and it expires after the grace period unless it is referenced again. Not thread-safe
+type refCounter struct {
+	counts map[string]int
+	dirty  map[string]time.Time // Ids without references along with the time they were released
+}
+
+func makeRefCounter() *refCounter {
+	return &refCounter{
+		counts: make(map[string]int),
+		dirty:  make(map[string]time.Time),
+	}
+}
+
+// Adds a reference to id and removes it from the dirty list. Returns the count of references
+func (r *refCounter) incr(id string) int {
+	delete(r.dirty, id)
+	r.counts[id]++
+	return r.counts[id]
+}
+
+// Removes a reference to id. The id is added to the dirty list once it has no references
+func (r *refCounter) decr(id string, now time.Time) int {
+	count, ok := r.counts[id]
+	if !ok {
+		return 0
+	}
+	count--
+	r.counts[id] = count
+	if count <= 0 {
+		r.counts[id] = 0
+		r.dirty[id] = now
+	}
+	return count
+}
+
+// Ids referenced or in the dirty list are alive
+func (r *refCounter) alive(id string) bool {
+	_, ok := r.counts[id]
+	return ok
+}
+
+// Forgets and returns the ids that are in the dirty list for more than grace
+func (r *refCounter) expire(now time.Time, grace time.Duration) []string {
+	var expired []string
+	for id, since := range r.dirty {
+		if now.Sub(since) >= grace {
+			expired = append(expired, id)
+			delete(r.dirty, id)
+			delete(r.counts, id)
+		}
+	}
+	return expired
+}
+
+// Returns the session with the id and adds a reference to it. Session of the user is created if it does not exist.
+// Fails if the id belongs to a guest session and guest is not set, or the other way around
+func (server *WsServer) acquireSession(id docid.DocId, userId docid.DocId, guest bool) (*Session, error) {
+	server.slock.Lock()
+	defer server.slock.Unlock()
+	if guest != isGuestSessionId(id.DocId()) {
+		return nil, errorSessionMismatch
+	}
+	session, ok := server.sessions[id.DocId()]
+	if ok && session.guest != guest {
+		return nil, errorSessionMismatch
+	}
+	if !ok {
+		uid := ""
+		if !docid.IsNil(userId) {
+			uid = userId.DocId()
+		}
+		session = makeSession(id.DocId(), uid, guest, server.lastMessageId())
+		server.sessions[id.DocId()] = session
+	}
+	if !guest {
+		server.sessionRefs.incr(id.DocId())
+	}
+	return session, nil
+}
+
+// Guest session ids are the connection ids prefixed with guestSessionPrefix
+func isGuestSessionId(id string) bool {
+	return strings.HasPrefix(id, guestSessionPrefix)
+}
+
+// Removes a reference to the session. Guest sessions end right away, others are reaped after SessionGracePeriod
+func (server *WsServer) releaseSession(session *Session) {
+	server.slock.Lock()
+	defer server.slock.Unlock()
+	if session.guest {
+		server.endSession(session)
+	} else {
+		server.sessionRefs.decr(session.DocId(), time.Now())
+	}
+}
+
+// Adds a reference to the user
+func (server *WsServer) acquireUser(id docid.DocId) {
+	server.slock.Lock()
+	server.userRefs.incr(id.DocId())
+	server.slock.Unlock()
+}
+
+// Removes a reference to the user. User is forgotten after SessionGracePeriod
+func (server *WsServer) releaseUser(id docid.DocId) {
+	server.slock.Lock()
+	server.userRefs.decr(id.DocId(), time.Now())
+	server.slock.Unlock()
+}
+
+// Users with live connections or disconnected for less than SessionGracePeriod are online
+func (server *WsServer) IsUserOnline(id docid.DocId) bool {
+	server.slock.Lock()
+	ok := server.userRefs.alive(id.DocId())
+	server.slock.Unlock()
+	return ok
+}
+
+// Unsubscribes the session from all the topics and patterns and forgets it. Must be called holding slock,
+// so that a session with the same id can not subscribe until the index is cleaned up
+func (server *WsServer) endSession(session *Session) {
+	log.WithFields("edge.server", "endSession").Debug(session.DocId())
+	delete(server.sessions, session.DocId())
+	server.indexMap.RemoveValue(TopicIdx, session)
+	server.indexMap.RemoveValue(PatternIdx, session)
+	for _, topic := range session.Topics() {
+		if session.removeTopic(topic) {
+			server.onUnsubscribe(topic, session)
+		}
+	}
+	for _, pattern := range session.Patterns() {
+		if session.removePattern(pattern) {
+			server.removePattern(pattern)
+		}
+	}
+	server.saveSubscriptions(session)
+}
+
+// Server run loop that ends the sessions and forgets the users expired from the dirty list every SessionReapInterval.
+// Topics without recent messages are dropped from the history as well
+func (server *WsServer) reapSessions() {
+	ticker := time.NewTicker(SessionReapInterval)
+	for now := range ticker.C {
+		server.slock.Lock()
+		for _, id := range server.sessionRefs.expire(now, SessionGracePeriod) {
+			session, ok := server.sessions[id]
+			if ok {
+				server.endSession(session)
+			}
+		}
+		for _, id := range server.userRefs.expire(now, SessionGracePeriod) {
+			log.WithFields("edge.server", "reapSessions").Debug("User expired ", id)
+		}
+		server.slock.Unlock()
+		server.trimHistory()
+	}
+}
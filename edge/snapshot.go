@@ -0,0 +1,144 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"bufio"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	SnapshotFile     = ""               // File the index is snapshotted to and restored from on start. Empty disables the snapshots
+	SnapshotInterval = 30 * time.Second // Interval between two snapshots of the index. The index is snapshotted on exit only when <= 0
+)
+
+/*
+	The index of the server is snapshotted to SnapshotFile every SnapshotInterval and on exit, so that a restarted edge keeps the
+	subscriptions of its sessions. On start the sessions of the snapshot are restored without connections, hence
+	they expire after SessionGracePeriod unless their clients reconnect and resume them. Guest sessions end with their
+	connection and are not restored, neither is the user of a session that had no connection at the time of the snapshot.
+*/
+
+// Restores the sessions and their subscriptions from SnapshotFile, if it exists
+func (server *WsServer) restoreSnapshot() error {
+	file, err := os.Open(SnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	index := docid.MakeImmutableIndexMap(SessionIdx, UserIdx, TopicIdx, PatternIdx)
+	if err = index.Restore(file); err != nil {
+		return err
+	}
+	clientUsers := make(map[string]string)
+	index.Each(UserIdx, func(user docid.DocId, client docid.DocId) {
+		clientUsers[client.DocId()] = user.DocId()
+	})
+	sessionUsers := make(map[string]string)
+	guests := make(map[string]bool)
+	index.Each(SessionIdx, func(session docid.DocId, client docid.DocId) {
+		if isGuestSessionId(session.DocId()) || docid.Equals(session, client) {
+			guests[session.DocId()] = true
+		} else if user, ok := clientUsers[client.DocId()]; ok {
+			sessionUsers[session.DocId()] = user
+		}
+	})
+	restored := make(map[string]bool)
+	restore := func(indexName int, key docid.DocId, sessionId docid.DocId) {
+		if guests[sessionId.DocId()] {
+			return
+		}
+		session, err := server.restoreSession(sessionId, sessionUsers[sessionId.DocId()])
+		if err != nil {
+			return
+		}
+		restored[session.DocId()] = true
+		server.resubscribe(indexName, key, session)
+	}
+	index.Each(TopicIdx, func(topic docid.DocId, session docid.DocId) {
+		restore(TopicIdx, topic, session)
+	})
+	index.Each(PatternIdx, func(pattern docid.DocId, session docid.DocId) {
+		restore(PatternIdx, pattern, session)
+	})
+	log.WithFields("edge.snapshot", "restoreSnapshot", SnapshotFile).Info(len(restored), " sessions restored")
+	return nil
+}
+
+// Returns the session with the id, creating it without connections so that it expires after SessionGracePeriod
+func (server *WsServer) restoreSession(id docid.DocId, userId string) (*Session, error) {
+	var user docid.DocId = &docid.Nil{}
+	if userId != "" {
+		user = &docid.StrId{Id: userId}
+	}
+	session, err := server.acquireSession(id, user, false)
+	if err != nil {
+		return nil, err
+	}
+	server.releaseSession(session)
+	return session, nil
+}
+
+// Writes the snapshot of the index to a temporary file and renames it to SnapshotFile
+func (server *WsServer) saveSnapshot() error {
+	snapshotter, ok := server.indexMap.(interface {
+		Snapshot(w io.Writer) error
+	})
+	if !ok {
+		return nil
+	}
+	temp := SnapshotFile + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = snapshotter.Snapshot(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(temp, SnapshotFile)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// Server run loop that snapshots the index every SnapshotInterval until stop is closed,
+// then snapshots it a last time and closes stopped
+func (server *WsServer) snapshotIndex(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	var tick <-chan time.Time
+	if SnapshotInterval > 0 {
+		ticker := time.NewTicker(SnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for stopping := false; !stopping; {
+		select {
+		case <-tick:
+		case <-stop:
+			stopping = true
+		}
+		if err := server.saveSnapshot(); err != nil {
+			log.WithFields("edge.snapshot", "snapshotIndex", SnapshotFile).Error(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package edge
+
+import (
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/datastore"
+	"math"
+	"sync/atomic"
+)
+
+var (
+	DataStore datastore.Store // Data store of the durable topics and the session subscriptions. Nil keeps them in memory only
+)
+
+/*
+	With a DataStore the edge reaches beyond its memory. HISTORY replies the messages older than the ones retained
+	in the history of the topic from the data store, so that a cold edge replies the history of the durable topics.
+	The subscriptions of the sessions are saved to the data store whenever they change and loaded when a session
+	first connects to the edge, so that a session moving to another edge or outliving a restart keeps them.
+	An expired session is forgotten. RESUME replays only the buffer of the session, the data store does not know
+	the delivery ids of the edge.
+*/
+
+// Returns the messages of topic in the DataStore published at or after the unix timestamp since and before the
+// recent ones, oldest first. Stored messages of the second of the oldest recent message are left out, they may be
+// among the recent ones. At most count minus the recent messages are returned, non positive count returns all
+func storedHistory(topic string, count int, since int64, recent []*docid.Message) []*docid.Message {
+	before := int64(math.MaxInt64)
+	if len(recent) > 0 {
+		before = recent[0].Timestamp
+	}
+	records, err := DataStore.Last(topic, count)
+	if err != nil {
+		log.WithFields("edge.store", "storedHistory", topic).Error(err)
+		return nil
+	}
+	messages := make([]*docid.Message, 0, len(records))
+	for _, record := range records {
+		if record.Message.Timestamp >= since && record.Message.Timestamp < before {
+			messages = append(messages, record.Message)
+		}
+	}
+	if count > 0 && len(messages) > count-len(recent) {
+		messages = messages[len(messages)-(count-len(recent)):]
+	}
+	return messages
+}
+
+// Subscribes the session to the topics and patterns saved in the DataStore. Loaded once per session
+func (server *WsServer) loadSubscriptions(session *Session) {
+	if session.guest || DataStore == nil || !atomic.CompareAndSwapInt32(&session.loaded, 0, 1) {
+		return
+	}
+	subs, err := DataStore.Subscriptions(session.DocId())
+	if err != nil {
+		log.WithFields("edge.store", "loadSubscriptions", session.DocId()).Error(err)
+		return
+	}
+	for _, topic := range subs.Topics {
+		server.resubscribe(TopicIdx, &docid.StrId{Id: topic}, session)
+	}
+	for _, pattern := range subs.Patterns {
+		server.resubscribe(PatternIdx, &docid.StrId{Id: pattern}, session)
+	}
+}
+
+// Saves the current subscriptions of the session to the DataStore in the background.
+// Saves of a session are serialized and each one saves the subscriptions it finds, so the last one wins
+func (server *WsServer) saveSubscriptions(session *Session) {
+	if session.guest || DataStore == nil {
+		return
+	}
+	go func() {
+		session.savelock.Lock()
+		defer session.savelock.Unlock()
+		subs := datastore.Subscriptions{Topics: session.Topics(), Patterns: session.Patterns()}
+		if err := DataStore.SaveSubscriptions(session.DocId(), subs); err != nil {
+			log.WithFields("edge.store", "saveSubscriptions", session.DocId()).Error(err)
+		}
+	}()
+}
+
+// Adds the session to the index keyed with the topic or pattern and marks it as subscribed
+func (server *WsServer) resubscribe(indexName int, key docid.DocId, session *Session) {
+	err := server.indexMap.Add(indexName, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(key, session)
+	})
+	if err != nil {
+		log.WithFields("edge.store", "resubscribe", key.DocId()).Error(session.DocId(), ", Err: ", err)
+		return
+	}
+	if indexName == TopicIdx && session.addTopic(key.DocId()) {
+		server.onSubscribe(key.DocId(), session)
+	}
+	if indexName == PatternIdx && session.addPattern(key.DocId()) {
+		server.addPattern(key.DocId())
+	}
+}
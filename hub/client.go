@@ -0,0 +1,487 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/common/stats"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ReconnectMinBackoff = 100 * time.Millisecond // Delay before the first reconnect attempt, doubled after each failed attempt
+	ReconnectMaxBackoff = 10 * time.Second       // Max delay between reconnect attempts
+	MaxPendingRequests  = 10000                  // Max unacknowledged publishes kept for retransmission, the oldest are dropped
+)
+
+var (
+	ErrClientClosed = errors.New("Hub client is closed")
+)
+
+// Callback invoked for each message published on another edge
+type MessageHandler func(topic string, msg []byte)
+
+// Returns the address of the hub to connect to. Invoked before every connection attempt
+type Resolver func() (string, error)
+
+// Resolver of a fixed hub address
+func StaticAddress(address string) Resolver {
+	return func() (string, error) {
+		return address, nil
+	}
+}
+
+/*
+	Client connects an edge to the hub.
+	Edge registers the topics and patterns its clients are subscribed to and forwards the messages published by its clients.
+	Messages published on the other edges are handed to the MessageHandler.
+
+	Requests never wait for the hub. They are numbered and pipelined on the connection, and the frames written
+	since the last flush go out together. Publishes are kept until the hub acknowledges them. When the connection
+	fails the client reconnects with exponential backoff, introduces itself with HELLO, registers its whole
+	interest set again and retransmits the publishes the hub has not applied. Idle links are kept alive with
+	PING every HeartbeatInterval, a link without any frame from the hub for 3 intervals is dropped.
+*/
+type Client struct {
+	EdgeId      string // Identifies the edge to the hub across reconnects
+	incarnation string // Identifies the client among the clients of the edge. Request ids are numbered per incarnation
+	resolve     Resolver
+	transport   Transport
+	onMessage   MessageHandler
+	link        *link           // Current connection. Nil while disconnected
+	seq         int64           // Id of the last request
+	pending     []*request      // Publishes not acknowledged by the hub, oldest first
+	topics      map[string]bool // Topics of interest
+	patterns    map[string]bool // Patterns of interest
+	closed      bool
+	done        chan struct{} // Closed along with the client
+	lock        sync.Mutex    // Synchronizes the state above and the writes to the link
+}
+
+type request struct {
+	id     int64
+	action string
+	args   [][]byte
+}
+
+// Connection to the hub. A new link is made on every reconnect
+type link struct {
+	address string
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	flush   chan struct{} // Signals that frames are waiting in writer
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Makes a client that connects to the hub returned by resolve in the background and stays connected until it is closed.
+// The edge id must be unique in the cluster, a random one is generated when empty
+func MakeClient(transport Transport, resolve Resolver, edgeId string, onMessage MessageHandler) *Client {
+	if edgeId == "" {
+		hostname, _ := os.Hostname()
+		edgeId = fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	}
+	client := &Client{
+		EdgeId:      edgeId,
+		incarnation: docid.UniqueMessageId(),
+		resolve:     resolve,
+		transport:   transport,
+		onMessage:   onMessage,
+		topics:      make(map[string]bool),
+		patterns:    make(map[string]bool),
+		done:        make(chan struct{}),
+	}
+	go client.run()
+	return client
+}
+
+func (client *Client) Subscribe(topics ...string) error {
+	return client.interest(client.topics, true, "SUBSCRIBE", topics)
+}
+
+func (client *Client) Unsubscribe(topics ...string) error {
+	return client.interest(client.topics, false, "UNSUBSCRIBE", topics)
+}
+
+func (client *Client) PSubscribe(patterns ...string) error {
+	return client.interest(client.patterns, true, "PSUBSCRIBE", patterns)
+}
+
+func (client *Client) PUnsubscribe(patterns ...string) error {
+	return client.interest(client.patterns, false, "PUNSUBSCRIBE", patterns)
+}
+
+// Forwards msgs published on topic to the other edges
+func (client *Client) Publish(topic string, msgs ...[]byte) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		return ErrClientClosed
+	}
+	req := client.makeRequest("PUBLISH", append([][]byte{[]byte(topic)}, msgs...))
+	client.pending = append(client.pending, req)
+	if len(client.pending) > MaxPendingRequests {
+		dropped := len(client.pending) - MaxPendingRequests
+		log.WithFields("hub.client", "Publish", topic).Error("Dropped ", dropped, " unacknowledged publishes")
+		client.pending = append(client.pending[:0:0], client.pending[dropped:]...)
+	}
+	client.send(req)
+	return nil
+}
+
+// Count of the publishes not acknowledged by the hub yet
+func (client *Client) Pending() int {
+	client.lock.Lock()
+	count := len(client.pending)
+	client.lock.Unlock()
+	return count
+}
+
+// Checks whether the client is connected to the hub
+func (client *Client) IsConnected() bool {
+	client.lock.Lock()
+	ok := client.link != nil
+	client.lock.Unlock()
+	return ok
+}
+
+// Address of the hub the client is connected to. Empty while disconnected
+func (client *Client) Address() string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.link == nil {
+		return ""
+	}
+	return client.link.address
+}
+
+// Drops the connection, the client connects again to the hub returned by the resolver
+func (client *Client) Reconnect() {
+	client.lock.Lock()
+	if client.link != nil {
+		log.WithFields("hub.client", "Reconnect").Info("Leaving ", client.link.address)
+		client.link.close()
+		client.link = nil
+	}
+	client.lock.Unlock()
+}
+
+// Closes the connection and stops reconnecting. Unacknowledged publishes are lost
+func (client *Client) Close() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		return nil
+	}
+	client.closed = true
+	close(client.done)
+	if client.link != nil {
+		client.link.close()
+		client.link = nil
+	}
+	return nil
+}
+
+// Updates the interest set and sends the changes to the hub
+func (client *Client) interest(set map[string]bool, interested bool, action string, keys []string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		return ErrClientClosed
+	}
+	args := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if set[key] == interested {
+			continue
+		}
+		if interested {
+			set[key] = true
+		} else {
+			delete(set, key)
+		}
+		args = append(args, []byte(key))
+	}
+	if len(args) > 0 {
+		client.send(client.makeRequest(action, args))
+	}
+	return nil
+}
+
+// Must be called holding lock
+func (client *Client) makeRequest(action string, args [][]byte) *request {
+	client.seq++
+	return &request{id: client.seq, action: action, args: args}
+}
+
+// Writes the request to the link, if connected. Must be called holding lock
+func (client *Client) send(req *request) {
+	if client.link == nil {
+		return
+	}
+	if err := client.link.writeRequest(req); err != nil {
+		client.disconnect(client.link, err)
+		return
+	}
+	client.link.signal()
+}
+
+// Drops the link after an error. The run loop reconnects. Must be called holding lock
+func (client *Client) disconnect(l *link, err error) {
+	if client.link != l {
+		return
+	}
+	log.WithFields("hub.client", "disconnect").Error(l.address, ", Err: ", err)
+	stats.IncrFailed()
+	client.link = nil
+	l.close()
+}
+
+// Client run loop that connects to the hub and reconnects with exponential backoff until the client is closed
+func (client *Client) run() {
+	backoff := ReconnectMinBackoff
+	for {
+		l, err := client.connect()
+		if err == ErrClientClosed {
+			return
+		}
+		if err != nil {
+			log.WithFields("hub.client", "connect").Error("Retry in ", backoff, ", Err: ", err)
+			select {
+			case <-client.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > ReconnectMaxBackoff {
+				backoff = ReconnectMaxBackoff
+			}
+			continue
+		}
+		backoff = ReconnectMinBackoff
+		go client.flushFrames(l)
+		client.readFrames(l)
+	}
+}
+
+// Dials the hub, exchanges HELLO and sends the interest set and the publishes the hub has not applied
+func (client *Client) connect() (*link, error) {
+	select {
+	case <-client.done:
+		return nil, ErrClientClosed
+	default:
+	}
+	address, err := client.resolve()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	l := &link{
+		address: address,
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		flush:   make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	applied, err := l.hello(client.EdgeId, client.incarnation)
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		l.close()
+		return nil, ErrClientClosed
+	}
+	client.acknowledge(applied)
+	if err = l.writeInterest(client.topics, client.patterns); err == nil {
+		for _, req := range client.pending {
+			if err = l.writeRequest(req); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	log.WithFields("hub.client", "connect").Info("Connected to ", address, ", Retransmitting ", len(client.pending))
+	client.link = l
+	l.signal()
+	return l, nil
+}
+
+// Forgets the publishes up to id. Must be called holding lock
+func (client *Client) acknowledge(id int64) {
+	i := sort.Search(len(client.pending), func(i int) bool {
+		return client.pending[i].id > id
+	})
+	if i > 0 {
+		client.pending = append(client.pending[:0:0], client.pending[i:]...)
+	}
+}
+
+// Link run loop that flushes the pipelined frames and sends the heartbeats
+func (client *Client) flushFrames(l *link) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		ping := false
+		select {
+		case <-l.closed:
+			return
+		case <-l.flush:
+		case <-ticker.C:
+			ping = true
+		}
+		client.lock.Lock()
+		if client.link == l {
+			err := l.flushFrames(ping)
+			if err != nil {
+				client.disconnect(l, err)
+			}
+		}
+		client.lock.Unlock()
+	}
+}
+
+// Link run loop that reads the acknowledgements, message pushes and errors sent by the hub until the link fails
+func (client *Client) readFrames(l *link) {
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(idleTimeout()))
+		value, err := resp.ReadValue(l.reader)
+		if err != nil {
+			client.lock.Lock()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // Hub does not close connections on its own
+			}
+			client.disconnect(l, err)
+			client.lock.Unlock()
+			return
+		}
+		switch {
+		case value.Type == resp.Err:
+			log.WithFields("hub.client", "readFrames").Error(value.String())
+		case isFrame(value, "message", 3):
+			client.onMessage(string(value.Elems[1].Str), value.Elems[2].Str)
+		case isFrame(value, "ack", 2):
+			id, _ := strconv.ParseInt(string(value.Elems[1].Str), 10, 64)
+			client.lock.Lock()
+			client.acknowledge(id)
+			client.lock.Unlock()
+		case isFrame(value, "pong", 1):
+		case isFrame(value, "error", 3):
+			log.WithFields("hub.client", "readFrames").Error("Request ", value.Elems[1].String(), ", Err: ", value.Elems[2].String())
+		default:
+			log.WithFields("hub.client", "readFrames").Debug("Unexpected value ", value.String())
+		}
+	}
+}
+
+// Sends HELLO edge-id and returns the id of the last request applied by the hub
+func (l *link) hello(edgeId string, incarnation string) (int64, error) {
+	l.conn.SetDeadline(time.Now().Add(DialTimeout))
+	w := resp.MakeWriter(l.writer)
+	if Secret != "" {
+		w.WriteStrings("HELLO", edgeId, incarnation, Secret)
+	} else {
+		w.WriteStrings("HELLO", edgeId, incarnation)
+	}
+	if w.Err() != nil {
+		return 0, w.Err()
+	}
+	if err := l.writer.Flush(); err != nil {
+		return 0, err
+	}
+	value, err := resp.ReadValue(l.reader)
+	if err != nil {
+		return 0, err
+	}
+	if !isFrame(value, "hello", 2) {
+		return 0, fmt.Errorf("Unexpected reply to HELLO %s", value.String())
+	}
+	l.conn.SetDeadline(time.Time{})
+	return strconv.ParseInt(string(value.Elems[1].Str), 10, 64)
+}
+
+// Writes the whole interest set as plain commands, which the hub applies regardless of the request ids
+func (l *link) writeInterest(topics map[string]bool, patterns map[string]bool) error {
+	w := resp.MakeWriter(l.writer)
+	for action, set := range map[string]map[string]bool{"SUBSCRIBE": topics, "PSUBSCRIBE": patterns} {
+		if len(set) == 0 {
+			continue
+		}
+		w.WriteArrayHeader(len(set) + 1)
+		w.WriteBulkString(action)
+		for key := range set {
+			w.WriteBulkString(key)
+		}
+	}
+	return w.Err()
+}
+
+// Writes id ACTION arg [arg ...] to the buffer. Frames reach the hub once flushed
+func (l *link) writeRequest(req *request) error {
+	l.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	w := resp.MakeWriter(l.writer)
+	w.WriteArrayHeader(len(req.args) + 2)
+	w.WriteBulkString(strconv.FormatInt(req.id, 10))
+	w.WriteBulkString(req.action)
+	for _, arg := range req.args {
+		w.WriteBulk(arg)
+	}
+	return w.Err()
+}
+
+func (l *link) flushFrames(ping bool) error {
+	l.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if ping {
+		w := resp.MakeWriter(l.writer)
+		if w.WriteStrings("PING").Err() != nil {
+			return w.Err()
+		}
+	}
+	return l.writer.Flush()
+}
+
+// Wakes up the flusher
+func (l *link) signal() {
+	select {
+	case l.flush <- struct{}{}:
+	default:
+	}
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+}
+
+// Frame kind arg [arg ...] of count elements
+func isFrame(value *resp.Value, kind string, count int) bool {
+	return (value.Type == resp.Array || value.Type == resp.Push) && len(value.Elems) == count &&
+		string(value.Elems[0].Str) == kind
+}
@@ -0,0 +1,406 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/pigeond-io/pigeond/common/commands"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/common/stats"
+	"github.com/pigeond-io/pigeond/common/utils"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	AckInterval   = 128  // Max requests applied before they are acknowledged while the edge keeps pipelining
+	EdgeQueueSize = 1024 // Max publishes queued for an edge. Edges falling further behind are disconnected
+)
+
+var (
+	errorInvalidCommand = errors.New("Invalid Command")
+	errorLateHello      = errors.New("HELLO must precede the other commands")
+	errorNoHello        = errors.New("HELLO with the secret must precede the other commands")
+	errorWrongSecret    = errors.New("Wrong secret")
+	errorInvalidPattern = errors.New("Pattern too long or with too many *")
+	errorQueueFull      = errors.New("Send queue full")
+)
+
+// Edge connected to the hub. Each edge is served by its own goroutine,
+// commands of an edge are executed in the order they are received.
+// Messages forwarded to the edge are queued and written by another goroutine, so that a slow edge
+// does not hold up the edges publishing to it
+type Edge struct {
+	docid.StrId          // Edge Id - Sent with HELLO, remote address of the connection until then
+	Conn        net.Conn // Transport connection to the edge
+	cmdRegistry commands.Registry
+	reader      *bufio.Reader
+	writer      *bufio.Writer
+	topics      map[string]bool // Topics the edge is interested in
+	patterns    map[string]bool // Patterns the edge is interested in
+	ilock       sync.RWMutex    // Topics and Patterns synchronization mutex
+	wlock       sync.Mutex      // Write synchronization mutex
+	once        sync.Once       // Singleton to close the connection once
+	closed      int32           // Set once the connection is closed
+	queue       chan push       // Messages waiting to be written to the edge
+	done        chan struct{}   // Closed with the connection, stops the writer goroutine
+	incarnation string          // Incarnation of the edge client sent with HELLO. Request ids are numbered per incarnation
+	authorized  bool            // Set once the edge presents the Secret with HELLO, or right away without a Secret
+	applied     int64           // Id of the last request applied
+	acked       int64           // Id of the last request acknowledged
+	server      *HubServer
+}
+
+// Messages published on topic, queued for an edge
+type push struct {
+	topic string
+	msgs  [][]byte
+}
+
+// Serves the edge connection until it is closed
+func InitEdge(server *HubServer, conn net.Conn) {
+	edge := &Edge{
+		Conn:        conn,
+		cmdRegistry: commands.MakeRegistry(),
+		reader:      bufio.NewReader(conn),
+		writer:      bufio.NewWriter(conn),
+		topics:      make(map[string]bool),
+		patterns:    make(map[string]bool),
+		queue:       make(chan push, EdgeQueueSize),
+		done:        make(chan struct{}),
+		authorized:  Secret == "",
+		server:      server,
+	}
+	edge.Id = conn.RemoteAddr().String()
+	edge.registerCommands()
+	server.addEdge(edge)
+	stats.IncrServed()
+	stats.IncrLive()
+	log.WithFields("hub.edge", "InitEdge").Info(edge.String())
+	go edge.writePushes()
+	edge.serve()
+}
+
+func (edge *Edge) String() string {
+	return fmt.Sprintf("Edge #%s", edge.DocId())
+}
+
+// Is connection closed
+func (edge *Edge) IsClosed() bool {
+	return atomic.LoadInt32(&edge.closed) == 1
+}
+
+func (edge *Edge) registerCommands() {
+	registry := edge.cmdRegistry
+	registry.Write("HELLO", edge.onHello)
+	registry.Write("PING", edge.onPing)
+	registry.Write("SUBSCRIBE", edge.onInterest(TopicIdx, true))
+	registry.Write("UNSUBSCRIBE", edge.onInterest(TopicIdx, false))
+	registry.Write("PSUBSCRIBE", edge.onInterest(PatternIdx, true))
+	registry.Write("PUNSUBSCRIBE", edge.onInterest(PatternIdx, false))
+	registry.Write("PUBLISH", edge.onPublish)
+}
+
+// Reads and executes the edge commands. Only HELLO has a reply, failed commands are replied with an error.
+// Requests with an id are executed once even if the edge retransmits them, and are acknowledged with
+// ack id once the edge stops pipelining or every AckInterval requests. Acknowledgements are cumulative
+func (edge *Edge) serve() {
+	defer edge.Close()
+	for {
+		edge.Conn.SetReadDeadline(time.Now().Add(idleTimeout()))
+		frame, err := resp.ReadValue(edge.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.WithFields("hub.edge", "serve").Error(edge.String(), ", Err: ", err)
+			}
+			return
+		}
+		id, cmd := parseFrame(frame)
+		if !edge.authorized && !(cmd.Ok() && cmd.Action() == "HELLO") {
+			edge.replyError(id, errorNoHello)
+			return
+		}
+		if id == 0 || id > edge.applied {
+			if !cmd.Ok() {
+				err = errorInvalidCommand
+			} else {
+				_, err = commands.MakeExecutor(cmd).Execute(edge.cmdRegistry)
+			}
+			if id > 0 {
+				edge.applied = id
+				edge.server.setApplied(edge.appliedKey(), id)
+			}
+			if err != nil {
+				edge.replyError(id, err)
+			}
+			if !edge.authorized {
+				return
+			}
+		}
+		if edge.applied > edge.acked && (edge.reader.Buffered() == 0 || edge.applied-edge.acked >= int64(AckInterval)) {
+			edge.ack()
+		}
+	}
+}
+
+// Splits the frame id ACTION arg [arg ...] into the request id and the command.
+// Frames without an id are plain commands and have the id 0
+func parseFrame(frame *resp.Value) (int64, *resp.Value) {
+	if frame.Type != resp.Array || len(frame.Elems) < 2 {
+		return 0, frame
+	}
+	id, err := strconv.ParseInt(string(frame.Elems[0].Str), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, frame
+	}
+	return id, &resp.Value{Type: resp.Array, Elems: frame.Elems[1:]}
+}
+
+// Failed requests with an id are replied with error id reason
+func (edge *Edge) replyError(id int64, err error) {
+	log.WithFields("hub.edge", "serve").Debug(edge.String(), ", Err: ", err)
+	edge.write(func(w *resp.Writer) {
+		if id > 0 {
+			w.WriteStrings("error", strconv.FormatInt(id, 10), err.Error())
+		} else {
+			w.WriteError("Error " + err.Error())
+		}
+	})
+}
+
+// Acknowledges the requests applied so far
+func (edge *Edge) ack() {
+	edge.acked = edge.applied
+	edge.write(func(w *resp.Writer) {
+		w.WriteStrings("ack", strconv.FormatInt(edge.applied, 10))
+	})
+}
+
+// PING
+// Replies with pong, so that both ends of the link see traffic
+func (edge *Edge) onPing(args ...[]byte) ([]byte, error) {
+	return nil, edge.write(func(w *resp.Writer) {
+		w.WriteStrings("pong")
+	})
+}
+
+// HELLO edge-id [incarnation [secret]]
+// Identifies the edge and replies with hello last-id, the id of the last request of the edge applied by the hub.
+// The edge retransmits the requests after it that it did not see acknowledged. Every client of an edge, e.g. after
+// a restart, is a new incarnation numbering its requests from 1, hence its last applied id starts at 0.
+// When the hub has a Secret, the edge must present it and is disconnected otherwise
+func (edge *Edge) onHello(args ...[]byte) ([]byte, error) {
+	if len(args) < 1 || len(args) > 3 || len(args[0]) == 0 {
+		return nil, errorInvalidCommand
+	}
+	if Secret != "" {
+		if len(args) < 3 || subtle.ConstantTimeCompare(args[2], []byte(Secret)) != 1 {
+			log.WithFields("hub.edge", "Hello").Error(edge.String(), ", Err: ", errorWrongSecret)
+			return nil, errorWrongSecret
+		}
+		edge.authorized = true
+	}
+	if len(args) > 1 {
+		edge.incarnation = string(args[1])
+	}
+	edge.ilock.RLock()
+	late := len(edge.topics) > 0 || len(edge.patterns) > 0
+	edge.ilock.RUnlock()
+	if late {
+		return nil, errorLateHello
+	}
+	server := edge.server
+	server.removeEdge(edge)
+	edge.Id = string(args[0])
+	server.addEdge(edge)
+	edge.applied = server.lastApplied(edge.appliedKey())
+	edge.acked = edge.applied
+	log.WithFields("hub.edge", "Hello").Info(edge.String(), ", Last applied: ", edge.applied)
+	return nil, edge.write(func(w *resp.Writer) {
+		w.WriteStrings("hello", strconv.FormatInt(edge.applied, 10))
+	})
+}
+
+// SUBSCRIBE | UNSUBSCRIBE | PSUBSCRIBE | PUNSUBSCRIBE topic [topic ...]
+// Adds or removes the topics or patterns to the interest set of the edge
+func (edge *Edge) onInterest(indexName int, interested bool) commands.ActionCallback {
+	return func(args ...[]byte) ([]byte, error) {
+		if len(args) == 0 {
+			return nil, errorInvalidCommand
+		}
+		for _, arg := range args {
+			key := string(arg)
+			var err error
+			if interested {
+				err = edge.addInterest(indexName, key)
+			} else {
+				err = edge.removeInterest(indexName, key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// PUBLISH topic msg [msg ...]
+// Forwards the msgs to the other edges interested in the topic
+func (edge *Edge) onPublish(args ...[]byte) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errorInvalidCommand
+	}
+	topic := string(args[0])
+	receivers := edge.server.Forward(edge, topic, args[1:])
+	log.WithFields("hub.edge", "Publish", topic).Debug(edge.String(), ", Receivers: ", receivers)
+	return nil, nil
+}
+
+// Key of the applied requests of the edge incarnation
+func (edge *Edge) appliedKey() string {
+	return edge.DocId() + " " + edge.incarnation
+}
+
+func (edge *Edge) interests(indexName int) map[string]bool {
+	if indexName == PatternIdx {
+		return edge.patterns
+	}
+	return edge.topics
+}
+
+func (edge *Edge) addInterest(indexName int, key string) error {
+	if indexName == PatternIdx && !utils.ValidGlob(key) {
+		return errorInvalidPattern
+	}
+	err := edge.server.indexMap.Add(indexName, func(idx docid.AddIndexEntryWriter) error {
+		return idx.Add(&docid.StrId{Id: key}, edge)
+	})
+	if err != nil {
+		return err
+	}
+	edge.ilock.Lock()
+	interests := edge.interests(indexName)
+	added := !interests[key]
+	interests[key] = true
+	edge.ilock.Unlock()
+	if added && indexName == PatternIdx {
+		edge.server.addPattern(key)
+	}
+	return nil
+}
+
+func (edge *Edge) removeInterest(indexName int, key string) error {
+	err := edge.server.indexMap.Remove(indexName, func(idx docid.RemoveIndexEntryWriter) error {
+		return idx.Remove(&docid.StrId{Id: key}, edge)
+	})
+	if err != nil {
+		return err
+	}
+	edge.ilock.Lock()
+	interests := edge.interests(indexName)
+	removed := interests[key]
+	delete(interests, key)
+	edge.ilock.Unlock()
+	if removed && indexName == PatternIdx {
+		edge.server.removePattern(key)
+	}
+	return nil
+}
+
+// Checks whether the edge is interested in the topic or pattern
+func (edge *Edge) isInterested(indexName int, key string) bool {
+	edge.ilock.RLock()
+	ok := edge.interests(indexName)[key]
+	edge.ilock.RUnlock()
+	return ok
+}
+
+// Queues msgs published on topic to be sent as message pushes if the edge is interested in key.
+// The edge is disconnected if its queue is full
+func (edge *Edge) send(indexName int, key string, topic string, msgs [][]byte) bool {
+	if edge.IsClosed() || !edge.isInterested(indexName, key) {
+		return false
+	}
+	select {
+	case edge.queue <- push{topic: topic, msgs: msgs}:
+		return true
+	default:
+		log.WithFields("hub.edge", "send", topic).Error(edge.String(), ", Err: ", errorQueueFull)
+		edge.Close()
+		return false
+	}
+}
+
+// Writer run loop that writes the queued pushes until the edge is closed.
+// Pushes queued while a write is in progress go out together with the next flush
+func (edge *Edge) writePushes() {
+	for {
+		select {
+		case <-edge.done:
+			return
+		case p := <-edge.queue:
+			pushes := append(make([]push, 0, len(edge.queue)+1), p)
+			for i := len(edge.queue); i > 0; i-- {
+				pushes = append(pushes, <-edge.queue)
+			}
+			edge.write(func(w *resp.Writer) {
+				for _, p := range pushes {
+					for _, msg := range p.msgs {
+						w.WriteMessage(p.topic, msg)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Writes to the edge connection. Connection is closed if the write does not complete within WriteTimeout
+func (edge *Edge) write(callback func(*resp.Writer)) error {
+	edge.wlock.Lock()
+	edge.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	w := resp.MakeWriter(edge.writer)
+	callback(w)
+	err := w.Err()
+	if err == nil {
+		err = edge.writer.Flush()
+	}
+	edge.wlock.Unlock()
+	if err != nil {
+		log.WithFields("hub.edge", "write").Error(edge.String(), ", Err: ", err)
+		edge.Close()
+	}
+	return err
+}
+
+// Deinit method invoked when edge connection is terminated
+func (edge *Edge) Close() {
+	edge.once.Do(func() {
+		log.WithFields("hub.edge", "Close").Info(edge.String())
+		atomic.StoreInt32(&edge.closed, 1)
+		close(edge.done)
+		stats.DecrLive()
+		server := edge.server
+		server.removeEdge(edge)
+		server.indexMap.RemoveValue(TopicIdx, edge)
+		server.indexMap.RemoveValue(PatternIdx, edge)
+		edge.ilock.Lock()
+		for pattern := range edge.patterns {
+			server.removePattern(pattern)
+		}
+		edge.topics = make(map[string]bool)
+		edge.patterns = make(map[string]bool)
+		edge.ilock.Unlock()
+		edge.Conn.Close()
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub_test
+
+import (
+	"bufio"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/hub"
+	"net"
+	"testing"
+	"time"
+)
+
+type rawEdge struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dialRaw(t *testing.T, address string) *rawEdge {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rawEdge{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+}
+
+func (e *rawEdge) send(t *testing.T, strs ...string) {
+	resp.MakeWriter(e.writer).WriteStrings(strs...)
+	if err := e.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *rawEdge) expect(t *testing.T, expected string) {
+	value, err := resp.ReadValue(e.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.String() != expected {
+		t.Errorf("Expected %s got %s", expected, value.String())
+	}
+}
+
+func TestRetransmittedRequestsAreAppliedOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := hub.MakeHubServer(listener)
+	go server.Serve()
+	defer server.Close()
+	address := listener.Addr().String()
+
+	subscriber := dialRaw(t, address)
+	subscriber.send(t, "HELLO", "subscriber")
+	subscriber.expect(t, "*[hello 0]")
+	subscriber.send(t, "1", "SUBSCRIBE", "news")
+	subscriber.expect(t, "*[ack 1]")
+
+	publisher := dialRaw(t, address)
+	publisher.send(t, "HELLO", "publisher")
+	publisher.expect(t, "*[hello 0]")
+	publisher.send(t, "1", "PUBLISH", "news", "a")
+	publisher.expect(t, "*[ack 1]")
+	subscriber.expect(t, "*[message news a]")
+
+	// Reconnected publisher retransmits the requests it did not see acknowledged
+	publisher.conn.Close()
+	publisher = dialRaw(t, address)
+	publisher.send(t, "HELLO", "publisher")
+	publisher.expect(t, "*[hello 1]")
+	publisher.send(t, "1", "PUBLISH", "news", "a")
+	publisher.send(t, "2", "PUBLISH", "news", "b")
+	publisher.expect(t, "*[ack 2]")
+	subscriber.expect(t, "*[message news b]")
+
+	publisher.send(t, "3", "PUBLISH", "news")
+	publisher.expect(t, "*[error 3 Invalid Command]")
+	publisher.expect(t, "*[ack 3]")
+	publisher.send(t, "SUBSCRIBE", "chat")
+	publisher.send(t, "HELLO", "late")
+	publisher.expect(t, "Error HELLO must precede the other commands")
+}
+
+func TestNewClientOfAnEdgeStartsOver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := hub.MakeHubServer(listener)
+	go server.Serve()
+	defer server.Close()
+	address := listener.Addr().String()
+	transport, err := hub.GetTransport("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := dialRaw(t, address)
+	subscriber.send(t, "HELLO", "subscriber")
+	subscriber.expect(t, "*[hello 0]")
+	subscriber.send(t, "1", "SUBSCRIBE", "news")
+	subscriber.expect(t, "*[ack 1]")
+
+	// Request ids of a restarted edge start at 1 again, they must not be taken for retransmissions
+	for _, msg := range []string{"a", "b"} {
+		client := hub.MakeClient(transport, hub.StaticAddress(address), "publisher", nil)
+		if err := client.Publish("news", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		subscriber.expect(t, "*[message news "+msg+"]")
+		client.Close()
+	}
+}
+
+func TestEdgesPresentTheSecret(t *testing.T) {
+	hub.Secret = "s3cret"
+	defer func() { hub.Secret = "" }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := hub.MakeHubServer(listener)
+	go server.Serve()
+	defer server.Close()
+	address := listener.Addr().String()
+
+	intruder := dialRaw(t, address)
+	intruder.send(t, "SUBSCRIBE", "news")
+	intruder.expect(t, "Error HELLO with the secret must precede the other commands")
+	intruder = dialRaw(t, address)
+	intruder.send(t, "HELLO", "intruder", "1", "guess")
+	intruder.expect(t, "Error Wrong secret")
+
+	subscriber := dialRaw(t, address)
+	subscriber.send(t, "HELLO", "subscriber", "1", "s3cret")
+	subscriber.expect(t, "*[hello 0]")
+	subscriber.send(t, "1", "SUBSCRIBE", "news")
+	subscriber.expect(t, "*[ack 1]")
+
+	// Client presents the Secret
+	transport, err := hub.GetTransport("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := hub.MakeClient(transport, hub.StaticAddress(address), "publisher", nil)
+	defer client.Close()
+	if err := client.Publish("news", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	subscriber.expect(t, "*[message news a]")
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+//go:build kcp
+// +build kcp
+
+package hub
+
+import (
+	"github.com/xtaci/kcp-go"
+	"net"
+)
+
+var (
+	KcpDataShards   = 10   // Forward error correction data shards. FEC is disabled when zero
+	KcpParityShards = 3    // Forward error correction parity shards
+	KcpWindowSize   = 1024 // Send and receive windows, in packets
+	KcpMtu          = 1350
+)
+
+/*
+	KCP transport, a reliable ARQ protocol over UDP selected with --hub-transport=kcp.
+	Lost packets are recovered from the parity shards or retransmitted without stalling the packets behind them,
+	which keeps the latency low on lossy WAN links where TCP suffers from head-of-line blocking.
+	Sessions run in stream mode, so the RESP frames are carried as a byte stream like over TCP.
+	KCP has no close handshake, dead links are detected by the heartbeats of the hub protocol.
+*/
+type kcpTransport struct{}
+
+func init() {
+	RegisterTransport("kcp", kcpTransport{})
+}
+
+func (kcpTransport) Dial(address string) (net.Conn, error) {
+	session, err := kcp.DialWithOptions(address, nil, KcpDataShards, KcpParityShards)
+	if err != nil {
+		return nil, err
+	}
+	setKcpOptions(session)
+	return session, nil
+}
+
+func (kcpTransport) Listen(address string) (net.Listener, error) {
+	listener, err := kcp.ListenWithOptions(address, nil, KcpDataShards, KcpParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{listener}, nil
+}
+
+// Applies the session options to the accepted sessions
+type kcpListener struct {
+	*kcp.Listener
+}
+
+func (listener *kcpListener) Accept() (net.Conn, error) {
+	session, err := listener.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	setKcpOptions(session)
+	return session, nil
+}
+
+// Low latency settings: no delay, 10ms internal update interval, fast resend after 2 duplicate acks, no congestion control
+func setKcpOptions(session *kcp.UDPSession) {
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetNoDelay(1, 10, 2, 1)
+	session.SetWindowSize(KcpWindowSize, KcpWindowSize)
+	session.SetMtu(KcpMtu)
+	session.SetACKNoDelay(true)
+}
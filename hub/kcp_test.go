@@ -0,0 +1,63 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+//go:build kcp
+// +build kcp
+
+package hub_test
+
+import (
+	"github.com/pigeond-io/pigeond/hub"
+	"testing"
+	"time"
+)
+
+// Run with bin/test, which builds with the kcp tag
+func TestKcpTransport(t *testing.T) {
+	transport, err := hub.GetTransport("kcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := hub.MakeHubServer(listener)
+	go server.Serve()
+	defer server.Close()
+	address := listener.Addr().String()
+
+	received := make(chan string, 16)
+	subscriber := hub.MakeClient(transport, hub.StaticAddress(address), "subscriber", func(topic string, msg []byte) {
+		select {
+		case received <- topic + " " + string(msg):
+		default:
+		}
+	})
+	defer subscriber.Close()
+	if err := subscriber.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	publisher := hub.MakeClient(transport, hub.StaticAddress(address), "publisher", nil)
+	defer publisher.Close()
+
+	// Publishes made before the hub registers the subscription reach nobody, publish until one gets through
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := publisher.Publish("news", []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg != "news a" {
+				t.Errorf("Expected news a got %s", msg)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No message received over kcp")
+		}
+	}
+}
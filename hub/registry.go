@@ -1,7 +0,0 @@
-// Copyright 2018 The PigeonD Authors. All rights reserved.
-// Use of this source code is governed by a GNU AGPL v3.0
-// license that can be found in the AGPL V3 LICENSE file.
-
-package hub
-
-var Edges = [...]string{"edge1", "edge2"}
@@ -0,0 +1,279 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub
+
+import (
+	"errors"
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/log"
+	"sync"
+)
+
+var (
+	ErrNoHub = errors.New("No hub is alive")
+)
+
+// Link of an edge to the hubs. Implemented by Client for a single hub and by Router for a cluster of hubs
+type Link interface {
+	Subscribe(topics ...string) error
+	Unsubscribe(topics ...string) error
+	PSubscribe(patterns ...string) error
+	PUnsubscribe(patterns ...string) error
+	Publish(topic string, msgs ...[]byte) error
+	Close() error
+}
+
+/*
+	Router links an edge to every alive hub of the cluster.
+	Each topic is owned by one hub, chosen on a consistent hash ring of the alive hubs. The edge publishes and
+	registers interest in a topic on its owner only, so the owner learns every publisher and every interested edge
+	of the topic. Patterns may match topics owned by any hub and are registered on every hub.
+
+	When a hub joins or dies the ring is rebalanced: the interest in the topics that moved is registered on their
+	new owner and removed from the previous one. Publishes not acknowledged by a dead hub are lost.
+*/
+type Router struct {
+	EdgeId     string // Identifies the edge to the hubs
+	transport  Transport
+	membership cluster.Membership
+	onMessage  MessageHandler
+	ring       *cluster.HashRing
+	clients    map[string]*Client // Links keyed with the name of the hub
+	owners     map[string]string  // Owner hub of the topics of interest
+	patterns   map[string]bool    // Patterns of interest
+	closed     bool
+	lock       sync.Mutex // Synchronizes the state above
+}
+
+// Links an edge to the hub at address, or to every alive hub of the membership when address is empty.
+// Edge id defaults to the name of the local node of the membership. Returns nil when there is neither
+func MakeLink(address string, membership cluster.Membership, edgeId string, onMessage MessageHandler) (Link, error) {
+	if address == "" && membership == nil {
+		return nil, nil
+	}
+	transport, err := GetTransport(TransportName)
+	if err != nil {
+		return nil, err
+	}
+	if edgeId == "" && membership != nil {
+		edgeId = membership.Self().Name
+	}
+	if address != "" {
+		client := MakeClient(transport, StaticAddress(address), edgeId, onMessage)
+		log.WithFields("hub.router", "MakeLink").Info("Linking to hub ", address, " over ", TransportName, " as ", client.EdgeId)
+		return client, nil
+	}
+	router := MakeRouter(transport, membership, edgeId, onMessage)
+	log.WithFields("hub.router", "MakeLink").Info("Linking to hubs over ", TransportName, " as ", router.EdgeId)
+	return router, nil
+}
+
+// Makes a router linking the edge to the alive hubs of the membership, following the hubs as they join and die
+func MakeRouter(transport Transport, membership cluster.Membership, edgeId string, onMessage MessageHandler) *Router {
+	router := &Router{
+		EdgeId:     edgeId,
+		transport:  transport,
+		membership: membership,
+		onMessage:  onMessage,
+		ring:       cluster.MakeHashRing(0),
+		clients:    make(map[string]*Client),
+		owners:     make(map[string]string),
+		patterns:   make(map[string]bool),
+	}
+	membership.OnChange(router.onMemberChange)
+	router.rebalance()
+	return router
+}
+
+// Name of the hub owning the topic. Empty when no hub is alive
+func (router *Router) Owner(topic string) string {
+	return router.ring.Owner(topic)
+}
+
+func (router *Router) Subscribe(topics ...string) error {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.closed {
+		return ErrClientClosed
+	}
+	var err error
+	for _, topic := range topics {
+		if _, ok := router.owners[topic]; ok {
+			continue
+		}
+		owner := router.ring.Owner(topic)
+		router.owners[topic] = owner
+		if client, ok := router.clients[owner]; ok {
+			err = firstError(err, client.Subscribe(topic))
+		}
+	}
+	return err
+}
+
+func (router *Router) Unsubscribe(topics ...string) error {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.closed {
+		return ErrClientClosed
+	}
+	var err error
+	for _, topic := range topics {
+		owner, ok := router.owners[topic]
+		if !ok {
+			continue
+		}
+		delete(router.owners, topic)
+		if client, ok := router.clients[owner]; ok {
+			err = firstError(err, client.Unsubscribe(topic))
+		}
+	}
+	return err
+}
+
+func (router *Router) PSubscribe(patterns ...string) error {
+	return router.patternInterest(true, patterns)
+}
+
+func (router *Router) PUnsubscribe(patterns ...string) error {
+	return router.patternInterest(false, patterns)
+}
+
+// Forwards msgs published on topic to the hub owning the topic
+func (router *Router) Publish(topic string, msgs ...[]byte) error {
+	router.lock.Lock()
+	if router.closed {
+		router.lock.Unlock()
+		return ErrClientClosed
+	}
+	client, ok := router.clients[router.ring.Owner(topic)]
+	router.lock.Unlock()
+	if !ok {
+		return ErrNoHub
+	}
+	return client.Publish(topic, msgs...)
+}
+
+// Closes the links to every hub
+func (router *Router) Close() error {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.closed {
+		return nil
+	}
+	router.closed = true
+	for name, client := range router.clients {
+		client.Close()
+		delete(router.clients, name)
+	}
+	return nil
+}
+
+// Updates the interest in the patterns on every hub
+func (router *Router) patternInterest(interested bool, patterns []string) error {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.closed {
+		return ErrClientClosed
+	}
+	for _, pattern := range patterns {
+		if interested {
+			router.patterns[pattern] = true
+		} else {
+			delete(router.patterns, pattern)
+		}
+	}
+	var err error
+	for _, client := range router.clients {
+		if interested {
+			err = firstError(err, client.PSubscribe(patterns...))
+		} else {
+			err = firstError(err, client.PUnsubscribe(patterns...))
+		}
+	}
+	return err
+}
+
+func (router *Router) onMemberChange(member cluster.Member) {
+	if member.Role == cluster.RoleHub {
+		router.rebalance()
+	}
+}
+
+// Links to the hubs that joined, drops the links to the hubs that died and moves the topics whose owner changed
+func (router *Router) rebalance() {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.closed {
+		return
+	}
+	var names []string
+	for _, member := range router.membership.Alive(cluster.RoleHub) {
+		names = append(names, member.Name)
+	}
+	if !router.ring.Set(names...) && len(router.clients) == len(names) {
+		return
+	}
+	log.WithFields("hub.router", "rebalance").Info("Hubs ", names)
+	alive := make(map[string]bool)
+	for _, name := range names {
+		alive[name] = true
+		if _, ok := router.clients[name]; !ok {
+			client := MakeClient(router.transport, router.resolver(name), router.EdgeId, router.onMessage)
+			client.PSubscribe(keys(router.patterns)...)
+			router.clients[name] = client
+		}
+	}
+	for name, client := range router.clients {
+		if !alive[name] {
+			client.Close()
+			delete(router.clients, name)
+		}
+	}
+	moved := 0
+	for topic, previous := range router.owners {
+		owner := router.ring.Owner(topic)
+		if owner == previous {
+			continue
+		}
+		if client, ok := router.clients[previous]; ok {
+			client.Unsubscribe(topic)
+		}
+		if client, ok := router.clients[owner]; ok {
+			client.Subscribe(topic)
+		}
+		router.owners[topic] = owner
+		moved++
+	}
+	if moved > 0 {
+		log.WithFields("hub.router", "rebalance").Info("Moved ", moved, " of ", len(router.owners), " topics")
+	}
+}
+
+// Resolves the current address of the hub
+func (router *Router) resolver(name string) Resolver {
+	return func() (string, error) {
+		for _, member := range router.membership.Alive(cluster.RoleHub) {
+			if member.Name == name {
+				return member.Address, nil
+			}
+		}
+		return "", ErrNoHub
+	}
+}
+
+func keys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	return list
+}
+
+func firstError(err error, next error) error {
+	if err != nil {
+		return err
+	}
+	return next
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub
+
+import (
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/docid"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/stats"
+	"github.com/pigeond-io/pigeond/common/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	KeepAliveInterval = 1 * time.Minute
+	WriteTimeout      = 10 * time.Second // Edges that can not receive a message within WriteTimeout are disconnected
+	HeartbeatInterval = 5 * time.Second  // Interval at which edges PING the hub. Links silent for 3 intervals are dropped
+	AppliedRetention  = 10 * time.Minute // Time the last applied request of a disconnected edge incarnation is remembered for its reconnection
+)
+
+var (
+	Membership cluster.Membership // Cluster membership. Edges that the membership reports dead are dropped
+)
+
+const (
+	TopicIdx int = iota
+	PatternIdx
+)
+
+/*
+	Hub routes the messages published on an edge to the other edges.
+
+	Edges connect to the hub over a Transport and exchange RESP frames, every bulk string of a frame is
+	length-prefixed so frames of any size survive. An edge introduces itself with HELLO edge-id incarnation [secret],
+	a hub with a Secret disconnects the peers that send any other command before or present a wrong secret.
+	The edge registers the topics and patterns its clients are subscribed to with SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE
+	and PUNSUBSCRIBE. It forwards the messages published by its clients with PUBLISH topic msg [msg ...].
+	The hub forwards every message only to the other edges interested in the topic as a message push,
+	*3\r\n$7\r\nmessage\r\n$<len>\r\n<topic>\r\n$<len>\r\n<msg>\r\n
+
+	Requests prefixed with an id, id ACTION arg [arg ...], are acknowledged so that the edge can pipeline them
+	and retransmit the unacknowledged ones after reconnecting. Edges PING the hub every HeartbeatInterval,
+	transports without a close handshake rely on it to detect dead links. See Client for the edge side of the protocol.
+*/
+type HubServer struct {
+	indexMap docid.ImmutableIndexMap // Edges keyed with the topics and patterns they are interested in
+	listener net.Listener
+	edges    map[string]*Edge     // Connected edges keyed with edge id
+	applied  map[string]int64     // Id of the last request applied per edge incarnation. Outlives the edge connections, see departed
+	departed map[string]time.Time // Disconnected edge incarnations along with the time they left. Forgotten after AppliedRetention
+	elock    sync.RWMutex         // Edges, Applied and Departed synchronization mutex
+	patterns map[string]int       // Patterns of interest along with the count of interested edges
+	plock    sync.RWMutex         // Patterns synchronization mutex
+}
+
+func InitHubServer(address string) {
+	transport, err := GetTransport(TransportName)
+	if err != nil {
+		log.WithFields("hub.server").Fatal(err)
+	}
+	listener, err := transport.Listen(address)
+	if err != nil {
+		log.WithFields("hub.server").Fatal(err)
+	}
+	log.WithFields("hub.server").Info("Listening on ", address, " over ", TransportName)
+	server := MakeHubServer(listener)
+	if Membership != nil {
+		server.Watch(Membership)
+	}
+	server.Serve()
+}
+
+func MakeHubServer(listener net.Listener) *HubServer {
+	return &HubServer{
+		indexMap: docid.MakeImmutableIndexMap(TopicIdx, PatternIdx),
+		listener: listener,
+		edges:    make(map[string]*Edge),
+		applied:  make(map[string]int64),
+		departed: make(map[string]time.Time),
+		patterns: make(map[string]int),
+	}
+}
+
+// Server run loop that accepts edge connections until the listener is closed
+func (server *HubServer) Serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				stats.IncrFailed()
+				log.WithFields("hub.server").Error(err)
+				continue
+			}
+			log.WithFields("hub.server").Error(err)
+			return
+		}
+		setKeepAlive(conn)
+		go InitEdge(server, conn)
+	}
+}
+
+// Stops accepting edge connections and closes the connected edges
+func (server *HubServer) Close() error {
+	err := server.listener.Close()
+	server.elock.RLock()
+	edges := make([]*Edge, 0, len(server.edges))
+	for _, edge := range server.edges {
+		edges = append(edges, edge)
+	}
+	server.elock.RUnlock()
+	for _, edge := range edges {
+		edge.Close()
+	}
+	return err
+}
+
+// Max time a link can stay silent before it is considered dead
+func idleTimeout() time.Duration {
+	return 3 * HeartbeatInterval
+}
+
+// Drops the connections of the edges that the membership reports dead or removed, along with their interest.
+// Edges linked with their member name are matched, an edge that is still alive reconnects
+func (server *HubServer) Watch(membership cluster.Membership) {
+	membership.OnChange(func(member cluster.Member) {
+		if member.Role != cluster.RoleEdge || (member.State != cluster.Dead && member.State != cluster.Left) {
+			return
+		}
+		server.elock.RLock()
+		edge, ok := server.edges[member.Name]
+		server.elock.RUnlock()
+		if ok {
+			log.WithFields("hub.server", "Watch").Info("Dropping ", edge.String(), ", Member is ", member.State)
+			edge.Close()
+		}
+	})
+}
+
+// Registers the edge under its id. An older connection of the same edge is closed,
+// so that it can not apply requests that the new connection retransmits
+func (server *HubServer) addEdge(edge *Edge) {
+	server.elock.Lock()
+	old, ok := server.edges[edge.DocId()]
+	server.elock.Unlock()
+	if ok && old != edge {
+		log.WithFields("hub.server", "addEdge").Info("Replacing ", old.String())
+		old.Close()
+	}
+	server.elock.Lock()
+	server.edges[edge.DocId()] = edge
+	delete(server.departed, edge.appliedKey())
+	server.elock.Unlock()
+}
+
+// Deregisters the edge. The last request its incarnation applied is remembered for AppliedRetention,
+// the incarnations that left before are forgotten
+func (server *HubServer) removeEdge(edge *Edge) {
+	now := time.Now()
+	server.elock.Lock()
+	if server.edges[edge.DocId()] == edge {
+		delete(server.edges, edge.DocId())
+	}
+	// Incarnation replaced by a newer one departs as well
+	if current, ok := server.edges[edge.DocId()]; !ok || current.appliedKey() != edge.appliedKey() {
+		if _, ok := server.applied[edge.appliedKey()]; ok {
+			server.departed[edge.appliedKey()] = now
+		}
+	}
+	for id, left := range server.departed {
+		if now.Sub(left) > AppliedRetention {
+			delete(server.departed, id)
+			delete(server.applied, id)
+		}
+	}
+	server.elock.Unlock()
+}
+
+// Id of the last request of the edge incarnation applied by the hub, see Edge.appliedKey
+func (server *HubServer) lastApplied(key string) int64 {
+	server.elock.RLock()
+	id := server.applied[key]
+	server.elock.RUnlock()
+	return id
+}
+
+func (server *HubServer) setApplied(key string, id int64) {
+	server.elock.Lock()
+	server.applied[key] = id
+	server.elock.Unlock()
+}
+
+// Forwards msgs published on topic by the source edge to the other edges interested in the topic
+// or in a pattern matching the topic. Each edge receives the msgs once. Returns the number of receiving edges
+func (server *HubServer) Forward(source *Edge, topic string, msgs [][]byte) int {
+	visited := map[string]bool{source.DocId(): true}
+	count := server.forwardTo(TopicIdx, topic, visited, topic, msgs)
+	for _, pattern := range server.matchingPatterns(topic) {
+		count += server.forwardTo(PatternIdx, pattern, visited, topic, msgs)
+	}
+	return count
+}
+
+func (server *HubServer) forwardTo(indexName int, key string, visited map[string]bool, topic string, msgs [][]byte) int {
+	publisher, err := server.indexMap.Query(indexName, &docid.StrId{Id: key})
+	if err != nil {
+		log.WithFields("hub.server", "Forward", topic).Error(err)
+		return 0
+	}
+	count := 0
+	channel := make(chan []docid.DocId)
+	publisher.Emit(channel, 0)
+	for slice := range channel {
+		if len(slice) == 0 {
+			break
+		}
+		for _, docId := range slice {
+			edge, ok := docId.(*Edge)
+			if !ok || visited[edge.DocId()] {
+				continue
+			}
+			visited[edge.DocId()] = true
+			if edge.send(indexName, key, topic, msgs) {
+				count++
+			}
+		}
+	}
+	close(channel)
+	return count
+}
+
+// Registers a pattern of interest
+func (server *HubServer) addPattern(pattern string) {
+	server.plock.Lock()
+	server.patterns[pattern]++
+	server.plock.Unlock()
+}
+
+// Deregisters a pattern of interest. Pattern is forgotten once no edge is interested in it
+func (server *HubServer) removePattern(pattern string) {
+	server.plock.Lock()
+	count := server.patterns[pattern] - 1
+	if count > 0 {
+		server.patterns[pattern] = count
+	} else {
+		delete(server.patterns, pattern)
+	}
+	server.plock.Unlock()
+}
+
+// Patterns of interest matching the topic
+func (server *HubServer) matchingPatterns(topic string) []string {
+	var patterns []string
+	server.plock.RLock()
+	for pattern := range server.patterns {
+		if utils.GlobMatch(pattern, topic) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	server.plock.RUnlock()
+	return patterns
+}
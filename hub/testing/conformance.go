@@ -0,0 +1,282 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pigeond-io/pigeond/common/resp"
+	"github.com/pigeond-io/pigeond/hub"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	Timeout = 5 * time.Second // Max wait for an expected message
+	Settle  = 200 * time.Millisecond
+)
+
+// Links to a stopped hub are detected by the heartbeats on transports without a close handshake,
+// the suite needs them to fire well within Timeout
+func init() {
+	hub.HeartbeatInterval = 200 * time.Millisecond
+}
+
+type Received struct {
+	Topic string
+	Msg   string
+}
+
+// Runs the conformance suite against the transport. Every transport between the edges and the hub must pass it.
+// Address is the local address the transport listens on, e.g. 127.0.0.1:0
+func TransportConformance(t *testing.T, transport hub.Transport, address string) {
+	t.Run("Frames", func(t *testing.T) { testFrames(t, transport, address) })
+	t.Run("Pipelining", func(t *testing.T) { testPipelining(t, transport, address) })
+	t.Run("Routing", func(t *testing.T) { testRouting(t, transport, address) })
+	t.Run("Reconnect", func(t *testing.T) { testReconnect(t, transport, address) })
+}
+
+// Frames of any size arrive whole
+func testFrames(t *testing.T, transport hub.Transport, address string) {
+	sizes := []int{0, 1, 2047, 2048, 2049, 64 << 10, 1 << 20}
+	echo(t, transport, address, func(w *resp.Writer) {
+		for _, size := range sizes {
+			w.WriteBulk(payload(size))
+		}
+	}, func(r *bufio.Reader) {
+		for _, size := range sizes {
+			value, err := resp.ReadValue(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value.Str, payload(size)) {
+				t.Errorf("Frame of %d bytes came back with %d bytes", size, len(value.Str))
+			}
+		}
+	})
+}
+
+// Frames written without waiting for replies arrive in order
+func testPipelining(t *testing.T, transport hub.Transport, address string) {
+	count := 10000
+	echo(t, transport, address, func(w *resp.Writer) {
+		for i := 0; i < count; i++ {
+			w.WriteStrings("PUBLISH", "topic", strconv.Itoa(i))
+		}
+	}, func(r *bufio.Reader) {
+		for i := 0; i < count; i++ {
+			value, err := resp.ReadValue(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg := value.Elems[2].String(); msg != strconv.Itoa(i) {
+				t.Fatalf("Expected frame %d got %s", i, msg)
+			}
+		}
+	})
+}
+
+// Hub forwards the published messages only to the other interested edges
+func testRouting(t *testing.T, transport hub.Transport, address string) {
+	server, address := StartHub(t, transport, address)
+	defer server.Close()
+	edge1, received1 := DialEdge(transport, address)
+	edge2, received2 := DialEdge(transport, address)
+	edge3, received3 := DialEdge(transport, address)
+	defer edge1.Close()
+	defer edge2.Close()
+	defer edge3.Close()
+
+	edge1.Subscribe("news")
+	edge2.PSubscribe("n*")
+	edge2.Subscribe("news")
+	edge3.Subscribe("chat")
+	time.Sleep(Settle) // Interest is registered asynchronously
+
+	large := string(payload(100 << 10))
+	edge1.Publish("news", []byte("a"), []byte(large))
+	Expect(t, received2, Received{"news", "a"}, Received{"news", large})
+	Expect(t, received1)
+	Expect(t, received3)
+
+	edge3.Publish("news", []byte("c"))
+	Expect(t, received1, Received{"news", "c"})
+	Expect(t, received2, Received{"news", "c"})
+
+	edge2.Unsubscribe("news")
+	edge2.PUnsubscribe("n*")
+	time.Sleep(Settle)
+	edge3.Publish("news", []byte("d"))
+	Expect(t, received1, Received{"news", "d"})
+	Expect(t, received2)
+}
+
+// Edges reconnect to a restarted hub, register their interest again and retransmit the publishes not acknowledged
+func testReconnect(t *testing.T, transport hub.Transport, address string) {
+	server, address := StartHub(t, transport, address)
+	edge1, received1 := DialEdge(transport, address)
+	edge2, received2 := DialEdge(transport, address)
+	defer edge1.Close()
+	defer edge2.Close()
+
+	edge1.Subscribe("news")
+	edge2.Subscribe("chat")
+	time.Sleep(Settle)
+	server.Close()
+	Eventually(t, func() bool { return !edge1.IsConnected() && !edge2.IsConnected() })
+
+	edge2.Publish("archive", []byte("while down"))
+	edge1.PSubscribe("sports.*")
+	if edge2.Pending() != 1 {
+		t.Errorf("Expected 1 pending publish got %d", edge2.Pending())
+	}
+	server, _ = StartHub(t, transport, address)
+	defer server.Close()
+	Eventually(t, func() bool { return edge1.IsConnected() && edge2.IsConnected() })
+	Eventually(t, func() bool { return edge2.Pending() == 0 }) // Retransmitted and acknowledged
+	time.Sleep(Settle)
+
+	edge2.Publish("news", []byte("after"))
+	edge2.Publish("sports.tennis", []byte("set"))
+	edge1.Publish("chat", []byte("hi"))
+	Expect(t, received1, Received{"news", "after"}, Received{"sports.tennis", "set"})
+	Expect(t, received2, Received{"chat", "hi"})
+}
+
+// Starts a hub listening on address over the transport. Returns the hub and the address it listens on
+func StartHub(t *testing.T, transport hub.Transport, address string) (*hub.HubServer, string) {
+	var listener net.Listener
+	var err error
+	for i := 0; i < 50; i++ { // Address of a hub that just stopped might not be free yet
+		if listener, err = transport.Listen(address); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := hub.MakeHubServer(listener)
+	go server.Serve()
+	return server, listener.Addr().String()
+}
+
+// Links an edge to the hub at address. Messages forwarded to the edge are sent to the channel
+func DialEdge(transport hub.Transport, address string) (*hub.Client, chan Received) {
+	channel := make(chan Received, 1024)
+	client := hub.MakeClient(transport, hub.StaticAddress(address), "", func(topic string, msg []byte) {
+		channel <- Received{topic, string(msg)}
+	})
+	return client, channel
+}
+
+// Checks that the channel receives exactly the expected messages, in order
+func Expect(t *testing.T, channel chan Received, expected ...Received) {
+	for _, e := range expected {
+		select {
+		case r := <-channel:
+			if r != e {
+				t.Errorf("Expected %.40v got %.40v", e, r)
+			}
+		case <-time.After(Timeout):
+			t.Errorf("Expected %.40v got nothing", e)
+		}
+	}
+	select {
+	case r := <-channel:
+		t.Errorf("Unexpected %.40v", r)
+	case <-time.After(Settle):
+	}
+}
+
+// Checks that the channel receives exactly the expected messages, in any order
+func ExpectUnordered(t *testing.T, channel chan Received, expected ...Received) {
+	missing := make(map[Received]int)
+	for _, e := range expected {
+		missing[e]++
+	}
+	for range expected {
+		select {
+		case r := <-channel:
+			if missing[r] == 0 {
+				t.Errorf("Unexpected %.40v", r)
+			}
+			missing[r]--
+		case <-time.After(Timeout):
+			t.Errorf("Expected %d more messages", len(expected))
+			return
+		}
+	}
+	Expect(t, channel)
+}
+
+// Waits until the condition holds
+func Eventually(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met within ", Timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Writes frames to a server that echoes every frame back while reading the echoes
+func echo(t *testing.T, transport hub.Transport, address string, write func(*resp.Writer), read func(*bufio.Reader)) {
+	listener, err := transport.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		for {
+			value, err := resp.ReadValue(reader)
+			if err != nil {
+				return
+			}
+			if value.Type == resp.Array {
+				w := resp.MakeWriter(writer)
+				w.WriteArrayHeader(len(value.Elems))
+				for _, elem := range value.Elems {
+					w.WriteBulk(elem.Str)
+				}
+			} else {
+				resp.MakeWriter(writer).WriteBulk(value.Str)
+			}
+			if reader.Buffered() == 0 {
+				writer.Flush()
+			}
+		}
+	}()
+	conn, err := transport.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(4 * Timeout))
+	go func() {
+		writer := bufio.NewWriter(conn)
+		write(resp.MakeWriter(writer))
+		writer.Flush()
+	}()
+	read(bufio.NewReader(conn))
+}
+
+func payload(size int) []byte {
+	slice := make([]byte, size)
+	for i := range slice {
+		slice[i] = byte('a' + i%26)
+	}
+	return slice
+}
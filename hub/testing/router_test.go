@@ -0,0 +1,142 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing_test
+
+import (
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/hub"
+	. "github.com/pigeond-io/pigeond/hub/testing"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Membership whose members are set by the test
+type fakeMembership struct {
+	members  map[string]cluster.Member
+	handlers []cluster.ChangeHandler
+	lock     sync.Mutex
+}
+
+func (m *fakeMembership) Self() cluster.Member {
+	return cluster.Member{Name: "edge", Role: cluster.RoleEdge, State: cluster.Alive}
+}
+
+func (m *fakeMembership) Members() []cluster.Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var members []cluster.Member
+	for _, member := range m.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+func (m *fakeMembership) Alive(role string) []cluster.Member {
+	var alive []cluster.Member
+	for _, member := range m.Members() {
+		if member.Role == role && member.State == cluster.Alive {
+			alive = append(alive, member)
+		}
+	}
+	return alive
+}
+
+func (m *fakeMembership) OnChange(handler cluster.ChangeHandler) {
+	m.lock.Lock()
+	m.handlers = append(m.handlers, handler)
+	m.lock.Unlock()
+}
+
+func (m *fakeMembership) Close() {}
+
+func (m *fakeMembership) set(member cluster.Member) {
+	m.lock.Lock()
+	m.members[member.Name] = member
+	handlers := m.handlers
+	m.lock.Unlock()
+	for _, handler := range handlers {
+		handler(member)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	transport, err := hub.GetTransport("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub1, address1 := StartHub(t, transport, "127.0.0.1:0")
+	hub2, address2 := StartHub(t, transport, "127.0.0.1:0")
+	defer hub1.Close()
+	defer hub2.Close()
+	membership := &fakeMembership{members: make(map[string]cluster.Member)}
+	membership.set(cluster.Member{Name: "hub-1", Role: cluster.RoleHub, Address: address1, State: cluster.Alive})
+	membership.set(cluster.Member{Name: "hub-2", Role: cluster.RoleHub, Address: address2, State: cluster.Alive})
+
+	var routers []*hub.Router
+	var channels []chan Received
+	for i := 0; i < 2; i++ {
+		channel := make(chan Received, 1024)
+		router := hub.MakeRouter(transport, membership, "edge-"+strconv.Itoa(i), func(topic string, msg []byte) {
+			channel <- Received{topic, string(msg)}
+		})
+		defer router.Close()
+		routers = append(routers, router)
+		channels = append(channels, channel)
+	}
+
+	// Topics are spread over both hubs
+	var topics []string
+	owners := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		topic := "topic-" + strconv.Itoa(i)
+		topics = append(topics, topic)
+		owners[routers[0].Owner(topic)] = true
+		if routers[0].Owner(topic) != routers[1].Owner(topic) {
+			t.Fatalf("Edges disagree on the owner of %s", topic)
+		}
+	}
+	if len(owners) != 2 {
+		t.Fatalf("Expected topics on both hubs got %v", owners)
+	}
+	routers[1].Subscribe(topics...)
+	routers[1].PSubscribe("news.*")
+	time.Sleep(Settle)
+
+	publish := func(msg string) []Received {
+		var expected []Received
+		for _, topic := range append(topics, "news.sports") {
+			routers[0].Publish(topic, []byte(msg))
+			expected = append(expected, Received{topic, msg})
+		}
+		return expected
+	}
+	expected := publish("a")
+	ExpectUnordered(t, channels[1], expected...)
+	Expect(t, channels[0])
+
+	// Topics of a dead hub move to the other hub
+	hub2.Close()
+	membership.set(cluster.Member{Name: "hub-2", Role: cluster.RoleHub, Address: address2, State: cluster.Dead})
+	for _, topic := range topics {
+		if owner := routers[0].Owner(topic); owner != "hub-1" {
+			t.Fatalf("Expected hub-1 to own %s got %s", topic, owner)
+		}
+	}
+	time.Sleep(Settle)
+	expected = publish("b")
+	ExpectUnordered(t, channels[1], expected...)
+
+	routers[1].Unsubscribe(topics...)
+	routers[1].PUnsubscribe("news.*")
+	time.Sleep(Settle)
+	publish("c")
+	Expect(t, channels[1])
+}
@@ -0,0 +1,19 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package testing_test
+
+import (
+	"github.com/pigeond-io/pigeond/hub"
+	. "github.com/pigeond-io/pigeond/hub/testing"
+	"testing"
+)
+
+func TestTcpTransport(t *testing.T) {
+	transport, err := hub.GetTransport("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TransportConformance(t, transport, "127.0.0.1:0")
+}
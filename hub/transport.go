@@ -0,0 +1,88 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package hub
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	TransportName = "tcp"           // Transport between the edges and the hub
+	DialTimeout   = 5 * time.Second // Max time to establish a connection to the hub
+	Secret        = ""              // Shared secret the edges present with HELLO. The hub lets every peer in when empty
+)
+
+/*
+	Transport carries the frames exchanged by the edges and the hub.
+	Connections of a transport must be reliable, ordered byte streams, the frames are delimited by the RESP
+	framing on top of them. TCP is always available, other transports register themselves from init.
+*/
+type Transport interface {
+	Dial(address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+var (
+	transports = map[string]Transport{"tcp": tcpTransport{}}
+	tlock      sync.RWMutex // Transports synchronization mutex
+)
+
+// Makes the transport available under the name
+func RegisterTransport(name string, transport Transport) {
+	tlock.Lock()
+	transports[name] = transport
+	tlock.Unlock()
+}
+
+// Transport registered under the name
+func GetTransport(name string) (Transport, error) {
+	tlock.RLock()
+	transport, ok := transports[name]
+	tlock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown transport %s, available: %v", name, TransportNames())
+	}
+	return transport, nil
+}
+
+// Names of the registered transports, sorted
+func TransportNames() []string {
+	tlock.RLock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	tlock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn)
+	return conn, nil
+}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// Detects dead peers on idle TCP connections
+func setKeepAlive(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(KeepAliveInterval)
+	}
+}
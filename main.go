@@ -5,14 +5,21 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"github.com/pigeond-io/pigeond/common/auth"
+	"github.com/pigeond-io/pigeond/common/cluster"
 	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/stats"
 	"github.com/pigeond-io/pigeond/common/utils"
+	"github.com/pigeond-io/pigeond/datastore"
 	"github.com/pigeond-io/pigeond/edge"
+	"github.com/pigeond-io/pigeond/edge/client"
+	"github.com/pigeond-io/pigeond/hub"
+	"github.com/pigeond-io/pigeond/origin"
 	"gopkg.in/urfave/cli.v1"
 	"os"
-	"github.com/pigeond-io/pigeond/common/stats"
-	"bufio"
+	"strings"
 )
 
 var flags = []cli.Flag{
@@ -26,21 +33,96 @@ var flags = []cli.Flag{
 		Value: "localhost:8765",
 		Usage: "websocket port",
 	},
+	cli.StringFlag{
+		Name:  "hub-address",
+		Value: "",
+		Usage: "hub address the edge connects to, the edge runs standalone when empty",
+	},
+	cli.StringFlag{
+		Name:  "hub-listen-address",
+		Value: "localhost:8766",
+		Usage: "address the hub listens on for edge connections",
+	},
+	cli.StringFlag{
+		Name:  "hub-secret",
+		Value: "",
+		Usage: "shared secret the edges, origins and data stores present to the hubs, empty lets every peer in",
+	},
+	cli.StringFlag{
+		Name:  "hub-transport",
+		Value: hub.TransportName,
+		Usage: "transport between the edges and the hub, one of " + strings.Join(hub.TransportNames(), ", "),
+	},
+	cli.StringFlag{
+		Name:  "origin-address",
+		Value: "localhost:8767",
+		Usage: "address the origin serves the http publish api on",
+	},
+	cli.StringFlag{
+		Name:  "data-store-address",
+		Value: "localhost:8768",
+		Usage: "address the data store serves on",
+	},
+	cli.StringFlag{
+		Name:  "edge-data-store-address",
+		Value: "",
+		Usage: "address of the data store the edge reads the history beyond history-size from and saves the session subscriptions to, empty keeps them in memory only",
+	},
+	cli.StringFlag{
+		Name:  "data-dir",
+		Value: datastore.DataDir,
+		Usage: "directory the data store keeps its segment logs in",
+	},
+	cli.StringFlag{
+		Name:  "durable-topics",
+		Value: strings.Join(datastore.DurableTopics, ","),
+		Usage: "comma separated patterns of the topics the data store persists",
+	},
+	cli.Int64Flag{
+		Name:  "data-retention-size",
+		Value: datastore.RetentionSize,
+		Usage: "max bytes of messages the data store keeps per topic, 0 keeps everything",
+	},
+	cli.DurationFlag{
+		Name:  "data-retention-age",
+		Value: datastore.RetentionAge,
+		Usage: "max age of the messages the data store keeps, 0 keeps everything",
+	},
+	cli.DurationFlag{
+		Name:  "data-compact-interval",
+		Value: datastore.CompactInterval,
+		Usage: "interval between two compactions of the duplicated messages, 0 disables the compaction",
+	},
+	cli.StringFlag{
+		Name:  "node-name",
+		Value: "",
+		Usage: "name of the node in the members file, defaults to the hostname",
+	},
+	cli.StringFlag{
+		Name:  "members-file",
+		Value: "",
+		Usage: "file listing the cluster members, edges link to every alive hub when hub-address is empty",
+	},
+	cli.StringFlag{
+		Name:  "gossip-address",
+		Value: "",
+		Usage: "address the node gossips cluster membership on e.g. hub-1:7946, ignored with members-file",
+	},
+	cli.StringFlag{
+		Name:  "join",
+		Value: "",
+		Usage: "comma separated gossip addresses of the members to join the cluster through. Empty starts a new cluster",
+	},
+	cli.StringFlag{
+		Name:  "advertise-address",
+		Value: "",
+		Usage: "address the other members reach the service on, defaults to the address the service listens on",
+	},
 	cli.IntFlag{
 		Name:  "ws-port",
 		Value: 8001,
 		Usage: "websocket port",
 	},
-	cli.IntFlag{
-		Name:  "udp-port",
-		Value: 8002,
-		Usage: "udp port",
-	},
-	cli.IntFlag{
-		Name:  "ws-buffer-size",
-		Value: 2048,
-		Usage: "websocket read buffer size",
-	},
 	cli.BoolFlag{
 		Name:  "debug",
 		Usage: "enable debug mode",
@@ -50,6 +132,173 @@ var flags = []cli.Flag{
 		Value: "",
 		Usage: "log file path",
 	},
+	cli.BoolTFlag{
+		Name:  "allow-anonymous",
+		Usage: "allow websocket connections without jwt token",
+	},
+	cli.DurationFlag{
+		Name:  "session-grace-period",
+		Value: edge.SessionGracePeriod,
+		Usage: "time a disconnected session keeps its subscriptions",
+	},
+	cli.IntFlag{
+		Name:  "session-buffer-size",
+		Value: edge.SessionBufferSize,
+		Usage: "max messages buffered per session for replay on RESUME",
+	},
+	cli.DurationFlag{
+		Name:  "session-buffer-age",
+		Value: edge.SessionBufferAge,
+		Usage: "max age of the messages buffered per session for replay on RESUME",
+	},
+	cli.StringFlag{
+		Name:  "snapshot-file",
+		Value: edge.SnapshotFile,
+		Usage: "file the edge snapshots its sessions to and restores them from on start, empty disables the snapshots",
+	},
+	cli.DurationFlag{
+		Name:  "snapshot-interval",
+		Value: edge.SnapshotInterval,
+		Usage: "interval between two snapshots of the edge sessions, the sessions are snapshotted on exit only when <= 0",
+	},
+	cli.IntFlag{
+		Name:  "history-size",
+		Value: edge.HistorySize,
+		Usage: "messages retained per topic for HISTORY, 0 disables the history",
+	},
+	cli.DurationFlag{
+		Name:  "history-age",
+		Value: edge.HistoryAge,
+		Usage: "max age of the messages retained per topic for HISTORY",
+	},
+	cli.StringFlag{
+		Name:  "allowed-hosts",
+		Value: "",
+		Usage: "comma separated list of allowed Host headers e.g. ws.example.com,*.example.com. Empty allows every host",
+	},
+	cli.StringFlag{
+		Name:  "allowed-origins",
+		Value: "",
+		Usage: "comma separated list of allowed Origin headers e.g. https://*.example.com. Empty allows every origin",
+	},
+	cli.StringFlag{
+		Name:  "jwt-secret",
+		Value: "",
+		Usage: "shared secret to verify HMAC (HS256, HS384, HS512) signed jwt tokens",
+	},
+	cli.StringFlag{
+		Name:  "jwt-key-file",
+		Value: "",
+		Usage: "public keys to verify RSA & ECDSA signed jwt tokens. PEM file or JWKS (.json) file, reloaded on change",
+	},
+	cli.StringFlag{
+		Name:  "jwt-algorithms",
+		Value: "",
+		Usage: "comma separated list of accepted jwt signing algorithms e.g. RS256,ES256",
+	},
+	cli.StringFlag{
+		Name:  "jwt-issuer",
+		Value: "",
+		Usage: "required jwt iss claim",
+	},
+	cli.StringFlag{
+		Name:  "jwt-audience",
+		Value: "",
+		Usage: "required jwt aud claim",
+	},
+	cli.DurationFlag{
+		Name:  "jwt-leeway",
+		Value: 0,
+		Usage: "allowed clock skew while validating jwt exp, nbf & iat claims",
+	},
+	cli.BoolFlag{
+		Name:  "jwt-require-exp",
+		Usage: "reject jwt tokens without exp claim",
+	},
+}
+
+// Creates the jwt verifier from the jwt-* flags. Returns nil if neither secret nor key file is provided
+func makeTokenVerifier(c *cli.Context) (auth.Verifier, error) {
+	secret := c.String("jwt-secret")
+	keyFile := c.String("jwt-key-file")
+	var keys auth.KeySet
+	switch {
+	case secret != "" && keyFile != "":
+		return nil, errors.New("jwt-secret and jwt-key-file are mutually exclusive")
+	case secret != "":
+		keys = auth.MakeStaticKeySet().Add("", []byte(secret))
+	case keyFile != "":
+		fileKeys, err := auth.MakeFileKeySet(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = fileKeys
+	default:
+		return nil, nil
+	}
+	return auth.MakeJwtVerifier(keys, auth.VerifierOptions{
+		Algorithms: splitList(c.String("jwt-algorithms")),
+		Issuer:     c.String("jwt-issuer"),
+		Audience:   c.String("jwt-audience"),
+		Leeway:     c.Duration("jwt-leeway"),
+		RequireExp: c.Bool("jwt-require-exp"),
+	}), nil
+}
+
+// Membership of the members listed in members-file, or of the gossip cluster joined through the join seeds
+// when gossip-address is set. Nil when there is neither
+func makeMembership(c *cli.Context, service string) (cluster.Membership, error) {
+	path := c.String("members-file")
+	gossipAddress := c.String("gossip-address")
+	if path == "" && gossipAddress == "" {
+		return nil, nil
+	}
+	name := c.String("node-name")
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		name = hostname
+	}
+	if path != "" {
+		return cluster.MakeFileMembership(name, path)
+	}
+	self := cluster.Member{
+		Name:      name,
+		Role:      service,
+		Address:   c.String("advertise-address"),
+		Heartbeat: gossipAddress,
+		Meta:      map[string]string{"transport": c.String("hub-transport")},
+	}
+	if self.Address == "" {
+		switch service {
+		case cluster.RoleHub:
+			self.Address = c.String("hub-listen-address")
+		case cluster.RoleOrigin:
+			self.Address = c.String("origin-address")
+		case cluster.RoleDataStore:
+			self.Address = c.String("data-store-address")
+		default:
+			self.Address = c.String("ws-address")
+		}
+	}
+	membership, err := cluster.MakeGossipMembership(self, splitList(c.String("join"))...)
+	if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// Splits a comma separated flag value
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 func main() {
@@ -71,24 +320,84 @@ func main() {
 		//Set logging
 		logFile := c.String("log")
 		debugMode := c.Bool("debug")
-		utils.InitProcess("edge", func(name string) {
+		service := c.String("service")
+		utils.InitProcess(service, func(name string) {
 			log.Init(name, logFile, debugMode)
 		})
+		hub.TransportName = c.String("hub-transport")
+		hub.Secret = c.String("hub-secret")
+		membership, err := makeMembership(c, service)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
 		utils.OnProcessExit(func() {
 			//close file descriptors
+			if membership != nil {
+				membership.Close()
+			}
 		})
 
-		service := c.String("service")
-
 		switch service {
 		case "edge":
 			addr := c.String("ws-address")
+			verifier, err := makeTokenVerifier(c)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			if verifier == nil {
+				log.Info("No jwt-secret or jwt-key-file provided, tokens will be rejected")
+			}
+			edge.TokenVerifier = verifier
+			edge.AllowAnonymousConnections = c.BoolT("allow-anonymous")
+			edge.SessionGracePeriod = c.Duration("session-grace-period")
+			edge.SessionBufferSize = c.Int("session-buffer-size")
+			edge.SessionBufferAge = c.Duration("session-buffer-age")
+			edge.SnapshotFile = c.String("snapshot-file")
+			edge.SnapshotInterval = c.Duration("snapshot-interval")
+			edge.HistorySize = c.Int("history-size")
+			edge.HistoryAge = c.Duration("history-age")
+			if address := c.String("edge-data-store-address"); address != "" {
+				edge.DataStore = datastore.MakeClient(address)
+			}
+			edge.AllowedHosts = splitList(c.String("allowed-hosts"))
+			edge.AllowedOrigins = splitList(c.String("allowed-origins"))
+			client.AllowedOrigins = edge.AllowedOrigins
+			edge.HubAddress = c.String("hub-address")
+			edge.Membership = membership
 			// wsPort := c.Int("wd-port")
-			// udpPort := c.Int("udp-port")
-			// wsBufferSize := c.Int("ws-buffer-size")
-			// edge.Init(wsPort, udpPort, wsBufferSize)
+			// edge.Init(wsPort)
 			edge.InitWsServer(addr)
 			break
+		case "hub":
+			hub.Membership = membership
+			hub.InitHubServer(c.String("hub-listen-address"))
+			break
+		case "origin":
+			verifier, err := makeTokenVerifier(c)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			if verifier == nil {
+				log.Info("No jwt-secret or jwt-key-file provided, service tokens will be rejected")
+			}
+			origin.TokenVerifier = verifier
+			origin.HubAddress = c.String("hub-address")
+			origin.Membership = membership
+			origin.InitOriginServer(c.String("origin-address"))
+			break
+		case "data_store":
+			datastore.DataDir = c.String("data-dir")
+			datastore.DurableTopics = splitList(c.String("durable-topics"))
+			datastore.RetentionSize = c.Int64("data-retention-size")
+			datastore.RetentionAge = c.Duration("data-retention-age")
+			datastore.CompactInterval = c.Duration("data-compact-interval")
+			datastore.HubAddress = c.String("hub-address")
+			datastore.Membership = membership
+			datastore.InitDataStoreServer(c.String("data-store-address"))
+			break
 		default:
 			log.Error("Invalid service name")
 			return errors.New("invalid service name")
@@ -0,0 +1,191 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package origin
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pigeond-io/pigeond/common/auth"
+	"github.com/pigeond-io/pigeond/common/cluster"
+	"github.com/pigeond-io/pigeond/common/log"
+	"github.com/pigeond-io/pigeond/common/stats"
+	"github.com/pigeond-io/pigeond/hub"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	TokenVerifier auth.Verifier      // Verifies the service tokens. When nil every call is rejected
+	ServiceClaim  = "svc"            // Name of the jwt claim identifying the backend service. Tokens without it are not service tokens
+	MaxBatchSize  = 1000             // Max messages published by a call
+	MaxBodySize   = int64(1 << 20)   // Max size of the request body in bytes
+	HubAddress    = ""               // Address of the hub the messages are pushed to
+	Membership    cluster.Membership // Cluster membership. Messages are pushed to the owner hub of the topic when HubAddress is empty
+)
+
+var (
+	errorNoHub           = errors.New("Origin needs a hub-address or a cluster membership")
+	errorNoTokenVerifier = errors.New("Token verification is not configured")
+	errorNoToken         = errors.New("Missing bearer token")
+	errorNotService      = errors.New("Not a service token")
+)
+
+type publishRequest struct {
+	Messages []struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"messages"`
+}
+
+type publishResponse struct {
+	Topic     string `json:"topic"`
+	Published int    `json:"published"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+/*
+	Origin is the authoritative publish API of the backend services, which publish without opening a websocket.
+
+		POST /topics/{topic}/messages
+		Authorization: Bearer service-token
+		{"messages": [{"data": "text"}, {"data": {"any": "json"}}]}
+
+		202 Accepted
+		{"topic": "news", "published": 2}
+
+	String data is published as is and any other json value as its encoding. The batch is pushed to the hubs,
+	which forward it to the interested edges. The edges assign the ids the subscribers receive the messages with.
+	Service tokens are jwt tokens verified by TokenVerifier that carry the ServiceClaim,
+	their acl claim scopes the topics the service can publish on.
+*/
+type OriginServer struct {
+	hub hub.Link
+}
+
+// Serves the publish API on address, pushing the messages to the hubs
+func InitOriginServer(address string) {
+	link, err := hub.MakeLink(HubAddress, Membership, "", func(string, []byte) {})
+	if err == nil && link == nil {
+		err = errorNoHub
+	}
+	if err != nil {
+		log.WithFields("origin.server").Fatal(err)
+	}
+	log.WithFields("origin.server").Info("Serving publish api on ", address)
+	err = http.ListenAndServe(address, MakeOriginServer(link))
+	log.WithFields("origin.server").Fatal(err)
+}
+
+// Makes the publish api handler pushing the messages to the link
+func MakeOriginServer(link hub.Link) *OriginServer {
+	return &OriginServer{hub: link}
+}
+
+func (server *OriginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topic, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	acl, err := authorize(r)
+	if err != nil {
+		log.WithFields("origin.server", "ServeHTTP", topic).Debug(err)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !acl.CanPublish(topic) {
+		writeError(w, http.StatusForbidden, "Not allowed to publish on "+topic)
+		return
+	}
+	var req publishRequest
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid body, "+err.Error())
+		return
+	}
+	if len(req.Messages) == 0 || len(req.Messages) > MaxBatchSize {
+		writeError(w, http.StatusBadRequest, "Expected 1 to "+strconv.Itoa(MaxBatchSize)+" messages")
+		return
+	}
+	payloads := make([][]byte, 0, len(req.Messages))
+	for i, msg := range req.Messages {
+		payload, err := decodeData(msg.Data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Message "+strconv.Itoa(i)+", "+err.Error())
+			return
+		}
+		payloads = append(payloads, payload)
+	}
+	if err = server.hub.Publish(topic, payloads...); err != nil {
+		log.WithFields("origin.server", "ServeHTTP", topic).Error(err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	stats.IncrServed()
+	writeJson(w, http.StatusAccepted, publishResponse{Topic: topic, Published: len(payloads)})
+}
+
+// Topic of /topics/{topic}/messages. Topics may contain slashes
+func parsePath(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/topics/") || !strings.HasSuffix(path, "/messages") {
+		return "", false
+	}
+	topic := strings.TrimSuffix(strings.TrimPrefix(path, "/topics/"), "/messages")
+	return topic, topic != "" && !strings.HasSuffix(path, "//messages")
+}
+
+// Verifies the bearer service token. Returns the acl of the service
+func authorize(r *http.Request) (*auth.TopicAcl, error) {
+	if TokenVerifier == nil {
+		return nil, errorNoTokenVerifier
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, errorNoToken
+	}
+	jToken, err := TokenVerifier.Parse(strings.TrimSpace(header[7:]))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := jToken.Claims.(jwt.MapClaims)
+	if !ok || !jToken.Valid {
+		return nil, errorNotService
+	}
+	if service, _ := claims[ServiceClaim].(string); service == "" {
+		return nil, errorNotService
+	}
+	return auth.ParseTopicAcl(claims), nil
+}
+
+func decodeData(data json.RawMessage) ([]byte, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, errors.New("missing data")
+	}
+	if data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		return []byte(s), err
+	}
+	return []byte(data), nil
+}
+
+func writeError(w http.ResponseWriter, code int, reason string) {
+	stats.IncrFailed()
+	writeJson(w, code, errorResponse{Error: reason})
+}
+
+func writeJson(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
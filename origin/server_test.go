@@ -0,0 +1,105 @@
+// Copyright 2018 The PigeonD Authors. All rights reserved.
+// Use of this source code is governed by a GNU AGPL v3.0
+// license that can be found in the AGPL V3 LICENSE file.
+
+package origin_test
+
+import (
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pigeond-io/pigeond/common/auth"
+	"github.com/pigeond-io/pigeond/hub"
+	hubtesting "github.com/pigeond-io/pigeond/hub/testing"
+	"github.com/pigeond-io/pigeond/origin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("secret")
+
+func token(t *testing.T, claims jwt.MapClaims) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestPublish(t *testing.T) {
+	origin.TokenVerifier = auth.MakeJwtVerifier(auth.MakeStaticKeySet().Add("", secret), auth.VerifierOptions{})
+	origin.MaxBatchSize = 3
+	transport, err := hub.GetTransport("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, address := hubtesting.StartHub(t, transport, "127.0.0.1:0")
+	defer server.Close()
+	edge, received := hubtesting.DialEdge(transport, address)
+	defer edge.Close()
+	edge.Subscribe("news")
+	link := hub.MakeClient(transport, hub.StaticAddress(address), "origin", nil)
+	defer link.Close()
+	time.Sleep(hubtesting.Settle)
+
+	api := httptest.NewServer(origin.MakeOriginServer(link))
+	defer api.Close()
+	service := token(t, jwt.MapClaims{"svc": "billing", "acl": map[string]interface{}{"publish": []string{"news"}}})
+	post := func(path string, token string, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, api.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var reply map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&reply)
+		if reason, ok := reply["error"]; ok {
+			return res.StatusCode, reason.(string)
+		}
+		return res.StatusCode, ""
+	}
+
+	batch := `{"messages": [{"data": "hello"}, {"data": {"n": 1}}]}`
+	failures := []struct {
+		path  string
+		token string
+		body  string
+		code  int
+	}{
+		{"/topics/news", service, batch, http.StatusNotFound},
+		{"/topics/news/messages", "", batch, http.StatusUnauthorized},
+		{"/topics/news/messages", "garbage", batch, http.StatusUnauthorized},
+		{"/topics/news/messages", token(t, jwt.MapClaims{"uid": "u1"}), batch, http.StatusUnauthorized},
+		{"/topics/chat/messages", service, batch, http.StatusForbidden},
+		{"/topics/news/messages", service, `{"messages": [`, http.StatusBadRequest},
+		{"/topics/news/messages", service, `{"messages": []}`, http.StatusBadRequest},
+		{"/topics/news/messages", service, `{"messages": [{"data": 1}, {"data": 2}, {"data": 3}, {"data": 4}]}`, http.StatusBadRequest},
+		{"/topics/news/messages", service, `{"messages": [{"data": 1}, {}]}`, http.StatusBadRequest},
+	}
+	for _, f := range failures {
+		if code, reason := post(f.path, f.token, f.body); code != f.code || reason == "" {
+			t.Errorf("%s %.40s expected %d got %d %s", f.path, f.body, f.code, code, reason)
+		}
+	}
+	hubtesting.Expect(t, received)
+
+	req, _ := http.NewRequest(http.MethodPost, api.URL+"/topics/news/messages", strings.NewReader(batch))
+	req.Header.Set("Authorization", "Bearer "+service)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var reply map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&reply)
+	if res.StatusCode != http.StatusAccepted || reply["topic"] != "news" || reply["published"] != float64(2) || len(reply) != 2 {
+		t.Errorf("Unexpected reply %d %v", res.StatusCode, reply)
+	}
+	hubtesting.Expect(t, received, hubtesting.Received{Topic: "news", Msg: "hello"}, hubtesting.Received{Topic: "news", Msg: `{"n": 1}`})
+}